@@ -0,0 +1,298 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/giantswarm/conair/fileutil"
+	"github.com/giantswarm/conair/runner"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	tarMagic   = []byte("ustar")
+)
+
+// offset of the magic in a tar header
+const tarMagicOffset = 257
+
+// Extensions are the file extensions of the compressed tar archives Decompress
+// reads, best compression first.
+var Extensions = []string{".tar.zst", ".tar.xz", ".tar.gz", ".tar.bz2"}
+
+// Decompress returns a reader for the decompressed content of r, which has to
+// be closed. Gzip and bzip2 compression are detected, and xz and zstd if the
+// xz or zstd tool is installed. Everything else is returned unchanged.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return ioutil.NopCloser(bzip2.NewReader(br)), nil
+	case bytes.HasPrefix(magic, xzMagic):
+		return decompressCommand(br, "xz", "-dc")
+	case bytes.HasPrefix(magic, zstdMagic):
+		return decompressCommand(br, "zstd", "-dcq")
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// commandReader reads the output of a decompression tool. It returns the
+// error of the tool at the end of the output, a truncated archive is an error.
+type commandReader struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+// decompressCommand runs a tool of the host which has no implementation in
+// the standard library.
+func decompressCommand(r io.Reader, tool string, args ...string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+
+	cmd := exec.CommandContext(ctx, tool, args...)
+	cmd.Stdin = r
+	cmd.Stdout = pw
+	cmd.Stderr = os.Stderr
+	go func() {
+		err := runner.Default.Run(cmd)
+		if errors.Is(err, exec.ErrNotFound) {
+			err = fmt.Errorf("Couldn't find %s. Please install it to extract this archive.", tool)
+		} else if err != nil {
+			err = fmt.Errorf("%s failed: %v", tool, err)
+		}
+		pw.CloseWithError(err)
+	}()
+	return &commandReader{PipeReader: pr, cancel: cancel}, nil
+}
+
+// Close stops the tool if the output wasn't read to the end.
+func (c *commandReader) Close() error {
+	c.cancel()
+	return c.PipeReader.Close()
+}
+
+// IsArchive returns whether the file at path is a tar archive, which may be
+// compressed.
+func IsArchive(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	r, err := Decompress(f)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	header := make([]byte, tarMagicOffset+len(tarMagic))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return false
+	}
+	return bytes.Equal(header[tarMagicOffset:], tarMagic)
+}
+
+// ExtractFile extracts the (compressed) tar archive at path into dest.
+func ExtractFile(path, dest string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := Decompress(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return Untar(r, dest)
+}
+
+// Untar extracts a tar stream into the directory dest. Ownership, permissions
+// and timestamps are preserved. Entries can't be written outside of dest,
+// neither by ".." in their names nor by symlinks.
+func Untar(r io.Reader, dest string) error {
+	return untar(r, dest, false)
+}
+
+// ApplyLayer extracts a layer, a tar stream written by Diff or another OCI
+// compatible tool, onto the directory dest. Whiteouts remove the files of the
+// layers below.
+func ApplyLayer(r io.Reader, dest string) error {
+	return untar(r, dest, true)
+}
+
+func untar(r io.Reader, dest string, layer bool) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	dirs := map[string]*tar.Header{}
+	// files of the layer itself survive opaque whiteouts
+	extracted := map[string]bool{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// the parent is resolved within dest, the entry itself is replaced
+		name := filepath.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		parent, err := fileutil.SecureJoin(dest, filepath.Dir(name))
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(parent, filepath.Base(name))
+
+		if base := filepath.Base(name); layer && strings.HasPrefix(base, whiteoutPrefix) {
+			if err := whiteout(dest, parent, base, extracted); err != nil {
+				return fmt.Errorf("Can't apply whiteout %s: %v", hdr.Name, err)
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+
+		if err := extract(tr, hdr, dest, target); err != nil {
+			return fmt.Errorf("Can't extract %s: %v", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs[target] = hdr
+		}
+		extracted[target] = true
+	}
+
+	// directory timestamps change while their content is extracted
+	for dir, hdr := range dirs {
+		if err := os.Chtimes(dir, accessTime(hdr), hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extract(tr *tar.Reader, hdr *tar.Header, dest, target string) error {
+	mode := uint32(hdr.Mode & 07777)
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		source, err := fileutil.SecureJoin(dest, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		return os.Link(source, target)
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+		return os.Lchown(target, hdr.Uid, hdr.Gid)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		kind := map[byte]uint32{
+			tar.TypeChar:  syscall.S_IFCHR,
+			tar.TypeBlock: syscall.S_IFBLK,
+			tar.TypeFifo:  syscall.S_IFIFO,
+		}[hdr.Typeflag]
+		dev := int((hdr.Devmajor&0xfff)<<8 | hdr.Devminor&0xff | (hdr.Devminor&^0xff)<<12)
+		if err := syscall.Mknod(target, kind|mode, dev); err != nil {
+			return err
+		}
+	case tar.TypeXGlobalHeader:
+		return nil
+	default:
+		return fmt.Errorf("unsupported type %c", hdr.Typeflag)
+	}
+
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	// chown clears setuid bits, so the mode is set afterwards
+	if err := os.Chmod(target, os.FileMode(mode&0777)|modeBits(mode)); err != nil {
+		return err
+	}
+	for key, value := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "SCHILY.xattr.") {
+			if err := syscall.Setxattr(target, strings.TrimPrefix(key, "SCHILY.xattr."), []byte(value), 0); err != nil {
+				return err
+			}
+		}
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+	return os.Chtimes(target, accessTime(hdr), hdr.ModTime)
+}
+
+func modeBits(mode uint32) os.FileMode {
+	var m os.FileMode
+	if mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+func accessTime(hdr *tar.Header) time.Time {
+	if hdr.AccessTime.IsZero() {
+		return hdr.ModTime
+	}
+	return hdr.AccessTime
+}
@@ -0,0 +1,31 @@
+package archive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/giantswarm/conair/runner"
+)
+
+func TestDecompressXz(t *testing.T) {
+	rec := &runner.Recorder{Handler: func(call runner.Call) ([]byte, error) {
+		return []byte("decompressed"), nil
+	}}
+	old := runner.Default
+	runner.Default = rec
+	defer func() { runner.Default = old }()
+
+	r, err := Decompress(bytes.NewReader(append(append([]byte{}, xzMagic...), "data"...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "decompressed" {
+		t.Fatalf("unexpected output %q %v", data, err)
+	}
+	if cmds := rec.Commands(); len(cmds) != 1 || cmds[0] != "xz -dc" {
+		t.Errorf("unexpected commands %v", cmds)
+	}
+}
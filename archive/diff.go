@@ -0,0 +1,208 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/giantswarm/conair/fileutil"
+)
+
+const (
+	// whiteoutPrefix marks a file removed by a layer, like in OCI images
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque removes everything the layers below have in a directory
+	whiteoutOpaque = whiteoutPrefix + ".wh..opq"
+)
+
+// Diff writes the changes from the directory tree base to dir as a tar
+// stream: new and changed files, and whiteouts for removed ones. An empty base
+// writes all of dir. Files are compared by their metadata, like rsync does,
+// so snapshots which keep the timestamps of their parent produce small diffs.
+func Diff(w io.Writer, base, dir string) error {
+	tw := tar.NewWriter(w)
+
+	if base != "" {
+		// removals first, a new file may take the place of a removed
+		// directory
+		err := filepath.Walk(base, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(base, path)
+			if err != nil || rel == "." {
+				return err
+			}
+			current, err := os.Lstat(filepath.Join(dir, rel))
+			if err != nil {
+				if !os.IsNotExist(err) && !isNotDir(err) {
+					return err
+				}
+				name := filepath.Join(filepath.Dir(rel), whiteoutPrefix+filepath.Base(rel))
+				if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}); err != nil {
+					return err
+				}
+			}
+			// replaced directories are removed by extracting their
+			// replacement
+			if fi.IsDir() && (err != nil || !current.IsDir()) {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	links := map[[2]uint64]string{}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if fi.Mode()&os.ModeSocket != 0 {
+			// sockets belong to running processes
+			return nil
+		}
+		if base != "" {
+			if old, err := os.Lstat(filepath.Join(base, rel)); err == nil && !changed(old, fi, filepath.Join(base, rel), path) {
+				return nil
+			}
+		}
+		return writeEntry(tw, path, rel, fi, links)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// changed returns whether a file differs from its previous version.
+func changed(old, fi os.FileInfo, oldPath, path string) bool {
+	if old.Mode() != fi.Mode() {
+		return true
+	}
+	so, st := old.Sys().(*syscall.Stat_t), fi.Sys().(*syscall.Stat_t)
+	if so.Uid != st.Uid || so.Gid != st.Gid || so.Rdev != st.Rdev {
+		return true
+	}
+	// copies don't always keep the timestamps of symlinks
+	if fi.Mode()&os.ModeSymlink != 0 {
+		oldLink, err1 := os.Readlink(oldPath)
+		link, err2 := os.Readlink(path)
+		return err1 != nil || err2 != nil || oldLink != link
+	}
+	return old.Size() != fi.Size() || !old.ModTime().Equal(fi.ModTime())
+}
+
+func writeEntry(tw *tar.Writer, path, rel string, fi os.FileInfo, links map[[2]uint64]string) error {
+	link := ""
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = rel
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	// names of the host mean nothing in the image
+	hdr.Uname, hdr.Gname = "", ""
+
+	st := fi.Sys().(*syscall.Stat_t)
+	if fi.Mode().IsRegular() && st.Nlink > 1 {
+		inode := [2]uint64{uint64(st.Dev), st.Ino}
+		if first, ok := links[inode]; ok {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+		} else {
+			links[inode] = rel
+		}
+	}
+
+	if fi.Mode()&os.ModeSymlink == 0 {
+		xattrs, err := fileutil.Xattrs(path)
+		if err != nil {
+			return err
+		}
+		for name, value := range xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords["SCHILY.xattr."+name] = string(value)
+		}
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// whiteout applies the whiteout file name in the directory parent, which was
+// resolved within dest.
+func whiteout(dest, parent, name string, extracted map[string]bool) error {
+	if name == whiteoutOpaque {
+		entries, err := ioutil.ReadDir(parent)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			path := filepath.Join(parent, entry.Name())
+			if !extracted[path] {
+				if err := os.RemoveAll(path); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	removed := strings.TrimPrefix(name, whiteoutPrefix)
+	if removed == "" || removed == "." || removed == ".." {
+		return fmt.Errorf("Invalid whiteout %s", name)
+	}
+	path := filepath.Join(parent, removed)
+	if !strings.HasPrefix(path, filepath.Clean(dest)+"/") {
+		return fmt.Errorf("Whiteout %s is outside of %s", name, dest)
+	}
+	err := os.RemoveAll(path)
+	if isNotDir(err) {
+		return nil
+	}
+	return err
+}
+
+func isNotDir(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	if le, ok := err.(*os.LinkError); ok {
+		err = le.Err
+	}
+	return err == syscall.ENOTDIR
+}
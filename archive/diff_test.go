@@ -0,0 +1,66 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func layerTar(t *testing.T, names ...string) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestApplyLayerWhiteout(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "layer")
+	if err := os.MkdirAll(filepath.Join(dest, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"etc/removed", "etc/kept"} {
+		if err := ioutil.WriteFile(filepath.Join(dest, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ApplyLayer(layerTar(t, "etc/.wh.removed"), dest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "etc/removed")); !os.IsNotExist(err) {
+		t.Errorf("whiteout didn't remove the file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "etc/kept")); err != nil {
+		t.Errorf("whiteout removed another file: %v", err)
+	}
+}
+
+func TestApplyLayerWhiteoutEscape(t *testing.T) {
+	for _, name := range []string{".wh...", ".wh..", ".wh.", "etc/.wh...", "../.wh.."} {
+		home := t.TempDir()
+		dest := filepath.Join(home, "layer")
+		if err := os.MkdirAll(filepath.Join(dest, "etc"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ApplyLayer(layerTar(t, name), dest); err == nil {
+			t.Errorf("whiteout %s was applied", name)
+		}
+		if _, err := os.Stat(filepath.Join(dest, "etc")); err != nil {
+			t.Errorf("whiteout %s removed the destination: %v", name, err)
+		}
+		if _, err := os.Stat(home); err != nil {
+			t.Errorf("whiteout %s removed the parent of the destination: %v", name, err)
+		}
+	}
+}
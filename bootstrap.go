@@ -1,19 +1,50 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
-	"github.com/giantswarm/conair/btrfs"
-	"github.com/giantswarm/conair/networkd"
-	"github.com/giantswarm/conair/nspawn"
+	"github.com/giantswarm/conair/bootstrap"
+	"github.com/giantswarm/conair/image"
 )
 
-var cmdBootstrap = &Command{
-	Name:        "bootstrap",
-	Description: "Bootstrap conair base image",
-	Summary:     "Creates an arch rootfs with pacstrap. If there is no pacstrap on your system use 'conair pull base' instead",
-	Run:         runBootstrap,
+var (
+	flagDistro   string
+	flagRelease  string
+	flagPackages string
+	cmdBootstrap = &Command{
+		Name:    "bootstrap",
+		Summary: "Bootstrap a base image of arch, debian, ubuntu, fedora or alpine",
+		Usage:   "[-distro=NAME] [-release=RELEASE] [-packages=PKG,...] <image>",
+		Run:     runBootstrap,
+		Description: `Bootstrap a base image from the package repositories of a distribution
+
+The image boots with systemd, networkd and resolved, configured for the
+network of conair init. Alpine doesn't package systemd and boots with openrc.
+
+arch     pacstrap, the distribution has no releases
+debian   debootstrap, the current stable release by default
+ubuntu   debootstrap (and the ubuntu keyring), the current LTS by default
+fedora   dnf --installroot with the repositories of the host's dnf
+alpine   the minirootfs of the release, no tools needed on the host
+
+-packages installs additional packages. If there are no bootstrap tools on
+your system use 'conair pull base' instead.
+
+conair bootstrap base
+conair bootstrap -distro=debian -release=bookworm -packages=curl,vim debian
+`,
+	}
+)
+
+func init() {
+	cmdBootstrap.Flags.StringVar(&flagDistro, "distro", "arch", "Distribution to bootstrap: "+strings.Join(bootstrap.Names(), ", "))
+	cmdBootstrap.Flags.StringVar(&flagRelease, "release", "", "Release of the distribution, its current release by default")
+	cmdBootstrap.Flags.StringVar(&flagPackages, "packages", "", "Comma separated packages to install in addition to the base system")
 }
 
 func runBootstrap(args []string) (exit int) {
@@ -24,27 +55,71 @@ func runBootstrap(args []string) (exit int) {
 
 	imagePath := args[0]
 
-	fs, err := btrfs.Init(home)
+	if !bootstrap.Known(flagDistro) {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Unknown distribution %s. Please use one of %s.", flagDistro, strings.Join(bootstrap.Names(), ", ")))
+		return 1
+	}
+
+	packages := []string{}
+	for _, pkg := range strings.Split(flagPackages, ",") {
+		if pkg = strings.TrimSpace(pkg); pkg != "" {
+			packages = append(packages, pkg)
+		}
+	}
+
+	fs, err := initStorage()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Couldn't populate filesystem for conair.", err)
 		return 1
 	}
 
+	if fs.Exists(imagePath) {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Image %s already exists.", imagePath))
+		return 1
+	}
+
+	downloads, err := downloadDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't create download directory.", err)
+		return 1
+	}
+
 	err = fs.Subvolume(imagePath)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, fmt.Sprintf("Couldn't create subvolume for image %s.", imagePath), err)
 		return 1
 	}
 
-	err = nspawn.CreateImage(imagePath, home)
+	// an interrupted bootstrap doesn't leave a broken image behind
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	release := flagRelease
+	if release == "" {
+		release = bootstrap.Release(flagDistro)
+	}
+	fmt.Println("Bootstrapping", strings.TrimSpace(flagDistro+" "+release))
+
+	err = bootstrap.Create(ctx, flagDistro, imagePath, fmt.Sprintf("%s/%s", home, imagePath), bootstrap.Options{
+		Release:     flagRelease,
+		Packages:    packages,
+		Destination: destination,
+		Downloads:   downloads,
+		Progress:    progressOutput(),
+	})
 	if err != nil {
+		_ = fs.Remove(imagePath)
 		fmt.Fprintln(os.Stderr, "Couldn't create image.", err)
 		return 1
 	}
 
-	err = networkd.DefineContainerNetwork(fmt.Sprintf("%s/%s", home, imagePath), destination)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Couldn't add networking to new image.", err)
+	m := image.New(imagePath, image.SourceBootstrap)
+	if m.Digest, err = image.ComputeDigest(fmt.Sprintf("%s/%s", home, imagePath)); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't compute digest of image.", err)
+		return 1
+	}
+	if err := m.Write(home); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't write manifest of image.", err)
 		return 1
 	}
 
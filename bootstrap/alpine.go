@@ -0,0 +1,173 @@
+package bootstrap
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/giantswarm/conair/archive"
+	"github.com/giantswarm/conair/fetch"
+	"github.com/giantswarm/conair/nspawn"
+)
+
+const alpineMirror = "https://dl-cdn.alpinelinux.org/alpine"
+
+// alpine names architectures like the kernel
+var alpineArchs = map[string]string{
+	"amd64":   "x86_64",
+	"386":     "x86",
+	"arm64":   "aarch64",
+	"arm":     "armv7",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+	"riscv64": "riscv64",
+}
+
+// minirootfs extracts the alpine minirootfs of the release into root. The
+// archive is downloaded and verified against the checksum of the release index
+// before it's extracted.
+func minirootfs(ctx context.Context, root string, o Options) error {
+	arch, ok := alpineArchs[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("Alpine isn't available for %s.", runtime.GOARCH)
+	}
+	base := fmt.Sprintf("%s/v%s/releases/%s", alpineMirror, strings.TrimPrefix(o.Release, "v"), arch)
+
+	file, sum, err := latestMinirootfs(ctx, base+"/latest-releases.yaml")
+	if err != nil {
+		return fmt.Errorf("Couldn't find the minirootfs of alpine %s. %v", o.Release, err)
+	}
+
+	dir := o.Downloads
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	dest := filepath.Join(dir, file)
+
+	fmt.Printf("Fetching %s.\n", file)
+	if _, err := fetch.Download(fmt.Sprintf("%s/%s", base, file), dest, o.Progress); err != nil {
+		return err
+	}
+	defer os.Remove(dest)
+	if err := fetch.Verify(dest, strings.ToLower(sum)); err != nil {
+		return err
+	}
+
+	f, err := os.Open(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := archive.Decompress(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return archive.Untar(r, root)
+}
+
+// latestMinirootfs returns the file name and sha256 of the minirootfs in the
+// release index of alpine. The index is YAML, a list of one map per flavor.
+func latestMinirootfs(ctx context.Context, url string) (string, string, error) {
+	resp, err := get(ctx, url)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	var flavor, file, sum string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "-") {
+			// the next entry starts
+			if flavor == "alpine-minirootfs" && file != "" && sum != "" {
+				return file, sum, nil
+			}
+			flavor, file, sum = "", "", ""
+			line = strings.TrimSpace(strings.TrimPrefix(line, "-"))
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) < 2 {
+			continue
+		}
+		value := strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+		switch kv[0] {
+		case "flavor":
+			flavor = value
+		case "file":
+			file = value
+		case "sha256":
+			sum = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	if flavor == "alpine-minirootfs" && file != "" && sum != "" {
+		return file, sum, nil
+	}
+	return "", "", fmt.Errorf("%s has no minirootfs", url)
+}
+
+func get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Couldn't fetch %s: %s", url, resp.Status)
+	}
+	return resp, nil
+}
+
+const alpineInterfaces = `auto lo
+iface lo inet loopback
+
+auto host0
+iface host0 inet dhcp
+`
+
+const alpineInittab = `::sysinit:/sbin/openrc sysinit
+::sysinit:/sbin/openrc boot
+::wait:/sbin/openrc default
+console::respawn:/sbin/getty 38400 console
+::shutdown:/sbin/openrc shutdown
+`
+
+// configureOpenRC installs the base system of alpine and sets up its network
+// like networkd does on the other distributions: DHCP on host0 and public DNS
+// servers. Alpine doesn't package systemd, it boots with openrc. The getty of
+// the console replaces those of the ttys nspawn doesn't have.
+func configureOpenRC(ctx context.Context, name, root string, o Options) error {
+	c := nspawn.Init(name, root)
+	packages := append([]string{"alpine-base"}, o.Packages...)
+	script := "apk add --no-cache " + strings.Join(packages, " ") +
+		` && sed -i 's/^#\?rc_sys=.*/rc_sys="systemd-nspawn"/' /etc/rc.conf` +
+		" && rc-update add networking default"
+	if err := c.Build(ctx, "RUN", script); err != nil {
+		return fmt.Errorf("Couldn't install the alpine base system. %v", err)
+	}
+
+	if err := os.MkdirAll(root+"/etc/network", 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(root+"/etc/network/interfaces", []byte(alpineInterfaces), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(root+"/etc/resolv.conf", []byte("nameserver 8.8.8.8\nnameserver 8.8.4.4\n"), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(root+"/etc/inittab", []byte(alpineInittab), 0644)
+}
@@ -0,0 +1,195 @@
+// Package bootstrap creates the root filesystems of base images from the
+// package repositories of a distribution.
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/giantswarm/conair/networkd"
+	"github.com/giantswarm/conair/nspawn"
+	"github.com/giantswarm/conair/runner"
+)
+
+// Options configure the root filesystem of a bootstrap.
+type Options struct {
+	// Release of the distribution, its current release if empty
+	Release string
+	// Packages are installed in addition to the base system with the package
+	// manager of the distribution
+	Packages []string
+	// Destination is the network of the containers, eg 192.168.13.0/24
+	Destination string
+	// Downloads is the directory downloads are kept in, interrupted ones are
+	// continued from there
+	Downloads string
+	// Progress receives the progress of downloads unless it's nil
+	Progress io.Writer
+}
+
+// distribution is a bootstrap backend.
+type distribution struct {
+	// release is used unless Options.Release is set
+	release string
+	// install creates the base system in root
+	install func(ctx context.Context, root string, o Options) error
+	// configure sets up the network of the installed system
+	configure func(ctx context.Context, name, root string, o Options) error
+}
+
+var distributions = map[string]*distribution{
+	"arch": {
+		install:   pacstrap,
+		configure: configureSystemd,
+	},
+	"debian": {
+		release: "trixie",
+		install: func(ctx context.Context, root string, o Options) error {
+			return debootstrap(ctx, root, o, "http://deb.debian.org/debian")
+		},
+		configure: configureSystemd,
+	},
+	"ubuntu": {
+		release: "noble",
+		install: func(ctx context.Context, root string, o Options) error {
+			return debootstrap(ctx, root, o, "http://archive.ubuntu.com/ubuntu")
+		},
+		configure: configureSystemd,
+	},
+	"fedora": {
+		release:   "42",
+		install:   dnf,
+		configure: configureSystemd,
+	},
+	"alpine": {
+		release:   "3.22",
+		install:   minirootfs,
+		configure: configureOpenRC,
+	},
+}
+
+// Names returns the names of all distributions.
+func Names() []string {
+	names := []string{}
+	for name := range distributions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Known returns whether a distribution can be bootstrapped.
+func Known(distro string) bool {
+	_, ok := distributions[distro]
+	return ok
+}
+
+// Create installs a distribution into root, which has to exist, and sets up
+// the network of the containers. name is used for the build container.
+func Create(ctx context.Context, distro, name, root string, o Options) error {
+	d, ok := distributions[distro]
+	if !ok {
+		return fmt.Errorf("Unknown distribution %s. Please use one of %s.", distro, strings.Join(Names(), ", "))
+	}
+	if o.Release == "" {
+		o.Release = d.release
+	}
+
+	if err := d.install(ctx, root, o); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return d.configure(ctx, name, root, o)
+}
+
+// Release returns the release a distribution is bootstrapped with by default.
+func Release(distro string) string {
+	if d, ok := distributions[distro]; ok {
+		return d.release
+	}
+	return ""
+}
+
+// pacstrap installs archlinux. Arch is a rolling release, so there is no
+// release to choose.
+func pacstrap(ctx context.Context, root string, o Options) error {
+	if o.Release != "" {
+		return fmt.Errorf("Arch Linux has no releases, please don't set one.")
+	}
+	args := []string{"-c", "-d", root,
+		"bash", "bzip2", "coreutils", "diffutils", "file", "filesystem", "findutils",
+		"gawk", "gcc-libs", "gettext", "glibc", "grep", "gzip", "iproute2", "iputils",
+		"less", "libutil-linux", "licenses", "logrotate", "nano", "pacman", "procps-ng",
+		"psmisc", "sed", "shadow", "sysfsutils", "systemd", "tar", "texinfo", "util-linux", "vi", "which"}
+	return install(ctx, "pacstrap", append(args, o.Packages...)...)
+}
+
+// debootstrap installs debian or ubuntu from mirror.
+func debootstrap(ctx context.Context, root string, o Options, mirror string) error {
+	packages := append([]string{"systemd", "systemd-sysv", "systemd-resolved", "dbus",
+		"iproute2", "iputils-ping", "ca-certificates"}, o.Packages...)
+	return install(ctx, "debootstrap", "--variant=minbase",
+		fmt.Sprintf("--include=%s", strings.Join(packages, ",")), o.Release, root, mirror)
+}
+
+// dnf installs fedora with the repositories of the host's dnf.
+func dnf(ctx context.Context, root string, o Options) error {
+	args := []string{"-y", fmt.Sprintf("--installroot=%s", root), fmt.Sprintf("--releasever=%s", o.Release),
+		"--setopt=install_weak_deps=False", "--nodocs", "install",
+		"systemd", "systemd-networkd", "systemd-resolved", "fedora-release", "dnf", "passwd",
+		"iproute", "iputils", "vim-minimal"}
+	return install(ctx, "dnf", append(args, o.Packages...)...)
+}
+
+// install runs a bootstrap tool of the host.
+func install(ctx context.Context, tool string, args ...string) error {
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return fmt.Errorf("Couldn't find %s. Please install it to bootstrap this distribution.", tool)
+	}
+
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Env = []string{
+		"TERM=vt102",
+		"SHELL=/bin/bash",
+		"USER=root",
+		"LANG=C",
+		"HOME=/root",
+		"PWD=/root",
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin:/usr/bin/core_perl",
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	return runner.Default.Run(cmd)
+}
+
+// configureSystemd enables networkd and resolved. The container gets its
+// address from the DHCP server of the bridge and uses public DNS servers.
+func configureSystemd(ctx context.Context, name, root string, o Options) error {
+	c := nspawn.Init(name, root)
+	if err := c.Build(ctx, "ENABLE", "systemd-networkd systemd-resolved"); err != nil {
+		return fmt.Errorf("Couldn't enable networkd and resolved. %v", err)
+	}
+
+	dir := fmt.Sprintf("%s/etc/systemd/resolved.conf.d", root)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(dir+"/dns.conf", []byte("[Resolve]\nDNS=8.8.8.8 8.8.4.4\n"), 0644); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(fmt.Sprintf("%s/etc/systemd/network", root), 0755); err != nil {
+		return err
+	}
+	return networkd.DefineContainerNetwork(root, o.Destination)
+}
@@ -1,14 +1,15 @@
 package btrfs
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
-	"strings"
 	"syscall"
+
+	"github.com/giantswarm/conair/runner"
 )
 
 type FsMagic int64
@@ -22,6 +23,38 @@ var (
 	ErrPrerequisites = errors.New("prerequisites for driver not satisfied (wrong filesystem?)")
 )
 
+// Subvolume describes a btrfs subvolume as reported by the kernel.
+type Subvolume struct {
+	ID         uint64
+	Path       string
+	UUID       UUID
+	ParentUUID UUID
+	// ReceivedUUID is the uuid the subvolume had on the host it was sent
+	// from, if it was created by btrfs receive
+	ReceivedUUID UUID
+	ReadOnly     bool
+}
+
+// SendUUID returns the uuid send streams refer to the subvolume by. Received
+// subvolumes keep the uuid they had on the sending host.
+func (s *Subvolume) SendUUID() UUID {
+	if !s.ReceivedUUID.IsZero() {
+		return s.ReceivedUUID
+	}
+	return s.UUID
+}
+
+// backend performs the actual subvolume operations. The native backend talks
+// to the kernel via ioctls, the cli backend shells out to btrfs-progs.
+type backend interface {
+	create(volPath string) error
+	snapshot(fromPath, toPath string, readonly bool) error
+	destroy(volPath string) error
+	setReadonly(volPath string) error
+	info(volPath string) (*Subvolume, error)
+	children(volPath string) ([]string, error)
+}
+
 func Init(home string) (*Driver, error) {
 	rootdir := path.Dir(home + "/")
 
@@ -39,12 +72,37 @@ func Init(home string) (*Driver, error) {
 	}
 
 	return &Driver{
-		home: home,
+		home:   home,
+		fs:     newBackend(home, runner.Default),
+		runner: runner.Default,
 	}, nil
 }
 
+// newBackend returns the ioctl backend, or the cli backend if the kernel
+// interface isn't usable for the home.
+func newBackend(home string, r runner.Runner) backend {
+	var fs backend = ioctlBackend{}
+	if _, err := fs.info(home); err != nil {
+		return cliBackend{home: home, runner: r}
+	}
+	return fs
+}
+
 type Driver struct {
 	home string
+	fs   backend
+	// runner calls btrfs send and receive, which have no ioctl backend
+	runner runner.Runner
+}
+
+// SetRunner sets the runner used to call the btrfs cli. It has no effect if
+// the driver talks to the kernel directly.
+func (d *Driver) SetRunner(r runner.Runner) {
+	d.runner = r
+	if cli, ok := d.fs.(cliBackend); ok {
+		cli.runner = r
+		d.fs = cli
+	}
 }
 
 func (d *Driver) Snapshot(from, to string, readonly bool) error {
@@ -58,14 +116,7 @@ func (d *Driver) Snapshot(from, to string, readonly bool) error {
 		return fmt.Errorf("Snapshot already exists: %s", toPath)
 	}
 
-	var cmd *exec.Cmd
-
-	if readonly {
-		cmd = raw("subvolume", "snapshot", "-r", fromPath, toPath)
-	} else {
-		cmd = raw("subvolume", "snapshot", fromPath, toPath)
-	}
-	if err := cmd.Run(); err != nil {
+	if err := d.fs.snapshot(fromPath, toPath, readonly); err != nil {
 		return err
 	}
 
@@ -100,7 +151,7 @@ func (d *Driver) Subvolume(vol string) error {
 		return fmt.Errorf("Subvolume already exists: %s", volPath)
 	}
 
-	return raw("subvolume", "create", volPath).Run()
+	return d.fs.create(volPath)
 }
 
 func (d *Driver) Exists(vol string) bool {
@@ -114,126 +165,154 @@ func (d *Driver) Exists(vol string) bool {
 	}
 }
 
-func (d *Driver) GetSubvolumeDetail(vol, detail string) (string, error) {
+// Rename moves a volume. The subvolume keeps its uuid, so snapshots of it still
+// find their parent.
+func (d *Driver) Rename(from, to string) error {
+	fromPath := fmt.Sprintf("%s/%s", d.home, from)
+	toPath := fmt.Sprintf("%s/%s", d.home, to)
+
+	if !d.Exists(from) {
+		return fmt.Errorf("Volume does not exist: %s", fromPath)
+	}
+	if d.Exists(to) {
+		return fmt.Errorf("Volume already exists: %s", toPath)
+	}
+	return os.Rename(fromPath, toPath)
+}
+
+// SetReadOnly marks a volume read-only, which btrfs send requires. Layers and
+// images never change once they are complete, builds and containers work on
+// writable snapshots of them.
+func (d *Driver) SetReadOnly(vol string) error {
 	volPath := fmt.Sprintf("%s/%s", d.home, vol)
 
-	o, _ := raw("subvolume", "show", volPath).Output()
+	if !d.Exists(vol) {
+		return fmt.Errorf("Volume does not exist: %s", volPath)
+	}
+	return d.fs.setReadonly(volPath)
+}
+
+// Send writes the send stream of a read-only volume to w. With a parent, which
+// must be read-only as well, the stream only holds the changes to the parent
+// and can only be received where the parent was received before.
+func (d *Driver) Send(vol, parent string, w io.Writer) error {
+	args := []string{"send", "-q"}
+	if parent != "" {
+		args = append(args, "-p", fmt.Sprintf("%s/%s", d.home, parent))
+	}
+	cmd := raw(append(args, fmt.Sprintf("%s/%s", d.home, vol))...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	return d.runner.Run(cmd)
+}
+
+// Receive creates a read-only volume from a send stream in dir, a directory
+// below the home. The volume gets the name it had on the sending host. The
+// stream can't touch files outside of dir.
+func (d *Driver) Receive(r io.Reader, dir string) error {
+	cmd := raw("receive", "-q", "--chroot", fmt.Sprintf("%s/%s", d.home, dir))
+	cmd.Stdin = r
+	cmd.Stderr = os.Stderr
+	return d.runner.Run(cmd)
+}
 
-	output := string(o)
-	lines := strings.Split(output, "\n")
+// Info returns the kernel's view of the given subvolume.
+func (d *Driver) Info(vol string) (*Subvolume, error) {
+	volPath := fmt.Sprintf("%s/%s", d.home, vol)
 
-	for _, line := range lines {
-		fields := strings.Split(line, ":")
-		if len(fields) > 1 {
-			key, val := strings.Trim(fields[0], " \t"), strings.Trim(fields[1], " \t")
-			if strings.EqualFold(key, detail) {
-				return val, nil
-			}
-		}
+	if !d.Exists(vol) {
+		return nil, fmt.Errorf("Volume does not exist: %s", volPath)
+	}
+
+	info, err := d.fs.info(volPath)
+	if err != nil {
+		return nil, err
 	}
-	return "", fmt.Errorf("Subvolume detail %s not found", detail)
+	info.Path = vol
+	return info, nil
 }
 
 func (d *Driver) GetSubvolumeParentUuid(vol string) (string, error) {
-	return d.GetSubvolumeDetail(vol, "Parent uuid")
-
+	info, err := d.Info(vol)
+	if err != nil {
+		return "", err
+	}
+	return info.ParentUUID.String(), nil
 }
 
 func (d *Driver) GetSubvolumeUuid(vol string) (string, error) {
-	return d.GetSubvolumeDetail(vol, "uuid")
+	info, err := d.Info(vol)
+	if err != nil {
+		return "", err
+	}
+	return info.UUID.String(), nil
 }
 
-func (d *Driver) ListSubvolumes() ([]string, error) {
-	var volumes []string
-
-	// find sub-subvolumes
-	cmd := raw("subvolume", "list", "-o", d.home, "-u")
+// ListSubvolumes returns all subvolumes directly below the conair home.
+func (d *Driver) ListSubvolumes() ([]*Subvolume, error) {
+	var volumes []*Subvolume
 
-	output, err := cmd.StdoutPipe()
+	entries, err := ioutil.ReadDir(d.home)
 	if err != nil {
 		return volumes, fmt.Errorf("Can't access subvolume list of %s: %v", d.home, err)
 	}
-	defer output.Close()
-	err = cmd.Start()
-	if err != nil {
-		return volumes, err
-	}
 
-	scanner := bufio.NewScanner(output)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, "__active") {
-			line = strings.Replace(line, "__active/", "", 1)
+	for _, entry := range entries {
+		if !isSubvolume(entry) {
+			continue
+		}
+
+		info, err := d.Info(entry.Name())
+		if err != nil {
+			return volumes, err
 		}
-		volumes = append(volumes, line)
+		volumes = append(volumes, info)
 	}
 	return volumes, nil
 }
 
+func (d *Driver) List() ([]string, error) {
+	volumes, err := d.ListSubvolumes()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, v := range volumes {
+		names = append(names, v.Path)
+	}
+	return names, nil
+}
+
 func (d *Driver) GetLayerByUuid(uuid string) (string, error) {
+	id, err := ParseUUID(uuid)
+	if err != nil {
+		return "", err
+	}
+	if id.IsZero() {
+		return "", fmt.Errorf("No layer found")
+	}
+
 	layers, err := d.ListSubvolumes()
 	if err != nil {
 		return "", err
 	}
 
-	replaceHome := strings.Replace(d.home, "/", "", 1) + "/"
 	for _, layer := range layers {
-		if strings.Contains(layer, fmt.Sprintf(" uuid %s ", uuid)) {
-			layerDetails := strings.Split(layer, " ")
-			if len(layerDetails) > 10 {
-				return strings.Replace(layerDetails[10], replaceHome, "", 1), nil
-			}
+		if layer.UUID == id {
+			return layer.Path, nil
 		}
 	}
 	return "", fmt.Errorf("No layer found")
 }
 
 func (d *Driver) ListSubSubvolumes(vol string) ([]string, error) {
-	var volumes []string
-
 	volPath := fmt.Sprintf("%s/%s", d.home, vol)
 
 	if !d.Exists(vol) {
-		return volumes, fmt.Errorf("Volume does not exist: %s", volPath)
+		return []string{}, fmt.Errorf("Volume does not exist: %s", volPath)
 	}
 
-	// find sub-subvolumes
-	cmd := raw("subvolume", "list", "-o", volPath)
-
-	output, err := cmd.StdoutPipe()
-	if err != nil {
-		return volumes, fmt.Errorf("Can't access subvolume list of %s: %v", volPath, err)
-	}
-	defer output.Close()
-	err = cmd.Start()
-	if err != nil {
-		return volumes, err
-	}
-
-	scanner := bufio.NewScanner(output)
-	for scanner.Scan() {
-		line := strings.Split(scanner.Text(), " ")
-		if len(line) > 8 {
-			subvol := strings.Join(line[8:], " ")
-			// remove beginning of volume path - relative to conair home
-			if strings.Contains(subvol, "__active") {
-				subvol = strings.Replace(subvol, "__active/", "", 1)
-			}
-
-			if strings.HasPrefix(subvol, volPath) {
-				volumes = append(volumes, strings.Replace(subvol, fmt.Sprintf("%s/", strings.Replace(volPath, "/", "", 1)), "", 1))
-			}
-
-			if strings.HasPrefix(subvol, vol) {
-				volumes = append(volumes, strings.Replace(subvol, fmt.Sprintf("%s/", vol), "", 1))
-			}
-		}
-	}
-	err = scanner.Err()
-	if err != nil {
-		return volumes, fmt.Errorf("Can't read subvolume list of %s: %v", volPath, err)
-	}
-	return volumes, nil
+	return d.fs.children(volPath)
 }
 
 func (d *Driver) Remove(vol string) error {
@@ -254,9 +333,15 @@ func (d *Driver) Remove(vol string) error {
 		}
 	}
 
-	return raw("subvolume", "delete", volPath).Run()
+	return d.fs.destroy(volPath)
 }
 
-func raw(args ...string) *exec.Cmd {
-	return exec.Command("btrfs", args...)
+// isSubvolume reports whether a directory is the root of a subvolume. The
+// root directory of every subvolume has the same well known inode number.
+func isSubvolume(fi os.FileInfo) bool {
+	if !fi.IsDir() {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Ino == firstFreeObjectid
 }
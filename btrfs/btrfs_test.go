@@ -0,0 +1,83 @@
+package btrfs
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/giantswarm/conair/runner"
+)
+
+func TestBackendFallback(t *testing.T) {
+	// the kernel interface only works on btrfs
+	home := t.TempDir()
+	rec := &runner.Recorder{}
+	fs := newBackend(home, rec)
+	if _, ok := fs.(cliBackend); !ok {
+		t.Fatalf("backend %T of a directory which isn't on btrfs", fs)
+	}
+
+	d := &Driver{home: home, fs: fs, runner: rec}
+	if err := d.Subvolume("base"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(home+"/base", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Snapshot("base", "app", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetReadOnly("base"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		fmt.Sprintf("btrfs subvolume create %s/base", home),
+		fmt.Sprintf("btrfs subvolume snapshot -r %s/base %s/app", home, home),
+		fmt.Sprintf("btrfs subvolume list -o %s/base", home),
+		fmt.Sprintf("btrfs property set -ts %s/base ro true", home),
+	}
+	if cmds := rec.Commands(); fmt.Sprint(cmds) != fmt.Sprint(want) {
+		t.Errorf("unexpected commands\n%v\nwant\n%v", cmds, want)
+	}
+
+	// SetRunner reaches the cli backend
+	other := &runner.Recorder{}
+	d.SetRunner(other)
+	d.SetReadOnly("base")
+	if len(other.Commands()) != 1 {
+		t.Errorf("cli backend didn't use the new runner: %v", other.Commands())
+	}
+}
+
+func TestCliInfo(t *testing.T) {
+	home := t.TempDir()
+	rec := &runner.Recorder{Handler: func(call runner.Call) ([]byte, error) {
+		return []byte(`base
+	Name: 			base
+	UUID: 			6d3b8e3c-0b1e-4a4f-9a55-3f1e8b7c2d01
+	Parent UUID: 		-
+	Received UUID: 		a1b2c3d4-e5f6-4789-8abc-def012345678
+	Creation time: 		2026-10-18 10:00:00 +0000
+	Subvolume ID: 		258
+	Generation: 		10
+	Flags: 			readonly
+`), nil
+	}}
+	if err := os.Mkdir(home+"/base", 0755); err != nil {
+		t.Fatal(err)
+	}
+	d := &Driver{home: home, fs: cliBackend{home: home, runner: rec}, runner: rec}
+
+	info, err := d.Info("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Path != "base" || info.ID != 258 || !info.ReadOnly || !info.ParentUUID.IsZero() ||
+		info.UUID.String() != "6d3b8e3c-0b1e-4a4f-9a55-3f1e8b7c2d01" ||
+		info.SendUUID().String() != "a1b2c3d4-e5f6-4789-8abc-def012345678" {
+		t.Errorf("unexpected subvolume %+v", info)
+	}
+	if uuid, err := d.GetSubvolumeParentUuid("base"); err != nil || uuid != "-" {
+		t.Errorf("unexpected parent uuid %s %v", uuid, err)
+	}
+}
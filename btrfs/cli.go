@@ -0,0 +1,118 @@
+package btrfs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/giantswarm/conair/runner"
+)
+
+// cliBackend shells out to btrfs-progs and scrapes its output. It is only
+// used if the ioctl interface isn't available.
+type cliBackend struct {
+	home   string
+	runner runner.Runner
+}
+
+func (c cliBackend) create(volPath string) error {
+	return c.runner.Run(raw("subvolume", "create", volPath))
+}
+
+func (c cliBackend) snapshot(fromPath, toPath string, readonly bool) error {
+	if readonly {
+		return c.runner.Run(raw("subvolume", "snapshot", "-r", fromPath, toPath))
+	}
+	return c.runner.Run(raw("subvolume", "snapshot", fromPath, toPath))
+}
+
+func (c cliBackend) destroy(volPath string) error {
+	return c.runner.Run(raw("subvolume", "delete", volPath))
+}
+
+func (c cliBackend) setReadonly(volPath string) error {
+	return c.runner.Run(raw("property", "set", "-ts", volPath, "ro", "true"))
+}
+
+func (c cliBackend) info(volPath string) (*Subvolume, error) {
+	o, err := c.runner.Output(raw("subvolume", "show", volPath))
+	if err != nil {
+		return nil, fmt.Errorf("Can't show subvolume %s: %v", volPath, err)
+	}
+
+	details := map[string]string{}
+	for _, line := range strings.Split(string(o), "\n") {
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) > 1 {
+			key, val := strings.Trim(fields[0], " \t"), strings.Trim(fields[1], " \t")
+			details[strings.ToLower(key)] = val
+		}
+	}
+
+	info := &Subvolume{}
+	if info.UUID, err = ParseUUID(details["uuid"]); err != nil {
+		return nil, err
+	}
+	if info.ParentUUID, err = ParseUUID(details["parent uuid"]); err != nil {
+		return nil, err
+	}
+	// older btrfs-progs don't show it
+	if received, ok := details["received uuid"]; ok {
+		if info.ReceivedUUID, err = ParseUUID(received); err != nil {
+			return nil, err
+		}
+	}
+	if id, ok := details["subvolume id"]; ok {
+		if info.ID, err = strconv.ParseUint(id, 10, 64); err != nil {
+			return nil, fmt.Errorf("Invalid subvolume id: %s", id)
+		}
+	}
+	info.ReadOnly = strings.Contains(details["flags"], "readonly")
+
+	return info, nil
+}
+
+func (c cliBackend) children(volPath string) ([]string, error) {
+	var volumes []string
+
+	// find sub-subvolumes
+	output, err := c.runner.Output(raw("subvolume", "list", "-o", volPath))
+	if err != nil {
+		return volumes, fmt.Errorf("Can't access subvolume list of %s: %v", volPath, err)
+	}
+
+	relPath := strings.Replace(volPath, "/", "", 1)
+	vol := strings.TrimPrefix(volPath, fmt.Sprintf("%s/", c.home))
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.Split(scanner.Text(), " ")
+		if len(line) > 8 {
+			subvol := strings.Join(line[8:], " ")
+			// remove beginning of volume path - relative to conair home
+			if strings.Contains(subvol, "__active") {
+				subvol = strings.Replace(subvol, "__active/", "", 1)
+			}
+
+			if strings.HasPrefix(subvol, relPath) {
+				volumes = append(volumes, strings.Replace(subvol, fmt.Sprintf("%s/", relPath), "", 1))
+			}
+
+			if strings.HasPrefix(subvol, vol) {
+				volumes = append(volumes, strings.Replace(subvol, fmt.Sprintf("%s/", vol), "", 1))
+			}
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return volumes, fmt.Errorf("Can't read subvolume list of %s: %v", volPath, err)
+	}
+	return volumes, nil
+}
+
+func raw(args ...string) *exec.Cmd {
+	return exec.Command("btrfs", args...)
+}
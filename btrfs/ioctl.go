@@ -0,0 +1,379 @@
+package btrfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+	"unsafe"
+)
+
+// Constants and structures of the btrfs ioctl interface, see
+// linux/include/uapi/linux/btrfs.h and btrfs_tree.h.
+const (
+	ioctlMagic = 0x94
+
+	rootTreeObjectid  = 1
+	firstFreeObjectid = 256
+
+	rootItemKey = 132
+	rootRefKey  = 156
+
+	// flag of btrfs_ioctl_vol_args_v2 to create a readonly snapshot
+	subvolReadonly = 1 << 1
+	// flag of btrfs_root_item marking a readonly subvolume
+	rootSubvolReadonly = 1 << 0
+
+	// offsets into btrfs_root_item
+	rootItemFlagsOffset      = 208
+	rootItemUUIDOffset       = 247
+	rootItemParentUUIDOffset = 263
+	rootItemReceivedOffset   = 279
+
+	searchHeaderSize = 32
+	rootRefSize      = 18
+)
+
+type volArgs struct {
+	fd   int64
+	name [4088]byte
+}
+
+type volArgsV2 struct {
+	fd      int64
+	transid uint64
+	flags   uint64
+	unused  [4]uint64
+	name    [4040]byte
+}
+
+type searchKey struct {
+	treeId      uint64
+	minObjectid uint64
+	maxObjectid uint64
+	minOffset   uint64
+	maxOffset   uint64
+	minTransid  uint64
+	maxTransid  uint64
+	minType     uint32
+	maxType     uint32
+	nrItems     uint32
+	unused      uint32
+	unused1     uint64
+	unused2     uint64
+	unused3     uint64
+	unused4     uint64
+}
+
+type searchArgs struct {
+	key searchKey
+	buf [4096 - unsafe.Sizeof(searchKey{})]byte
+}
+
+type searchHeader struct {
+	transid  uint64
+	objectid uint64
+	offset   uint64
+	typ      uint32
+	len      uint32
+}
+
+type inoLookupArgs struct {
+	treeId   uint64
+	objectid uint64
+	name     [4080]byte
+}
+
+var (
+	iocSubvolCreate   = iow(14, unsafe.Sizeof(volArgs{}))
+	iocSnapDestroy    = iow(15, unsafe.Sizeof(volArgs{}))
+	iocTreeSearch     = iowr(17, unsafe.Sizeof(searchArgs{}))
+	iocInoLookup      = iowr(18, unsafe.Sizeof(inoLookupArgs{}))
+	iocSnapCreateV2   = iow(23, unsafe.Sizeof(volArgsV2{}))
+	iocSubvolGetflags = ior(25, 8)
+	iocSubvolSetflags = iow(26, 8)
+)
+
+// iow and iowr encode ioctl request numbers like the _IOW and _IOWR macros of
+// the generic linux ioctl layout.
+func iow(nr, size uintptr) uintptr {
+	return 1<<30 | size<<16 | ioctlMagic<<8 | nr
+}
+
+func ior(nr, size uintptr) uintptr {
+	return 2<<30 | size<<16 | ioctlMagic<<8 | nr
+}
+
+func iowr(nr, size uintptr) uintptr {
+	return 3<<30 | size<<16 | ioctlMagic<<8 | nr
+}
+
+// ioctlBackend manages subvolumes through the kernel's btrfs ioctls.
+type ioctlBackend struct{}
+
+func (ioctlBackend) create(volPath string) error {
+	dir, name := path.Split(volPath)
+
+	var args volArgs
+	if err := setName(args.name[:], name); err != nil {
+		return err
+	}
+
+	return withDir(dir, func(fd uintptr) error {
+		return ioctl(fd, iocSubvolCreate, unsafe.Pointer(&args))
+	})
+}
+
+func (ioctlBackend) snapshot(fromPath, toPath string, readonly bool) error {
+	dir, name := path.Split(toPath)
+
+	var args volArgsV2
+	if err := setName(args.name[:], name); err != nil {
+		return err
+	}
+	if readonly {
+		args.flags |= subvolReadonly
+	}
+
+	return withDir(fromPath, func(src uintptr) error {
+		args.fd = int64(src)
+		return withDir(dir, func(fd uintptr) error {
+			return ioctl(fd, iocSnapCreateV2, unsafe.Pointer(&args))
+		})
+	})
+}
+
+func (ioctlBackend) destroy(volPath string) error {
+	dir, name := path.Split(volPath)
+
+	var args volArgs
+	if err := setName(args.name[:], name); err != nil {
+		return err
+	}
+
+	return withDir(dir, func(fd uintptr) error {
+		return ioctl(fd, iocSnapDestroy, unsafe.Pointer(&args))
+	})
+}
+
+func (ioctlBackend) setReadonly(volPath string) error {
+	return withDir(volPath, func(fd uintptr) error {
+		var flags uint64
+		if err := ioctl(fd, iocSubvolGetflags, unsafe.Pointer(&flags)); err != nil {
+			return err
+		}
+		if flags&subvolReadonly != 0 {
+			return nil
+		}
+		flags |= subvolReadonly
+		return ioctl(fd, iocSubvolSetflags, unsafe.Pointer(&flags))
+	})
+}
+
+func (ioctlBackend) info(volPath string) (*Subvolume, error) {
+	info := &Subvolume{}
+
+	err := withDir(volPath, func(fd uintptr) error {
+		id, err := subvolumeId(fd)
+		if err != nil {
+			return err
+		}
+		info.ID = id
+
+		return search(fd, searchKey{
+			treeId:      rootTreeObjectid,
+			minObjectid: id,
+			maxObjectid: id,
+			minType:     rootItemKey,
+			maxType:     rootItemKey,
+			maxOffset:   ^uint64(0),
+			maxTransid:  ^uint64(0),
+		}, func(h *searchHeader, item []byte) bool {
+			parseRootItem(item, info)
+			return false
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Can't show subvolume %s: %v", volPath, err)
+	}
+	return info, nil
+}
+
+func (ioctlBackend) children(volPath string) ([]string, error) {
+	var volumes []string
+
+	err := withDir(volPath, func(fd uintptr) error {
+		id, err := subvolumeId(fd)
+		if err != nil {
+			return err
+		}
+
+		var lookupErr error
+		err = search(fd, searchKey{
+			treeId:      rootTreeObjectid,
+			minObjectid: id,
+			maxObjectid: id,
+			minType:     rootRefKey,
+			maxType:     rootRefKey,
+			maxOffset:   ^uint64(0),
+			maxTransid:  ^uint64(0),
+		}, func(h *searchHeader, item []byte) bool {
+			dirid, name, ok := parseRootRef(item)
+			if !ok {
+				return true
+			}
+
+			// resolve the directory the child subvolume lives in
+			dir, err := lookupPath(fd, id, dirid)
+			if err != nil {
+				lookupErr = err
+				return false
+			}
+			volumes = append(volumes, dir+name)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		return lookupErr
+	})
+	if err != nil {
+		return volumes, fmt.Errorf("Can't access subvolume list of %s: %v", volPath, err)
+	}
+	return volumes, nil
+}
+
+// parseRootItem reads the flags and uuids of a btrfs_root_item into info.
+func parseRootItem(item []byte, info *Subvolume) {
+	if len(item) >= rootItemFlagsOffset+8 {
+		flags := binary.LittleEndian.Uint64(item[rootItemFlagsOffset:])
+		info.ReadOnly = flags&rootSubvolReadonly != 0
+	}
+	// older kernels don't store uuids in the root item
+	if len(item) >= rootItemParentUUIDOffset+len(info.ParentUUID) {
+		copy(info.UUID[:], item[rootItemUUIDOffset:])
+		copy(info.ParentUUID[:], item[rootItemParentUUIDOffset:])
+	}
+	if len(item) >= rootItemReceivedOffset+len(info.ReceivedUUID) {
+		copy(info.ReceivedUUID[:], item[rootItemReceivedOffset:])
+	}
+}
+
+// parseRootRef returns the id of the directory and the name of a child
+// subvolume from a btrfs_root_ref.
+func parseRootRef(item []byte) (uint64, string, bool) {
+	if len(item) < rootRefSize {
+		return 0, "", false
+	}
+	dirid := binary.LittleEndian.Uint64(item[0:])
+	nameLen := int(binary.LittleEndian.Uint16(item[16:]))
+	if len(item) < rootRefSize+nameLen {
+		return 0, "", false
+	}
+	return dirid, string(item[rootRefSize : rootRefSize+nameLen]), true
+}
+
+// subvolumeId returns the id of the subvolume the open file belongs to.
+func subvolumeId(fd uintptr) (uint64, error) {
+	args := inoLookupArgs{
+		objectid: firstFreeObjectid,
+	}
+	if err := ioctl(fd, iocInoLookup, unsafe.Pointer(&args)); err != nil {
+		return 0, err
+	}
+	return args.treeId, nil
+}
+
+// lookupPath returns the path of a directory inside of a subvolume. The path is
+// relative to the subvolume and has a trailing slash unless it's the root.
+func lookupPath(fd uintptr, treeId, dirid uint64) (string, error) {
+	args := inoLookupArgs{
+		treeId:   treeId,
+		objectid: dirid,
+	}
+	if err := ioctl(fd, iocInoLookup, unsafe.Pointer(&args)); err != nil {
+		return "", err
+	}
+	return cString(args.name[:]), nil
+}
+
+// search runs a tree search and calls fn for every item found until fn
+// returns false or there are no more items.
+func search(fd uintptr, key searchKey, fn func(h *searchHeader, item []byte) bool) error {
+	for {
+		args := searchArgs{key: key}
+		args.key.nrItems = 4096
+
+		if err := ioctl(fd, iocTreeSearch, unsafe.Pointer(&args)); err != nil {
+			return err
+		}
+		if args.key.nrItems == 0 {
+			return nil
+		}
+
+		var (
+			h   searchHeader
+			off uintptr
+		)
+		for i := uint32(0); i < args.key.nrItems; i++ {
+			if off+searchHeaderSize > uintptr(len(args.buf)) {
+				return nil
+			}
+			// copy the header, items aren't necessarily aligned
+			copy((*[searchHeaderSize]byte)(unsafe.Pointer(&h))[:], args.buf[off:])
+			off += searchHeaderSize
+
+			end := off + uintptr(h.len)
+			if end > uintptr(len(args.buf)) {
+				return nil
+			}
+			if !fn(&h, args.buf[off:end]) {
+				return nil
+			}
+			off = end
+		}
+
+		// continue after the last item found
+		if h.offset == ^uint64(0) {
+			return nil
+		}
+		key.minObjectid = h.objectid
+		key.minType = h.typ
+		key.minOffset = h.offset + 1
+	}
+}
+
+func withDir(dir string, fn func(fd uintptr) error) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return fn(f.Fd())
+}
+
+func ioctl(fd, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func setName(buf []byte, name string) error {
+	if len(name) == 0 || len(name) >= len(buf) {
+		return fmt.Errorf("Invalid subvolume name: %s", name)
+	}
+	copy(buf, name)
+	return nil
+}
+
+func cString(buf []byte) string {
+	for i, b := range buf {
+		if b == 0 {
+			return string(buf[:i])
+		}
+	}
+	return string(buf)
+}
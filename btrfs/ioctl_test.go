@@ -0,0 +1,99 @@
+package btrfs
+
+import (
+	"encoding/binary"
+	"testing"
+	"unsafe"
+)
+
+func TestIoctlLayout(t *testing.T) {
+	// sizes of the structures of linux/include/uapi/linux/btrfs.h
+	sizes := []struct {
+		name       string
+		size, want uintptr
+	}{
+		{"btrfs_ioctl_vol_args", unsafe.Sizeof(volArgs{}), 4096},
+		{"btrfs_ioctl_vol_args_v2", unsafe.Sizeof(volArgsV2{}), 4096},
+		{"btrfs_ioctl_search_key", unsafe.Sizeof(searchKey{}), 104},
+		{"btrfs_ioctl_search_args", unsafe.Sizeof(searchArgs{}), 4096},
+		{"btrfs_ioctl_search_header", unsafe.Sizeof(searchHeader{}), searchHeaderSize},
+		{"btrfs_ioctl_ino_lookup_args", unsafe.Sizeof(inoLookupArgs{}), 4096},
+	}
+	for _, s := range sizes {
+		if s.size != s.want {
+			t.Errorf("%s has %d bytes, want %d", s.name, s.size, s.want)
+		}
+	}
+
+	requests := []struct {
+		name      string
+		req, want uintptr
+	}{
+		{"BTRFS_IOC_SUBVOL_CREATE", iocSubvolCreate, 0x5000940e},
+		{"BTRFS_IOC_SNAP_DESTROY", iocSnapDestroy, 0x5000940f},
+		{"BTRFS_IOC_TREE_SEARCH", iocTreeSearch, 0xd0009411},
+		{"BTRFS_IOC_INO_LOOKUP", iocInoLookup, 0xd0009412},
+		{"BTRFS_IOC_SNAP_CREATE_V2", iocSnapCreateV2, 0x50009417},
+		{"BTRFS_IOC_SUBVOL_GETFLAGS", iocSubvolGetflags, 0x80089419},
+		{"BTRFS_IOC_SUBVOL_SETFLAGS", iocSubvolSetflags, 0x4008941a},
+	}
+	for _, r := range requests {
+		if r.req != r.want {
+			t.Errorf("%s is %#x, want %#x", r.name, r.req, r.want)
+		}
+	}
+}
+
+func TestParseRootItem(t *testing.T) {
+	uuid, _ := ParseUUID("6d3b8e3c-0b1e-4a4f-9a55-3f1e8b7c2d01")
+	parent, _ := ParseUUID("0f8e2a6b-9c1d-4e3f-8a7b-6c5d4e3f2a10")
+	received, _ := ParseUUID("a1b2c3d4-e5f6-4789-8abc-def012345678")
+
+	// btrfs_root_item of current kernels has 439 bytes
+	item := make([]byte, 439)
+	binary.LittleEndian.PutUint64(item[rootItemFlagsOffset:], rootSubvolReadonly)
+	copy(item[rootItemUUIDOffset:], uuid[:])
+	copy(item[rootItemParentUUIDOffset:], parent[:])
+	copy(item[rootItemReceivedOffset:], received[:])
+
+	info := &Subvolume{}
+	parseRootItem(item, info)
+	if !info.ReadOnly || info.UUID != uuid || info.ParentUUID != parent || info.ReceivedUUID != received {
+		t.Errorf("unexpected subvolume %+v", info)
+	}
+	if info.SendUUID() != received {
+		t.Errorf("received subvolume is sent as %s", info.SendUUID())
+	}
+
+	// root items of old kernels end before the uuids
+	info = &Subvolume{}
+	parseRootItem(item[:rootItemUUIDOffset], info)
+	if !info.ReadOnly || !info.UUID.IsZero() || !info.ParentUUID.IsZero() {
+		t.Errorf("unexpected subvolume of an old root item %+v", info)
+	}
+	binary.LittleEndian.PutUint64(item[rootItemFlagsOffset:], 0)
+	info = &Subvolume{}
+	parseRootItem(item[:rootItemReceivedOffset], info)
+	if info.ReadOnly || info.UUID != uuid || !info.ReceivedUUID.IsZero() || info.SendUUID() != uuid {
+		t.Errorf("unexpected subvolume without received uuid %+v", info)
+	}
+}
+
+func TestParseRootRef(t *testing.T) {
+	item := make([]byte, rootRefSize, rootRefSize+5)
+	binary.LittleEndian.PutUint64(item[0:], 259)
+	binary.LittleEndian.PutUint64(item[8:], 7)
+	binary.LittleEndian.PutUint16(item[16:], 5)
+	item = append(item, "layer"...)
+
+	dirid, name, ok := parseRootRef(item)
+	if !ok || dirid != 259 || name != "layer" {
+		t.Errorf("unexpected root ref %d %q %v", dirid, name, ok)
+	}
+	if _, _, ok := parseRootRef(item[:len(item)-1]); ok {
+		t.Error("truncated name was parsed")
+	}
+	if _, _, ok := parseRootRef(item[:rootRefSize-1]); ok {
+		t.Error("truncated root ref was parsed")
+	}
+}
@@ -0,0 +1,42 @@
+package btrfs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// UUID is the 16 byte identifier btrfs assigns to every subvolume.
+type UUID [16]byte
+
+// IsZero reports whether the UUID is unset, e.g. the parent of a subvolume
+// that wasn't created as a snapshot.
+func (u UUID) IsZero() bool {
+	return u == UUID{}
+}
+
+// String formats the UUID like btrfs-progs does, including "-" for an unset
+// UUID.
+func (u UUID) String() string {
+	if u.IsZero() {
+		return "-"
+	}
+	h := hex.EncodeToString(u[:])
+	return fmt.Sprintf("%s-%s-%s-%s-%s", h[0:8], h[8:12], h[12:16], h[16:20], h[20:32])
+}
+
+func ParseUUID(s string) (UUID, error) {
+	var u UUID
+
+	s = strings.TrimSpace(s)
+	if s == "-" || s == "" {
+		return u, nil
+	}
+
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != len(u) {
+		return u, fmt.Errorf("Invalid uuid: %s", s)
+	}
+	copy(u[:], b)
+	return u, nil
+}
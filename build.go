@@ -1,28 +1,339 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/giantswarm/conair/btrfs"
+	"github.com/giantswarm/conair/buildcontext"
+	"github.com/giantswarm/conair/image"
 	"github.com/giantswarm/conair/layer"
 	"github.com/giantswarm/conair/nspawn"
 	"github.com/giantswarm/conair/parser"
+	"github.com/giantswarm/conair/pkgmgr"
+	"github.com/giantswarm/conair/progress"
+	"github.com/giantswarm/conair/storage"
 )
 
-var cmdBuild = &Command{
-	Name:        "build",
-	Description: "Build an image",
-	Summary:     "Build an image",
-	Run:         runBuild,
+var (
+	flagBuildArg stringSlice
+	flagFile     string
+	flagContext  string
+	flagQuiet    bool
+	flagProgress string
+	flagSecret   stringSlice
+	flagSSH      stringSlice
+	flagNoCache  bool
+	cmdBuild     = &Command{
+		Name:    "build",
+		Summary: "Build an image",
+		Usage:   "[-f=Conairfile] [-context=DIR] [-build-arg=KEY=VALUE] [-secret=id=ID,src=FILE] [-ssh=ID[=SOCKET]] [-no-cache-mounts] [-q] [-progress=text|json] <image>",
+		Run:     runBuild,
+		Description: `Build an image from the Conairfile (or Dockerfile) in the build context
+
+The build context is the current directory unless -context is given. ADD and
+COPY can only read files from the build context, files matching the patterns
+in its .conairignore (or .dockerignore) are left out.
+
+conair build -f build/Conairfile -context src my-new-image
+
+Values of ARG instructions can be set with -build-arg:
+
+conair build -build-arg=VERSION=1.2 my-new-image
+
+Secrets and the ssh agent are only available to RUN instructions which mount
+them, they are neither part of a layer nor of the cache key:
+
+RUN --mount=type=secret,id=npmrc,target=/root/.npmrc npm install
+RUN --mount=type=ssh git clone git@github.com:example/private.git
+
+conair build -secret id=npmrc,src=$HOME/.npmrc -ssh default my-new-image
+
+Cache mounts keep files between builds (eg downloads of package managers)
+without putting them into a layer. PKG always caches the downloaded packages.
+-no-cache-mounts builds without them, caches are removed with conair cache
+prune:
+
+RUN --mount=type=cache,target=/root/.cache/go-build go build ./...
+
+Every step is shown with the output of its commands and its duration. -q only
+prints the ID of the image (and the output of a failed step), -progress=json
+prints every build event as a JSON object per line:
+
+conair build -progress=json my-new-image | jq -c 'select(.type == "step-end")'
+`,
+	}
+)
+
+func init() {
+	cmdBuild.Flags.Var(&flagBuildArg, "build-arg", "Set a build-time variable declared with ARG")
+	cmdBuild.Flags.StringVar(&flagFile, "f", "", "Path of the Conairfile (default <context>/Conairfile or <context>/Dockerfile)")
+	cmdBuild.Flags.StringVar(&flagContext, "context", ".", "Directory ADD and COPY read their sources from")
+	cmdBuild.Flags.Var(&flagSecret, "secret", "Provide a secret to RUN --mount=type=secret, eg id=npmrc,src=.npmrc")
+	cmdBuild.Flags.Var(&flagSSH, "ssh", "Provide an ssh agent to RUN --mount=type=ssh, eg default or default=SOCKET")
+	cmdBuild.Flags.BoolVar(&flagNoCache, "no-cache-mounts", false, "Don't mount caches into RUN and PKG steps")
+	cmdBuild.Flags.BoolVar(&flagQuiet, "q", false, "Only print the ID of the image")
+	cmdBuild.Flags.StringVar(&flagProgress, "progress", "text", "Progress output: text or json")
 }
 
-func readFile(filename string) (*parser.Conairfile, error) {
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		return nil, err
+// buildState holds the variables of a build. ENV variables are persisted into
+// the image, ARG variables are only available while building.
+type buildState struct {
+	env       []string
+	args      []string
+	globals   []string
+	buildArgs map[string]string
+	// build arguments declared by an ARG instruction of any stage
+	consumed map[string]bool
+
+	workdir string
+	user    string
+	shell   []string
+	// pkgManager is set by PKG_MANAGER, otherwise it is detected
+	pkgManager *pkgmgr.Manager
+
+	// runtime configuration, it doesn't change the filesystem
+	labels     map[string]string
+	ports      []string
+	volumes    []string
+	entrypoint []string
+	cmd        []string
+}
+
+func newBuildState(buildArgs []string) (*buildState, error) {
+	s := &buildState{
+		buildArgs: map[string]string{},
+		consumed:  map[string]bool{},
+	}
+	for _, arg := range buildArgs {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) < 2 {
+			return nil, fmt.Errorf("Build argument %s is unreadable. Please use KEY=VALUE notation.", arg)
+		}
+		s.buildArgs[kv[0]] = kv[1]
+	}
+	return s, nil
+}
+
+// lookup resolves a variable for substitution. ENV takes precedence over ARG.
+func (s *buildState) lookup(name string) (string, bool) {
+	if value, ok := lookupVar(s.env, name); ok {
+		return value, true
+	}
+	return lookupVar(s.args, name)
+}
+
+// stage returns the state of a new build stage. The ARG values declared
+// before FROM are defaults for ARG instructions of the stage. The stage starts
+// with the configuration of its base image or stage.
+func (s *buildState) stage(base image.Config) *buildState {
+	stage := &buildState{
+		globals:    s.args,
+		buildArgs:  s.buildArgs,
+		consumed:   s.consumed,
+		env:        base.Env,
+		workdir:    base.Workdir,
+		user:       base.User,
+		shell:      base.Shell,
+		labels:     map[string]string{},
+		ports:      append([]string{}, base.ExposedPorts...),
+		volumes:    append([]string{}, base.Volumes...),
+		entrypoint: base.Entrypoint,
+		cmd:        base.Cmd,
+	}
+	for k, v := range base.Labels {
+		stage.labels[k] = v
 	}
-	return parser.Parse(filename)
+	return stage
+}
+
+// config returns the runtime configuration of an image built with the state.
+func (s *buildState) config() image.Config {
+	return image.Config{
+		Env:          s.env,
+		Workdir:      s.workdir,
+		User:         s.user,
+		Shell:        s.shell,
+		ExposedPorts: s.ports,
+		Labels:       s.labels,
+		Volumes:      s.volumes,
+		Entrypoint:   s.entrypoint,
+		Cmd:          s.cmd,
+	}
+}
+
+// configure applies instructions which only change the runtime configuration
+// of the image.
+func (s *buildState) configure(cmd parser.Command) error {
+	switch cmd.Verb {
+	case "LABEL":
+		labels, err := parser.ParseLabel(parser.Expand(cmd.Payload, s.lookup))
+		if err != nil {
+			return err
+		}
+		for k, v := range labels {
+			s.labels[k] = v
+		}
+	case "EXPOSE":
+		ports, err := parser.SplitWords(parser.Expand(cmd.Payload, s.lookup))
+		if err != nil {
+			return err
+		}
+		for _, port := range ports {
+			port, err := parser.ParsePort(port)
+			if err != nil {
+				return err
+			}
+			s.ports = appendUnique(s.ports, port)
+		}
+	case "VOLUME":
+		volumes := cmd.Args
+		if !cmd.JSON {
+			var err error
+			if volumes, err = parser.SplitWords(cmd.Payload); err != nil {
+				return err
+			}
+		}
+		for _, volume := range volumes {
+			volume, err := image.CleanVolume(parser.Expand(volume, s.lookup))
+			if err != nil {
+				return err
+			}
+			s.volumes = appendUnique(s.volumes, volume)
+		}
+	case "ENTRYPOINT":
+		s.entrypoint = s.command(cmd)
+		// like docker, a new entrypoint drops the command of the base image
+		s.cmd = nil
+	case "CMD":
+		s.cmd = s.command(cmd)
+	}
+	return nil
+}
+
+// command returns the command line of a CMD or ENTRYPOINT instruction. The
+// shell form is run by the SHELL of the stage.
+func (s *buildState) command(cmd parser.Command) []string {
+	if cmd.JSON {
+		return cmd.Args
+	}
+	shell := s.shell
+	if len(shell) == 0 {
+		shell = []string{"/bin/sh", "-c"}
+	}
+	return append(append([]string{}, shell...), cmd.Payload)
+}
+
+func appendUnique(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+func (s *buildState) declareArg(payload string) error {
+	name, value, hasDefault, err := parser.ParseArg(payload)
+	if err != nil {
+		return err
+	}
+	if v, ok := s.buildArgs[name]; ok {
+		value = v
+		s.consumed[name] = true
+	} else if v, ok := lookupVar(s.globals, name); ok && !hasDefault {
+		value = v
+	} else if !hasDefault {
+		return nil
+	} else {
+		value = parser.Expand(value, s.lookup)
+	}
+	s.args = setVar(s.args, name, value)
+	return nil
+}
+
+func (s *buildState) setEnv(payload string) error {
+	env, err := parser.ParseEnv(payload)
+	if err != nil {
+		return err
+	}
+	for _, kv := range env {
+		pair := strings.SplitN(kv, "=", 2)
+		s.env = setVar(s.env, pair[0], parser.Expand(pair[1], s.lookup))
+	}
+	return nil
+}
+
+// keys returns the variables which influence the result of a build step.
+func (s *buildState) keys() []string {
+	keys := []string{}
+	for _, env := range s.env {
+		keys = append(keys, "ENV "+env)
+	}
+	for _, arg := range s.args {
+		keys = append(keys, "ARG "+arg)
+	}
+	if s.workdir != "" {
+		keys = append(keys, "WORKDIR "+s.workdir)
+	}
+	if s.user != "" {
+		keys = append(keys, "USER "+s.user)
+	}
+	if len(s.shell) > 0 {
+		keys = append(keys, "SHELL "+parser.Quote(s.shell))
+	}
+	if s.pkgManager != nil {
+		keys = append(keys, "PKG_MANAGER "+s.pkgManager.Name)
+	}
+	return keys
+}
+
+// setWorkdir changes the working directory. Relative paths are resolved
+// against the previous working directory.
+func (s *buildState) setWorkdir(dir string) {
+	if !path.IsAbs(dir) {
+		dir = path.Join("/", s.workdir, dir)
+	}
+	s.workdir = path.Clean(dir)
+}
+
+// unusedBuildArgs returns the build arguments no ARG instruction declared.
+func (s *buildState) unusedBuildArgs() []string {
+	unused := []string{}
+	for name := range s.buildArgs {
+		if !s.consumed[name] {
+			unused = append(unused, name)
+		}
+	}
+	return unused
+}
+
+func lookupVar(vars []string, name string) (string, bool) {
+	for _, v := range vars {
+		kv := strings.SplitN(v, "=", 2)
+		if kv[0] == name {
+			return kv[1], true
+		}
+	}
+	return "", false
+}
+
+func setVar(vars []string, name, value string) []string {
+	result := []string{}
+	for _, v := range vars {
+		if strings.SplitN(v, "=", 2)[0] != name {
+			result = append(result, v)
+		}
+	}
+	return append(result, fmt.Sprintf("%s=%s", name, value))
 }
 
 func runBuild(args []string) (exit int) {
@@ -32,30 +343,78 @@ func runBuild(args []string) (exit int) {
 	}
 
 	newImagePath := args[0]
+	start := time.Now()
 
-	fs, _ := btrfs.Init(home)
+	mode := flagProgress
+	if flagQuiet {
+		mode = "quiet"
+	}
+	reporter, err := progress.NewReporter(mode, os.Stdout, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
 
-	// remove existing layer
-	if fs.Exists(newImagePath) {
-		if err := fs.Remove(newImagePath); err != nil {
-			fmt.Printf("%v", err)
-			fmt.Fprintln(os.Stderr, fmt.Sprintf("Couldn't remove existing image. %v", err))
-			return 1
-		}
+	fs, err := initStorage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't populate filesystem for conair.", err)
+		return 1
+	}
+
+	// the first interrupt cancels the build and removes its unfinished
+	// layer, a second one kills conair
+	runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-runCtx.Done()
+		stop()
+	}()
+
+	ctx, err := buildcontext.New(flagContext)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't read build context.", err)
+		return 1
 	}
 
 	// read build file
-	f, err := readFile("./Conairfile")
+	filename := flagFile
+	if filename == "" {
+		filename = path.Join(ctx.Dir, "Conairfile")
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			filename = path.Join(ctx.Dir, "Dockerfile")
+		}
+	}
+	f, err := parser.Parse(filename)
 	if err != nil {
-		f, err = readFile("./Dockerfile")
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Couldn't read Conairfile or Dockerfile.", err)
+		fmt.Fprintln(os.Stderr, "Couldn't read Conairfile or Dockerfile.", err)
+		return 1
+	}
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't read Conairfile or Dockerfile.", err)
+		return 1
+	}
+
+	state, err := newBuildState(flagBuildArg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	mounts, err := newBuildMounts(fs, flagSecret, flagSSH, flagNoCache)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// ARG instructions before FROM can only be used in FROM
+	for _, arg := range f.Args {
+		if err := state.declareArg(arg.Payload); err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Line %d: %v", arg.Line, err))
 			return 1
 		}
 	}
 
-	parentPath := f.From
-
 	for i, snap := range f.Snapshots {
 		paths := strings.Split(snap, ":")
 		if len(paths) < 2 {
@@ -75,36 +434,369 @@ func runBuild(args []string) (exit int) {
 		f.Snapshots[i] = fmt.Sprintf("%s/.cnr-snapshot-%s", home, snap)
 	}
 
-	for _, cmd := range f.Commands {
-		l, err := layer.Create(fs, cmd.Verb, cmd.Payload, parentPath)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, fmt.Sprintf("Couldn't create layer: %v.", err))
+	b := &builder{
+		fs:       fs,
+		file:     f,
+		ctx:      ctx,
+		global:   state,
+		progress: reporter,
+		runCtx:   runCtx,
+		mounts:   mounts,
+	}
+	for _, stage := range f.Stages {
+		b.steps += len(stage.Commands)
+	}
+	for i := range f.Stages {
+		if err := b.buildStage(i); err != nil {
+			reporter.Report(progress.Event{Type: progress.Failed, Time: time.Now(), Error: err.Error()})
+			fmt.Fprintln(os.Stderr, err)
 			return 1
 		}
-		fmt.Println(l.Hash, cmd.Verb, cmd.Payload)
+	}
 
-		if l.Exists == true {
-			parentPath = l.Path
-			continue
-		}
+	for _, arg := range state.unusedBuildArgs() {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Build argument %s was not consumed by any ARG instruction.", arg))
+	}
 
-		c := nspawn.Init(l.Hash, fmt.Sprintf("%s/%s", home, l.Path))
-		c.SetBinds(append(f.Binds, f.Snapshots...))
+	if runCtx.Err() != nil {
+		fmt.Fprintln(os.Stderr, errCanceled)
+		return 1
+	}
 
-		if err := c.Build(cmd.Verb, cmd.Payload); err != nil {
-			fmt.Fprintln(os.Stderr, fmt.Sprintf("Buildstep failed: %v.", err))
-			if err = l.Remove(); err != nil {
-				fmt.Fprintln(os.Stderr, "Couldn't remove temporary build container.", err)
-			}
+	// only the last stage becomes the image. An existing image is replaced
+	// once the new one is complete.
+	last := len(b.stages) - 1
+	tmpPath := layer.TempPath(newImagePath)
+	if err = fs.Snapshot(b.stages[last].path, tmpPath, false); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't create filesystem for new image.", err)
+		return 1
+	}
+	if fs.Exists(newImagePath) {
+		if err := fs.Remove(newImagePath); err != nil {
+			fs.Remove(tmpPath)
+			fmt.Fprintln(os.Stderr, "Couldn't remove existing image.", err)
 			return 1
 		}
-
-		parentPath = l.Path
 	}
-	if err = fs.Snapshot(parentPath, newImagePath, false); err != nil {
+	if err := fs.Rename(tmpPath, newImagePath); err != nil {
 		fmt.Fprintln(os.Stderr, "Couldn't create filesystem for new image.", err)
 		return 1
 	}
 
+	m := image.New(newImagePath, image.SourceBuild)
+	m.Parent = b.stages[last].parent
+	m.Conairfile = string(source)
+	m.Layers = b.stages[last].layers
+	m.Digest = b.stages[last].id
+	m.Config = b.stages[last].state.config()
+	if err := m.Write(home); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't write manifest of new image.", err)
+		return 1
+	}
+
+	reporter.Report(progress.Event{
+		Type:     progress.Done,
+		Time:     time.Now(),
+		Image:    newImagePath,
+		Digest:   m.Digest,
+		Duration: time.Since(start),
+	})
 	return 0
 }
+
+// builder builds the stages of a Conairfile one after another.
+type builder struct {
+	fs     storage.Driver
+	file   *parser.Conairfile
+	ctx    *buildcontext.Context
+	global *buildState
+	stages []*builtStage
+
+	progress progress.Reporter
+	// runCtx is canceled when the build is interrupted
+	runCtx context.Context
+	mounts *buildMounts
+	// step is the number of the current instruction, steps counts the
+	// instructions of all stages
+	step  int
+	steps int
+}
+
+// builtStage is the result of a stage.
+type builtStage struct {
+	// path and id of the last layer, the id is the digest of the base image
+	// if the stage has no layers
+	path  string
+	id    string
+	state *buildState
+	// parent is the image the stage is based on
+	parent string
+	layers []image.Layer
+}
+
+// resolve finds the stage (by name or index) or the image a FROM or COPY
+// --from refers to. It returns the path below home and, for stages, their
+// result.
+func (b *builder) resolve(ref string) (string, *builtStage, error) {
+	index := -1
+	for i, stage := range b.file.Stages {
+		if stage.Name != "" && stage.Name == strings.ToLower(ref) {
+			index = i
+		}
+	}
+	if n, err := strconv.Atoi(ref); err == nil && index < 0 {
+		index = n
+	}
+
+	switch {
+	case index >= len(b.stages):
+		return "", nil, fmt.Errorf("Stage %s can't be used before it is built", ref)
+	case index >= 0:
+		return b.stages[index].path, b.stages[index], nil
+	}
+	return ref, nil, nil
+}
+
+func (b *builder) buildStage(i int) error {
+	stage := b.file.Stages[i]
+
+	parentPath, base, err := b.resolve(parser.Expand(stage.From, b.global.lookup))
+	if err != nil {
+		return fmt.Errorf("Line %d: %v", stage.Line, err)
+	}
+
+	result := &builtStage{parent: parentPath}
+	var config image.Config
+	if base != nil {
+		result.parent = base.parent
+		result.id = base.id
+		result.layers = append(result.layers, base.layers...)
+		config = base.state.config()
+	} else {
+		if m, err := image.Read(home, parentPath); err == nil {
+			config = m.Config
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if !b.fs.Exists(parentPath) {
+			return fmt.Errorf("Line %d: Image %s doesn't exist", stage.Line, parentPath)
+		}
+		// the cache is keyed on the content of the base image
+		if result.id, err = image.Digest(home, parentPath); err != nil {
+			return fmt.Errorf("Line %d: %v", stage.Line, err)
+		}
+	}
+	state := b.global.stage(config)
+	b.progress.Report(progress.Event{
+		Type:        progress.Stage,
+		Time:        time.Now(),
+		Stage:       i,
+		Instruction: fmt.Sprintf("FROM %s", stage.From),
+	})
+
+	result.path = parentPath
+	for _, cmd := range stage.Commands {
+		if err := b.buildStep(i, cmd, state, result); err != nil {
+			return err
+		}
+	}
+
+	result.state = state
+	b.stages = append(b.stages, result)
+	return nil
+}
+
+// buildStep runs an instruction of a stage and reports its progress.
+func (b *builder) buildStep(stage int, cmd parser.Command, state *buildState, result *builtStage) error {
+	if b.runCtx.Err() != nil {
+		return errCanceled
+	}
+
+	b.step++
+	event := progress.Event{
+		Stage:       stage,
+		Step:        b.step,
+		Steps:       b.steps,
+		Instruction: fmt.Sprintf("%s %s", cmd.Verb, cmd.Payload),
+	}
+	event.Type, event.Time = progress.StepStart, time.Now()
+	b.progress.Report(event)
+
+	start := time.Now()
+	err := b.runStep(&event, cmd, state, result)
+	if err != nil && event.ExitCode == 0 {
+		event.ExitCode = 1
+	}
+	event.Type, event.Time = progress.StepEnd, time.Now()
+	event.Duration = time.Since(start)
+	b.progress.Report(event)
+	return err
+}
+
+// runStep runs an instruction on top of result. It records the layer of the
+// step, whether it was cached and the exit code of a failed command in event.
+func (b *builder) runStep(event *progress.Event, cmd parser.Command, state *buildState, result *builtStage) error {
+	payload := cmd.Payload
+
+	switch cmd.Verb {
+	case "ARG":
+		if err := state.declareArg(payload); err != nil {
+			return fmt.Errorf("Line %d: %v", cmd.Line, err)
+		}
+		return nil
+	case "ENV":
+		if err := state.setEnv(payload); err != nil {
+			return fmt.Errorf("Line %d: %v", cmd.Line, err)
+		}
+	case "WORKDIR":
+		state.setWorkdir(parser.Expand(payload, state.lookup))
+		return nil
+	case "USER":
+		state.user = parser.Expand(payload, state.lookup)
+		return nil
+	case "SHELL":
+		state.shell = cmd.Args
+		return nil
+	case "PKG_MANAGER":
+		m, err := pkgmgr.Get(parser.Expand(payload, state.lookup))
+		if err != nil {
+			return fmt.Errorf("Line %d: %v", cmd.Line, err)
+		}
+		state.pkgManager = m
+		return nil
+	case "LABEL", "EXPOSE", "VOLUME", "ENTRYPOINT", "CMD":
+		if err := state.configure(cmd); err != nil {
+			return fmt.Errorf("Line %d: %v", cmd.Line, err)
+		}
+		return nil
+	case "RUN", "RUN_NOCACHE":
+		// variables are expanded by the shell of the build step
+		payload = cmd.ShellPayload()
+	default:
+		payload = parser.Expand(payload, state.lookup)
+	}
+
+	keys := state.keys()
+	ctx := b.ctx
+	if cmd.Verb == "ADD" || cmd.Verb == "COPY" {
+		args, err := parser.ParseCopy(payload)
+		if err != nil {
+			return fmt.Errorf("Line %d: %v", cmd.Line, err)
+		}
+		if args.From != "" {
+			if ctx, err = b.sourceContext(args.From); err != nil {
+				return fmt.Errorf("Line %d: %v", cmd.Line, err)
+			}
+		}
+
+		// the content of the sources decides whether the layer is reused
+		digest, err := ctx.Digest(args.Sources)
+		if err != nil {
+			return fmt.Errorf("Line %d: %v", cmd.Line, err)
+		}
+		keys = append(keys, "SOURCES "+digest)
+	}
+
+	l, err := layer.Create(b.fs, cmd.Verb, payload, result.path, result.id, keys...)
+	if err != nil {
+		return fmt.Errorf("Couldn't create layer: %v.", err)
+	}
+	event.Layer = l.Hash
+	result.layers = append(result.layers, image.Layer{
+		Hash:        l.Hash,
+		Instruction: fmt.Sprintf("%s %s", cmd.Verb, payload),
+	})
+
+	result.id = l.Hash
+	if l.Exists == true {
+		result.path = l.Path
+		event.Type, event.Time, event.Cached = progress.CacheHit, time.Now(), true
+		b.progress.Report(*event)
+		return nil
+	}
+
+	specs := cmd.Mounts
+	pkgManager := state.pkgManager
+	if cmd.Verb == "PKG" {
+		if pkgManager == nil {
+			if pkgManager, err = pkgmgr.Detect(fmt.Sprintf("%s/%s", home, l.TmpPath)); err != nil {
+				l.Remove()
+				return fmt.Errorf("Line %d: %v", cmd.Line, err)
+			}
+		}
+		specs = append(specs, packageCache(pkgManager))
+	}
+
+	// secrets are copied for the step and removed right after it
+	mounts, cleanup, err := b.mounts.resolve(specs)
+	if err != nil {
+		l.Remove()
+		return fmt.Errorf("Line %d: %v", cmd.Line, err)
+	}
+	defer cleanup()
+
+	c := nspawn.Init(l.Hash, fmt.Sprintf("%s/%s", home, l.TmpPath))
+	c.SetMounts(mounts)
+	c.SetPackageManager(pkgManager)
+	c.SetBinds(append(b.file.Binds, b.file.Snapshots...))
+	c.SetEnv(state.env)
+	c.SetBuildArgs(state.args)
+	c.SetWorkdir(state.workdir)
+	c.SetUser(state.user)
+	c.SetContext(ctx)
+	if !cmd.JSON {
+		// the exec form doesn't use a shell
+		c.SetShell(state.shell)
+	}
+
+	stdout := progress.Writer(b.progress, *event, "stdout")
+	stderr := progress.Writer(b.progress, *event, "stderr")
+	c.SetOutput(stdout, stderr)
+	err = c.Build(b.runCtx, cmd.Verb, payload)
+	stdout.Close()
+	stderr.Close()
+	if err != nil {
+		event.ExitCode = exitCode(err)
+		if err := l.Remove(); err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't remove temporary build container.", err)
+		}
+		if b.runCtx.Err() != nil {
+			return errCanceled
+		}
+		return fmt.Errorf("Buildstep failed: %v.", err)
+	}
+	if err := l.Commit(); err != nil {
+		return fmt.Errorf("Couldn't create layer: %v.", err)
+	}
+	if err := layer.MarkCreated(home, l.Path); err != nil {
+		return fmt.Errorf("Couldn't record creation of layer: %v.", err)
+	}
+
+	result.path = l.Path
+	return nil
+}
+
+var errCanceled = fmt.Errorf("Build canceled.")
+
+// exitCode returns the exit code of a failed build step.
+func exitCode(err error) int {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return 1
+}
+
+// sourceContext returns the root filesystem of a stage or an image to COPY
+// --from.
+func (b *builder) sourceContext(from string) (*buildcontext.Context, error) {
+	vol, _, err := b.resolve(from)
+	if err != nil {
+		return nil, err
+	}
+	if !b.fs.Exists(vol) {
+		return nil, fmt.Errorf("Neither a stage nor an image named %s exists", from)
+	}
+	return buildcontext.FromImage(fmt.Sprintf("%s/%s", home, vol))
+}
@@ -0,0 +1,221 @@
+package buildcontext
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/giantswarm/conair/fileutil"
+)
+
+// Context is the directory the sources of ADD and COPY instructions are
+// relative to.
+type Context struct {
+	Dir    string
+	ignore []pattern
+	// image contexts are root filesystems, their symlinks are resolved
+	// within Dir
+	image bool
+}
+
+func New(dir string) (*Context, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	// sources are compared with the context after resolving their symlinks
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("Build context %s is not a directory", dir)
+	}
+
+	c := &Context{Dir: dir}
+	if err := c.readIgnore(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// FromImage returns a context for the root filesystem of an image or a build
+// stage, for COPY --from.
+func FromImage(dir string) (*Context, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &Context{Dir: filepath.Clean(dir), image: true}, nil
+}
+
+// IsURL returns whether a source is downloaded instead of read from the
+// context.
+func IsURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// Glob returns the paths of the files matching a source pattern, without the
+// ignored ones. It's an error if nothing matches or a source is outside of the
+// context.
+func (c *Context) Glob(pattern string) ([]string, error) {
+	if c.image {
+		return c.globImage(pattern)
+	}
+
+	abs := filepath.Join(c.Dir, filepath.Clean("/"+pattern))
+	matches, err := filepath.Glob(abs)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, match := range matches {
+		if c.Ignored(match) {
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(match)
+		if err != nil {
+			return nil, err
+		}
+		if resolved != c.Dir && !strings.HasPrefix(resolved, c.Dir+"/") {
+			return nil, fmt.Errorf("%s is outside of the build context", pattern)
+		}
+		result = append(result, match)
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%s: no such file or directory in build context", pattern)
+	}
+	return result, nil
+}
+
+// globImage resolves the directory of a pattern like the image would see it,
+// so absolute symlinks don't point to the host.
+func (c *Context) globImage(pattern string) ([]string, error) {
+	dir, base := filepath.Split(filepath.Clean("/" + pattern))
+	if strings.ContainsAny(dir, `*?[\`) {
+		return nil, fmt.Errorf("%s: wildcards are only supported in the last element of the path", pattern)
+	}
+	resolved, err := fileutil.SecureJoin(c.Dir, dir)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := filepath.Glob(filepath.Join(resolved, base))
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("%s: no such file or directory", pattern)
+	}
+
+	result := []string{}
+	for _, match := range matches {
+		// sources which are symlinks are followed
+		if match, err = fileutil.SecureJoin(c.Dir, strings.TrimPrefix(match, c.Dir)); err != nil {
+			return nil, err
+		}
+		result = append(result, match)
+	}
+	return result, nil
+}
+
+// Digest returns a checksum over the names, permissions and contents of all
+// files matching the sources. URLs are downloaded to checksum their content.
+func (c *Context) Digest(sources []string) (string, error) {
+	h := sha256.New()
+
+	for _, source := range sources {
+		io.WriteString(h, source+"\x00")
+		if IsURL(source) {
+			if err := hashURL(h, source); err != nil {
+				return "", fmt.Errorf("Couldn't download %s. %v", source, err)
+			}
+			continue
+		}
+
+		matches, err := c.Glob(source)
+		if err != nil {
+			return "", err
+		}
+		for _, match := range matches {
+			if err := c.hashTree(h, match); err != nil {
+				return "", err
+			}
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashURL writes the content of a URL to h.
+func hashURL(h io.Writer, source string) error {
+	resp, err := http.Get(source)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Server responded with %s", resp.Status)
+	}
+	_, err = io.Copy(h, resp.Body)
+	return err
+}
+
+// hashTree writes all entries below root, which aren't ignored, to h in
+// lexical order.
+func (c *Context) hashTree(h io.Writer, root string) error {
+	// a trailing slash makes Walk follow a symlinked source directory
+	if fi, err := os.Stat(root); err != nil {
+		return err
+	} else if fi.IsDir() {
+		root += "/"
+	}
+
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != root && c.Ignored(path) {
+			if fi.IsDir() && !c.hasExclusions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00", filepath.ToSlash(rel), fi.Mode())
+
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			io.WriteString(h, link)
+		case fi.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fmt.Fprintf(h, "%d\x00", fi.Size())
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+		io.WriteString(h, "\x00")
+		return nil
+	})
+}
@@ -0,0 +1,158 @@
+package buildcontext
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFiles list the files of the context which are never added to an
+// image. Like docker, .dockerignore is used if there is no .conairignore.
+var IgnoreFiles = []string{".conairignore", ".dockerignore"}
+
+type pattern struct {
+	re        *regexp.Regexp
+	exclusion bool
+}
+
+// readPatterns parses docker-style ignore patterns: one glob per line, `**`
+// matches any number of directories, lines starting with ! re-include files
+// and the last matching pattern wins.
+func readPatterns(r io.Reader) ([]pattern, error) {
+	patterns := []pattern{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p := pattern{}
+		if strings.HasPrefix(line, "!") {
+			p.exclusion = true
+			line = strings.TrimSpace(line[1:])
+		}
+		line = strings.Trim(filepath.ToSlash(filepath.Clean("/"+line)), "/")
+		if line == "" {
+			continue
+		}
+
+		re, err := compile(line)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ignore pattern %s. %v", line, err)
+		}
+		p.re = re
+		patterns = append(patterns, p)
+	}
+	return patterns, scanner.Err()
+}
+
+// compile translates a glob to a regular expression.
+func compile(glob string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == '*' && strings.HasPrefix(glob[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case c == '*' && strings.HasPrefix(glob[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [")
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += end
+		case c == '\\' && i+1 < len(glob):
+			i++
+			re.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+func (c *Context) readIgnore() error {
+	for _, name := range IgnoreFiles {
+		f, err := os.Open(filepath.Join(c.Dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if c.ignore, err = readPatterns(f); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// Ignored returns whether a path of the context is excluded by the ignore
+// file. Files in an ignored directory are ignored as well, unless a later
+// pattern re-includes them.
+func (c *Context) Ignored(path string) bool {
+	rel, err := filepath.Rel(c.Dir, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+
+	ignored := false
+	for _, p := range c.ignore {
+		if p.exclusion != ignored {
+			// the pattern can't change the result
+			continue
+		}
+		if p.matches(rel) {
+			ignored = !p.exclusion
+		}
+	}
+	return ignored
+}
+
+// matches checks the path and all its parent directories.
+func (p pattern) matches(rel string) bool {
+	for {
+		if p.re.MatchString(rel) {
+			return true
+		}
+		i := strings.LastIndexByte(rel, '/')
+		if i < 0 {
+			return false
+		}
+		rel = rel[:i]
+	}
+}
+
+// hasExclusions returns whether ignored directories may contain files which
+// aren't ignored.
+func (c *Context) hasExclusions() bool {
+	for _, p := range c.ignore {
+		if p.exclusion {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/giantswarm/conair/fileutil"
+)
+
+var cmdCache = &Command{
+	Name:    "cache",
+	Summary: "Manage the cache mounts of builds",
+	Usage:   "ls | prune [<id>...]",
+	Run:     runCache,
+	Description: `Manage the caches mounted into RUN --mount=type=cache and PKG build steps
+
+conair cache ls
+
+Shows the id, size and last modification of every cache.
+
+conair cache prune [<id>...]
+
+Removes the given caches, or all of them. They are created again by the next
+build which uses them.
+`,
+}
+
+func runCache(args []string) (exit int) {
+	if len(args) < 1 || (args[0] != "ls" && args[0] != "prune") {
+		fmt.Fprintln(os.Stderr, "Unknown or missing subcommand. Use: conair cache ls | prune [<id>...]")
+		return 1
+	}
+
+	fs, err := initStorage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't populate filesystem for conair.", err)
+		return 1
+	}
+
+	volumes, err := fs.List()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't list volumes.", err)
+		return 1
+	}
+
+	if args[0] == "ls" {
+		fmt.Fprintln(out, "CACHE\tSIZE\tMODIFIED")
+		for _, vol := range volumes {
+			id, ok := cacheID(vol)
+			if !ok {
+				continue
+			}
+			dir := fmt.Sprintf("%s/%s", home, vol)
+			fi, err := os.Stat(dir)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, fmt.Sprintf("Couldn't stat cache %s.", id), err)
+				return 1
+			}
+			size, err := fileutil.Size(dir)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, fmt.Sprintf("Couldn't compute size of cache %s.", id), err)
+				return 1
+			}
+			fmt.Fprintf(out, "%s\t%s\t%s\n", id, fileutil.FormatSize(size), fi.ModTime().Format(time.RFC3339))
+		}
+		out.Flush()
+		return 0
+	}
+
+	prune := []string{}
+	if len(args) > 1 {
+		for _, id := range args[1:] {
+			vol := cacheVolume(id)
+			if !fs.Exists(vol) {
+				fmt.Fprintln(os.Stderr, fmt.Sprintf("Cache %s doesn't exist.", id))
+				return 1
+			}
+			prune = append(prune, vol)
+		}
+	} else {
+		for _, vol := range volumes {
+			if _, ok := cacheID(vol); ok {
+				prune = append(prune, vol)
+			}
+		}
+	}
+
+	var freed int64
+	for _, vol := range prune {
+		id, _ := cacheID(vol)
+		size, err := fileutil.Size(fmt.Sprintf("%s/%s", home, vol))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Couldn't compute size of cache %s.", id), err)
+			return 1
+		}
+		if err := fs.Remove(vol); err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Couldn't remove cache %s.", id), err)
+			return 1
+		}
+		fmt.Println(id, fileutil.FormatSize(size))
+		freed += size
+	}
+	fmt.Printf("Removed %d caches, %s.\n", len(prune), fileutil.FormatSize(freed))
+	return 0
+}
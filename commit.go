@@ -4,7 +4,7 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/giantswarm/conair/btrfs"
+	"github.com/giantswarm/conair/image"
 )
 
 var cmdCommit = &Command{
@@ -30,11 +30,39 @@ func runCommit(args []string) (exit int) {
 		imagePath = args[1]
 	}
 
-	fs, _ := btrfs.Init(home)
+	fs, err := initStorage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't populate filesystem for conair.", err)
+		return 1
+	}
+
+	// the new image keeps the configuration of the image the container runs
+	m := image.New(imagePath, image.SourceCommit)
+	if uuid, err := fs.GetSubvolumeParentUuid(containerPath); err == nil {
+		if parent, err := fs.GetLayerByUuid(uuid); err == nil {
+			m.Parent = parent
+			if pm, err := image.Read(home, parent); err == nil {
+				m.Layers = pm.Layers
+				m.Config = pm.Config
+			}
+		}
+	}
+
 	if err := fs.Snapshot(containerPath, imagePath, true); err != nil {
 		fmt.Fprintln(os.Stderr, "Couldn't create snapshot of container.", err)
 		return 1
 	}
 
+	digest, err := image.ComputeDigest(fmt.Sprintf("%s/%s", home, imagePath))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't compute digest of image.", err)
+		return 1
+	}
+	m.Digest = digest
+	if err := m.Write(home); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't write manifest of image.", err)
+		return 1
+	}
+
 	return 0
 }
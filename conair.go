@@ -6,19 +6,28 @@ import (
 	"os"
 	"os/user"
 	"text/tabwriter"
+
+	"github.com/giantswarm/conair/config"
+	"github.com/giantswarm/conair/networkd"
+	"github.com/giantswarm/conair/nspawn"
+	"github.com/giantswarm/conair/storage"
 )
 
 const (
 	cliName        = "conair"
 	cliDescription = "conair is a command-line interface to systemd-nspawn containers. much like docker."
 
-	bridge      = "nspawn0"
-	destination = "192.168.13.0/24"
-	home        = "/var/lib/machines"
-	hub         = "http://conair.teemow.com/images"
+	bridge       = "nspawn0"
+	destination  = "192.168.13.0/24"
+	machinesPath = "/var/lib/machines"
 )
 
 var (
+	// directory images, layers and containers are stored in
+	home = machinesPath
+	// configuration file with the registries
+	configFile = config.Path
+
 	out           *tabwriter.Writer
 	globalFlagset = flag.NewFlagSet(cliName, flag.ExitOnError)
 
@@ -27,8 +36,10 @@ var (
 
 	// flags used by all commands
 	globalFlags = struct {
-		Debug   bool
-		Version bool
+		Debug         bool
+		Version       bool
+		StorageDriver string
+		Root          string
 	}{}
 
 	projectVersion string
@@ -46,19 +57,10 @@ func (s *stringSlice) Set(value string) error {
 }
 
 func init() {
-	user, err := user.Current()
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Can't find current user. Need to be root.")
-		os.Exit(1)
-	}
-
-	if user.Uid != "0" {
-		fmt.Fprintln(os.Stderr, "Please run conair as root.")
-		os.Exit(1)
-	}
-
 	globalFlagset.BoolVar(&globalFlags.Debug, "debug", false, "Print out more debug information to stderr")
 	globalFlagset.BoolVar(&globalFlags.Version, "version", false, "Print the version and exit")
+	globalFlagset.StringVar(&globalFlags.StorageDriver, "storage-driver", storage.DriverAuto, "Storage driver to use (auto, btrfs, overlay or vfs)")
+	globalFlagset.StringVar(&globalFlags.Root, "root", "", "Prefix for all host paths conair writes to")
 }
 
 type Command struct {
@@ -89,10 +91,17 @@ func init() {
 		cmdStatus,
 		cmdBuild,
 		cmdPull,
+		cmdPush,
+		cmdSign,
+		cmdSave,
+		cmdLoad,
 		cmdBootstrap,
 		cmdInspect,
 		cmdIp,
 		cmdSnapshot,
+		cmdLayers,
+		cmdGc,
+		cmdCache,
 		cmdHelp,
 		cmdVersion,
 	}
@@ -110,8 +119,32 @@ func getFlags(flagset *flag.FlagSet) (flags []*flag.Flag) {
 	return
 }
 
+func initStorage() (storage.Driver, error) {
+	return storage.Init(globalFlags.StorageDriver, home)
+}
+
+// setRoot moves all host paths below the given directory.
+func setRoot(root string) {
+	home = root + machinesPath
+	configFile = root + config.Path
+	nspawn.Root = root
+	networkd.Root = root
+}
+
 func main() {
+	user, err := user.Current()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can't find current user. Need to be root.")
+		os.Exit(1)
+	}
+
+	if user.Uid != "0" {
+		fmt.Fprintln(os.Stderr, "Please run conair as root.")
+		os.Exit(1)
+	}
+
 	globalFlagset.Parse(os.Args[1:])
+	setRoot(globalFlags.Root)
 
 	var args = globalFlagset.Args()
 
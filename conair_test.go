@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"text/tabwriter"
+	"time"
+
+	"github.com/giantswarm/conair/image"
+	"github.com/giantswarm/conair/runner"
+	"github.com/giantswarm/conair/storage"
+)
+
+// setupRoot moves conair into a temporary root with the vfs driver and
+// records all commands instead of running them.
+func setupRoot(t *testing.T) (string, *runner.Recorder) {
+	root := t.TempDir()
+	rec := &runner.Recorder{}
+
+	oldRunner, oldDriver, oldContext := runner.Default, globalFlags.StorageDriver, flagContext
+	runner.Default = rec
+	globalFlags.StorageDriver = storage.DriverVfs
+	setRoot(root)
+	t.Cleanup(func() {
+		runner.Default, globalFlags.StorageDriver, flagContext = oldRunner, oldDriver, oldContext
+		setRoot("")
+	})
+
+	for _, dir := range []string{home, root + "/etc/systemd/system"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, rec
+}
+
+// createBaseImage creates an image without manifest, like pacstrap does.
+func createBaseImage(t *testing.T, name string) {
+	fs, err := initStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Subvolume(name); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path.Join(home, name, "etc/os-release"), "ID=test\n")
+}
+
+func writeFile(t *testing.T, file, content string) {
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// hasCommand reports whether a recorded command line starts with prefix and
+// contains all of the parts.
+func hasCommand(commands []string, prefix string, parts ...string) bool {
+	for _, cmd := range commands {
+		if !strings.HasPrefix(cmd, prefix) {
+			continue
+		}
+		found := true
+		for _, part := range parts {
+			found = found && strings.Contains(cmd, part)
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBuildRunRm(t *testing.T) {
+	_, rec := setupRoot(t)
+	createBaseImage(t, "base")
+
+	ctx := t.TempDir()
+	writeFile(t, path.Join(ctx, "hello.txt"), "hello\n")
+	writeFile(t, path.Join(ctx, "Conairfile"), `FROM base
+ENV GREETING=hello
+RUN echo $GREETING > /greeting
+COPY hello.txt /srv/hello.txt
+EXPOSE 80
+CMD ["/bin/true"]
+`)
+	flagContext = ctx
+
+	if exit := runBuild([]string{"app"}); exit != 0 {
+		t.Fatalf("build failed with %d", exit)
+	}
+	if !hasCommand(rec.Commands(), "/usr/bin/systemd-nspawn", "--setenv=GREETING=hello") {
+		t.Errorf("RUN wasn't run by systemd-nspawn: %v", rec.Commands())
+	}
+	data, err := ioutil.ReadFile(path.Join(home, "app/srv/hello.txt"))
+	if err != nil || string(data) != "hello\n" {
+		t.Errorf("COPY didn't copy hello.txt: %q %v", data, err)
+	}
+	if _, err := os.Stat(path.Join(home, "app/etc/os-release")); err != nil {
+		t.Errorf("image lost the content of its base: %v", err)
+	}
+	m, err := image.Read(home, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Config.Cmd) != 1 || m.Config.Cmd[0] != "/bin/true" || len(m.Config.ExposedPorts) != 1 {
+		t.Errorf("unexpected configuration %+v", m.Config)
+	}
+
+	if exit := runRun([]string{"app", "web"}); exit != 0 {
+		t.Fatalf("run failed with %d", exit)
+	}
+	commands := rec.Commands()
+	if !hasCommand(commands, "systemctl enable conair@web.service") || !hasCommand(commands, "systemctl start conair@web.service") {
+		t.Errorf("container wasn't enabled and started: %v", commands)
+	}
+	if _, err := os.Stat(path.Join(home, ".#web/srv/hello.txt")); err != nil {
+		t.Errorf("container doesn't have the files of its image: %v", err)
+	}
+
+	if exit := runRm([]string{"web"}); exit != 0 {
+		t.Fatalf("rm failed with %d", exit)
+	}
+	commands = rec.Commands()
+	if !hasCommand(commands, "systemctl stop conair@web.service") || !hasCommand(commands, "systemctl disable conair@web.service") {
+		t.Errorf("container wasn't stopped and disabled: %v", commands)
+	}
+	if _, err := os.Stat(path.Join(home, ".#web")); !os.IsNotExist(err) {
+		t.Errorf("filesystem of the container wasn't removed: %v", err)
+	}
+	if _, err := os.Stat(path.Join(home, "app")); err != nil {
+		t.Errorf("rm removed the image: %v", err)
+	}
+}
+
+func TestBuildSymlinkedContext(t *testing.T) {
+	setupRoot(t)
+	createBaseImage(t, "base")
+
+	ctx := t.TempDir()
+	writeFile(t, path.Join(ctx, "hello.txt"), "hello\n")
+	writeFile(t, path.Join(ctx, "Conairfile"), "FROM base\nCOPY hello.txt /srv/hello.txt\n")
+	link := path.Join(t.TempDir(), "context")
+	if err := os.Symlink(ctx, link); err != nil {
+		t.Fatal(err)
+	}
+	flagContext = link
+
+	if exit := runBuild([]string{"app"}); exit != 0 {
+		t.Fatalf("build from a symlinked context failed with %d", exit)
+	}
+	if _, err := os.Stat(path.Join(home, "app/srv/hello.txt")); err != nil {
+		t.Errorf("COPY didn't copy hello.txt: %v", err)
+	}
+}
+
+func TestBuildChangedURL(t *testing.T) {
+	setupRoot(t)
+	createBaseImage(t, "base")
+
+	body := "one\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	ctx := t.TempDir()
+	writeFile(t, path.Join(ctx, "Conairfile"), "FROM base\nADD "+server.URL+"/file.txt /srv/file.txt\n")
+	flagContext = ctx
+
+	layers := []string{}
+	for i, name := range []string{"one", "same", "two"} {
+		if i == 2 {
+			body = "two\n"
+		}
+		if exit := runBuild([]string{name}); exit != 0 {
+			t.Fatalf("build of %s failed with %d", name, exit)
+		}
+		m, err := image.Read(home, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers = append(layers, m.Layers[len(m.Layers)-1].Hash)
+	}
+	if layers[0] != layers[1] {
+		t.Errorf("unchanged URL didn't use the cache: %v", layers)
+	}
+	if layers[1] == layers[2] {
+		t.Errorf("changed URL used the cache: %v", layers)
+	}
+	data, err := ioutil.ReadFile(path.Join(home, "two/srv/file.txt"))
+	if err != nil || string(data) != "two\n" {
+		t.Errorf("ADD didn't download the changed file: %q %v", data, err)
+	}
+}
+
+func TestBuildFailingStep(t *testing.T) {
+	_, rec := setupRoot(t)
+	createBaseImage(t, "base")
+	rec.Handler = func(call runner.Call) ([]byte, error) {
+		if strings.HasSuffix(call.Args[0], "systemd-nspawn") {
+			return []byte("no such command\n"), &os.PathError{Op: "exec", Path: call.Args[0], Err: os.ErrNotExist}
+		}
+		return nil, nil
+	}
+
+	ctx := t.TempDir()
+	writeFile(t, path.Join(ctx, "Conairfile"), "FROM base\nRUN false\n")
+	flagContext = ctx
+
+	if exit := runBuild([]string{"broken"}); exit == 0 {
+		t.Fatal("build of a failing step succeeded")
+	}
+	fs, err := initStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.Exists("broken") {
+		t.Error("failed build created the image")
+	}
+}
+
+func TestBuildUserGroup(t *testing.T) {
+	_, rec := setupRoot(t)
+	createBaseImage(t, "base")
+	writeFile(t, path.Join(home, "base/etc/passwd"), "root:x:0:0::/root:/bin/sh\napp:x:1000:1000::/home/app:/bin/sh\n")
+	writeFile(t, path.Join(home, "base/etc/group"), "root:x:0:\nwheel:x:10:\napp:x:1000:\n")
+
+	ctx := t.TempDir()
+	flagContext = ctx
+
+	writeFile(t, path.Join(ctx, "Conairfile"), "FROM base\nUSER app:app\nRUN id\n")
+	if exit := runBuild([]string{"primary"}); exit != 0 {
+		t.Fatalf("build with the primary group failed with %d", exit)
+	}
+	if !hasCommand(rec.Commands(), "/usr/bin/systemd-nspawn", "--user=app ") {
+		t.Errorf("RUN didn't run as app: %v", rec.Commands())
+	}
+
+	writeFile(t, path.Join(ctx, "Conairfile"), "FROM base\nUSER app:wheel\nRUN id\n")
+	if exit := runBuild([]string{"other"}); exit == 0 {
+		t.Error("build with another group than the primary one succeeded")
+	}
+}
+
+func TestBuildChownSymlinkedPasswd(t *testing.T) {
+	setupRoot(t)
+	createBaseImage(t, "base")
+	// the passwd file of the host must not be read
+	host := path.Join(t.TempDir(), "passwd")
+	writeFile(t, host, "host:x:4242:4242::/:/bin/sh\n")
+	if err := os.Symlink(host, path.Join(home, "base/etc/passwd")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := t.TempDir()
+	writeFile(t, path.Join(ctx, "hello.txt"), "hello\n")
+	writeFile(t, path.Join(ctx, "Conairfile"), "FROM base\nCOPY --chown=host hello.txt /hello.txt\n")
+	flagContext = ctx
+	if exit := runBuild([]string{"app"}); exit == 0 {
+		t.Error("COPY --chown looked up the user on the host")
+	}
+}
+
+func TestImagesWithoutManifest(t *testing.T) {
+	setupRoot(t)
+	createBaseImage(t, "base")
+
+	var buf bytes.Buffer
+	old := out
+	out = tabwriter.NewWriter(&buf, 0, 8, 1, ' ', 0)
+	defer func() { out = old }()
+
+	if exit := runImages(nil); exit != 0 {
+		t.Fatalf("images failed with %d", exit)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "base ") {
+		t.Errorf("image without manifest isn't listed:\n%s", buf.String())
+	}
+}
+
+func TestRootVolume(t *testing.T) {
+	setupRoot(t)
+	createBaseImage(t, "base")
+
+	ctx := t.TempDir()
+	writeFile(t, path.Join(ctx, "Conairfile"), "FROM base\nVOLUME /usr/..\n")
+	flagContext = ctx
+	if exit := runBuild([]string{"app"}); exit == 0 {
+		t.Error("build with VOLUME / succeeded")
+	}
+
+	// manifests of pulled or loaded images aren't checked by a build
+	m := image.New("base", image.SourceUnknown)
+	m.Config.Volumes = []string{"/"}
+	if err := m.Write(home); err != nil {
+		t.Fatal(err)
+	}
+	if exit := runRun([]string{"base", "web"}); exit == 0 {
+		t.Error("run of an image with volume / succeeded")
+	}
+	if _, err := os.Stat(path.Join(home, ".#web/etc/os-release")); err != nil {
+		t.Errorf("filesystem of the container was removed: %v", err)
+	}
+}
+
+func TestGcKeepSince(t *testing.T) {
+	setupRoot(t)
+	createBaseImage(t, "base")
+	// snapshots keep the modification time of the base image
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	if err := os.Chtimes(path.Join(home, "base"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := t.TempDir()
+	writeFile(t, path.Join(ctx, "Conairfile"), "FROM base\nENV GREETING=hello\n")
+	flagContext = ctx
+	if exit := runBuild([]string{"app"}); exit != 0 {
+		t.Fatalf("build failed with %d", exit)
+	}
+	fs, err := initStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("app"); err != nil {
+		t.Fatal(err)
+	}
+	if err := image.Remove(home, "app"); err != nil {
+		t.Fatal(err)
+	}
+	layers, _, err := layerRefs(fs, "")
+	if err != nil || len(layers) != 1 {
+		t.Fatalf("expected one layer, got %v %v", layers, err)
+	}
+
+	oldKeep := flagGcKeepSince
+	defer func() { flagGcKeepSince = oldKeep }()
+
+	flagGcKeepSince = "7d"
+	if exit := runGc(nil); exit != 0 {
+		t.Fatalf("gc failed with %d", exit)
+	}
+	if !fs.Exists(layers[0]) {
+		t.Fatal("gc removed a layer created right now")
+	}
+
+	flagGcKeepSince = ""
+	if exit := runGc(nil); exit != 0 {
+		t.Fatalf("gc failed with %d", exit)
+	}
+	if fs.Exists(layers[0]) {
+		t.Error("gc kept an unused layer")
+	}
+}
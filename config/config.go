@@ -0,0 +1,115 @@
+// Package config reads the configuration file of conair, which lists the
+// registries images are pulled from and pushed to.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// Path of the configuration file
+	Path = "/etc/conair/config.json"
+
+	// DefaultRegistry is the registry of references without one, unless
+	// the configuration names another
+	DefaultRegistry = "hub"
+	DefaultHub      = "http://conair.teemow.com/images"
+
+	// DefaultTrustedKeys is the directory of the public keys pulled images
+	// have to be signed with, relative to the configuration file
+	DefaultTrustedKeys = "trusted-keys"
+)
+
+// Config is the configuration file, eg
+//
+//	{
+//	  "defaultRegistry": "local",
+//	  "trustedKeys": "/etc/conair/trusted-keys",
+//	  "registries": {
+//	    "local": "/mnt/images",
+//	    "example": "https://images.example.com"
+//	  }
+//	}
+type Config struct {
+	// DefaultRegistry is used for references without a registry
+	DefaultRegistry string `json:"defaultRegistry,omitempty"`
+	// Registries maps the names used in references to the http(s) URL or
+	// directory of a registry
+	Registries map[string]string `json:"registries,omitempty"`
+	// TrustedKeys is the directory of the public keys which sign images
+	TrustedKeys string `json:"trustedKeys,omitempty"`
+}
+
+// Default returns the configuration used without a configuration file.
+func Default() *Config {
+	return &Config{
+		DefaultRegistry: DefaultRegistry,
+		Registries:      map[string]string{DefaultRegistry: DefaultHub},
+		TrustedKeys:     DefaultTrustedKeys,
+	}
+}
+
+// Read reads a configuration file. A missing file is the default
+// configuration. The hub is always known, unless the file configures its own.
+// A relative TrustedKeys is resolved against the directory of the file.
+func Read(path string) (*Config, error) {
+	c := Default()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		c.TrustedKeys = filepath.Join(filepath.Dir(path), c.TrustedKeys)
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("Couldn't parse %s: %v", path, err)
+	}
+	if c.Registries == nil {
+		c.Registries = map[string]string{}
+	}
+	if _, ok := c.Registries[DefaultRegistry]; !ok {
+		c.Registries[DefaultRegistry] = DefaultHub
+	}
+	if c.DefaultRegistry == "" {
+		c.DefaultRegistry = DefaultRegistry
+	}
+	if c.TrustedKeys == "" {
+		c.TrustedKeys = DefaultTrustedKeys
+	}
+	if !filepath.IsAbs(c.TrustedKeys) {
+		c.TrustedKeys = filepath.Join(filepath.Dir(path), c.TrustedKeys)
+	}
+	if _, ok := c.Registries[c.DefaultRegistry]; !ok {
+		return nil, fmt.Errorf("The default registry %s of %s isn't configured.", c.DefaultRegistry, path)
+	}
+	return c, nil
+}
+
+// Registry returns the location of a registry, or of the default registry for
+// an empty name.
+func (c *Config) Registry(name string) (string, error) {
+	if name == "" {
+		name = c.DefaultRegistry
+	}
+	url, ok := c.Registries[name]
+	if !ok {
+		return "", fmt.Errorf("Unknown registry %s. Please configure it in %s, known are %v.", name, Path, c.Names())
+	}
+	return url, nil
+}
+
+// Names returns the names of all registries.
+func (c *Config) Names() []string {
+	names := []string{}
+	for name := range c.Registries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
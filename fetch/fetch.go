@@ -0,0 +1,196 @@
+// Package fetch downloads files over http(s). Partial downloads are resumed
+// and files are checked against published sha256 checksums.
+package fetch
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ErrNotFound is returned for files the server doesn't have.
+var ErrNotFound = errors.New("Not found")
+
+var sumRegexp = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// IsURL returns whether src is a http(s) URL, not a local path.
+func IsURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// Download fetches src, a http(s) URL or a local path, into the file dest and
+// returns its size. The download is written to dest.part first, which an
+// interrupted download leaves behind: the next Download continues it with a
+// range request. Progress is written to progress unless it's nil.
+func Download(src, dest string, progress io.Writer) (int64, error) {
+	part := dest + ".part"
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	var body io.Reader
+	total := int64(-1)
+	if IsURL(src) {
+		resp, err := get(src, offset)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+				return 0, fmt.Errorf("Couldn't resume %s, the server sent %s.", src, resp.Header.Get("Content-Range"))
+			}
+		case http.StatusRequestedRangeNotSatisfiable:
+			// the part has all of the file, or more if the file changed
+			if resp.Header.Get("Content-Range") == fmt.Sprintf("bytes */%d", offset) {
+				return offset, complete(f, part, dest)
+			}
+			f.Truncate(0)
+			return 0, fmt.Errorf("Couldn't resume %s, it changed. Please try again.", src)
+		default:
+			// the server doesn't do ranges, start over
+			if offset > 0 {
+				if err := f.Truncate(0); err != nil {
+					return 0, err
+				}
+				if offset, err = f.Seek(0, io.SeekStart); err != nil {
+					return 0, err
+				}
+			}
+		}
+		if resp.ContentLength >= 0 {
+			total = offset + resp.ContentLength
+		}
+		body = resp.Body
+	} else {
+		in, err := os.Open(src)
+		if os.IsNotExist(err) {
+			return 0, ErrNotFound
+		}
+		if err != nil {
+			return 0, err
+		}
+		defer in.Close()
+		fi, err := in.Stat()
+		if err != nil {
+			return 0, err
+		}
+		if _, err := in.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		body, total = in, fi.Size()
+	}
+
+	var w io.Writer = f
+	if progress != nil {
+		bar := newBar(progress, src[strings.LastIndex(src, "/")+1:], offset, total)
+		defer bar.finish()
+		w = io.MultiWriter(f, bar)
+	}
+	n, err := io.Copy(w, body)
+	if err != nil {
+		return 0, fmt.Errorf("Download of %s was interrupted, it's continued next time. %v", src, err)
+	}
+	if total >= 0 && offset+n != total {
+		return 0, fmt.Errorf("Download of %s is incomplete, it's continued next time.", src)
+	}
+	return offset + n, complete(f, part, dest)
+}
+
+// get requests src from offset on.
+func get(src string, offset int64) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		return resp, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("Couldn't fetch %s: %s", src, resp.Status)
+}
+
+func complete(f *os.File, part, dest string) error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(part, dest)
+}
+
+// ParseChecksum reads a checksum file in the format of sha256sum and returns
+// the checksum of file, or the only checksum of the file.
+func ParseChecksum(r io.Reader, file string) (string, error) {
+	sums := map[string]string{}
+	first := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		sum := strings.ToLower(fields[0])
+		if !sumRegexp.MatchString(sum) {
+			return "", fmt.Errorf("Invalid checksum %s", fields[0])
+		}
+		if first == "" {
+			first = sum
+		}
+		if len(fields) > 1 {
+			// sha256sum marks binary mode with a *
+			sums[strings.TrimPrefix(fields[1], "*")] = sum
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if sum, ok := sums[file]; ok {
+		return sum, nil
+	}
+	if len(sums) <= 1 && first != "" {
+		return first, nil
+	}
+	return "", fmt.Errorf("No checksum for %s", file)
+}
+
+// Verify checks the sha256 of a file.
+func Verify(path, sum string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if fmt.Sprintf("%x", h.Sum(nil)) != sum {
+		return fmt.Errorf("Checksum of %s doesn't match, the download is corrupt.", path)
+	}
+	return nil
+}
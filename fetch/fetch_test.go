@@ -0,0 +1,214 @@
+package fetch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var content = []byte(strings.Repeat("0123456789", 1000))
+
+// serve serves content with range support and records the Range headers.
+func serve(t *testing.T, ranges *[]string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*ranges = append(*ranges, r.Header.Get("Range"))
+		if r.URL.Path != "/file" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func writePart(t *testing.T, dest string, data []byte) {
+	if err := ioutil.WriteFile(dest+".part", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkFile(t *testing.T, dest string, n int64, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, rerr := ioutil.ReadFile(dest)
+	if rerr != nil || !bytes.Equal(data, content) || n != int64(len(content)) {
+		t.Errorf("unexpected download of %d bytes %v", n, rerr)
+	}
+	if _, err := os.Stat(dest + ".part"); !os.IsNotExist(err) {
+		t.Errorf("part was left: %v", err)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	ranges := []string{}
+	s := serve(t, &ranges)
+	dest := t.TempDir() + "/file"
+
+	progress := &bytes.Buffer{}
+	n, err := Download(s.URL+"/file", dest, progress)
+	checkFile(t, dest, n, err)
+	if ranges[0] != "" {
+		t.Errorf("new download requested range %s", ranges[0])
+	}
+	if !strings.Contains(progress.String(), "100%") {
+		t.Errorf("unexpected progress %q", progress.String())
+	}
+
+	if _, err := Download(s.URL+"/missing", t.TempDir()+"/missing", nil); err != ErrNotFound {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	ranges := []string{}
+	s := serve(t, &ranges)
+	dest := t.TempDir() + "/file"
+
+	writePart(t, dest, content[:1234])
+	n, err := Download(s.URL+"/file", dest, nil)
+	checkFile(t, dest, n, err)
+	if len(ranges) != 1 || ranges[0] != "bytes=1234-" {
+		t.Errorf("unexpected ranges %v", ranges)
+	}
+
+	// a part with all of the file only needs renaming
+	os.Remove(dest)
+	writePart(t, dest, content)
+	n, err = Download(s.URL+"/file", dest, nil)
+	checkFile(t, dest, n, err)
+}
+
+func TestDownloadChanged(t *testing.T) {
+	ranges := []string{}
+	s := serve(t, &ranges)
+	dest := t.TempDir() + "/file"
+
+	// the file got shorter, the part is dropped
+	writePart(t, dest, append(content, 'x'))
+	if _, err := Download(s.URL+"/file", dest, nil); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Fatalf("changed file: %v", err)
+	}
+	if fi, err := os.Stat(dest + ".part"); err != nil || fi.Size() != 0 {
+		t.Errorf("part of a changed file was kept: %v", err)
+	}
+	n, err := Download(s.URL+"/file", dest, nil)
+	checkFile(t, dest, n, err)
+}
+
+func TestDownloadIgnoredRange(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer s.Close()
+	dest := t.TempDir() + "/file"
+
+	// the server sends all of the file, the part is started over
+	writePart(t, dest, []byte("garbage"))
+	n, err := Download(s.URL+"/file", dest, nil)
+	checkFile(t, dest, n, err)
+}
+
+func TestDownloadBadRange(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content)
+	}))
+	defer s.Close()
+	dest := t.TempDir() + "/file"
+
+	writePart(t, dest, content[:10])
+	if _, err := Download(s.URL+"/file", dest, nil); err == nil {
+		t.Fatal("wrong range was appended")
+	}
+	if data, _ := ioutil.ReadFile(dest + ".part"); !bytes.Equal(data, content[:10]) {
+		t.Errorf("part was changed to %d bytes", len(data))
+	}
+}
+
+func TestDownloadInterrupted(t *testing.T) {
+	interrupt := true
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if interrupt {
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Write(content[:100])
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer s.Close()
+	dest := t.TempDir() + "/file"
+
+	if _, err := Download(s.URL+"/file", dest, nil); err == nil {
+		t.Fatal("interrupted download succeeded")
+	}
+	if data, _ := ioutil.ReadFile(dest + ".part"); !bytes.Equal(data, content[:100]) {
+		t.Fatalf("part has %d bytes", len(data))
+	}
+	interrupt = false
+	n, err := Download(s.URL+"/file", dest, nil)
+	checkFile(t, dest, n, err)
+}
+
+func TestDownloadFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/src", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	writePart(t, dir+"/file", content[:500])
+	n, err := Download(dir+"/src", dir+"/file", nil)
+	checkFile(t, dir+"/file", n, err)
+
+	if _, err := Download(dir+"/missing", dir+"/missing", nil); err != ErrNotFound {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	a, b := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	tests := []struct {
+		sums, file, sum string
+	}{
+		{a + "\n", "file.tar", a},
+		{a + "  file.tar\n", "other.tar", a},
+		{a + "  other.tar\n" + b + " *file.tar\n", "file.tar", b},
+		{"\n" + strings.ToUpper(a) + "  file.tar\n\n", "file.tar", a},
+	}
+	for _, test := range tests {
+		sum, err := ParseChecksum(strings.NewReader(test.sums), test.file)
+		if err != nil || sum != test.sum {
+			t.Errorf("ParseChecksum(%q, %s) = %s %v, want %s", test.sums, test.file, sum, err, test.sum)
+		}
+	}
+
+	for _, sums := range []string{"", "abc  file.tar\n", a + "  a.tar\n" + b + "  b.tar\n"} {
+		if sum, err := ParseChecksum(strings.NewReader(sums), "file.tar"); err == nil {
+			t.Errorf("ParseChecksum(%q) = %s, want an error", sums, sum)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	path := t.TempDir() + "/file"
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(path, fmt.Sprintf("%x", sha256.Sum256(content))); err != nil {
+		t.Error(err)
+	}
+	if err := Verify(path, strings.Repeat("0", 64)); err == nil {
+		t.Error("wrong checksum was accepted")
+	}
+	if err := Verify(path+".missing", strings.Repeat("0", 64)); err == nil {
+		t.Error("missing file was verified")
+	}
+}
@@ -0,0 +1,61 @@
+package fetch
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/giantswarm/conair/fileutil"
+)
+
+const (
+	barWidth = 30
+	// redraw the bar at most this often
+	barInterval = 200 * time.Millisecond
+)
+
+// bar draws the progress of a download on a terminal line.
+type bar struct {
+	w     io.Writer
+	name  string
+	done  int64
+	total int64
+	drawn time.Time
+}
+
+// newBar starts a bar for a download of total bytes, which is unknown if
+// negative. done bytes were downloaded before.
+func newBar(w io.Writer, name string, done, total int64) *bar {
+	b := &bar{w: w, name: name, done: done, total: total}
+	b.draw()
+	return b
+}
+
+func (b *bar) Write(p []byte) (int, error) {
+	b.done += int64(len(p))
+	if time.Since(b.drawn) >= barInterval {
+		b.draw()
+	}
+	return len(p), nil
+}
+
+func (b *bar) draw() {
+	b.drawn = time.Now()
+	if b.total <= 0 {
+		fmt.Fprintf(b.w, "\r%s %s", b.name, fileutil.FormatSize(b.done))
+		return
+	}
+	filled := int(b.done * barWidth / b.total)
+	if filled > barWidth {
+		filled = barWidth
+	}
+	fmt.Fprintf(b.w, "\r%s [%s%s] %3d%% %s/%s", b.name, strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled),
+		b.done*100/b.total, fileutil.FormatSize(b.done), fileutil.FormatSize(b.total))
+}
+
+// finish draws the final state and ends the line.
+func (b *bar) finish() {
+	b.draw()
+	fmt.Fprintln(b.w)
+}
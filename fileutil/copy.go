@@ -0,0 +1,352 @@
+package fileutil
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// FICLONE shares the extents of one file with another on filesystems with
+// reflink support (btrfs, xfs).
+const ficlone = 0x40049409
+
+// AT_FDCWD and AT_SYMLINK_NOFOLLOW of utimensat
+const (
+	atFdcwd           = -100
+	atSymlinkNofollow = 0x100
+)
+
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// CopyTree copies the directory tree src to dst, which must not exist yet.
+// Regular files are reflinked if the filesystem supports it. Ownership,
+// permissions, timestamps, extended attributes (and with them ACLs), device
+// nodes, fifos, symlinks and hardlinks are preserved.
+func CopyTree(src, dst string) error {
+	links := map[inode]string{}
+	dirs := []string{}
+
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("Can't stat %s", path)
+		}
+
+		// recreate hardlinks instead of copying the same content twice
+		if !fi.IsDir() && st.Nlink > 1 {
+			key := inode{uint64(st.Dev), st.Ino}
+			if first, ok := links[key]; ok {
+				return os.Link(first, target)
+			}
+			links[key] = target
+		}
+
+		switch {
+		case fi.IsDir():
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, path)
+		case fi.Mode().IsRegular():
+			if err := CopyFile(path, target); err != nil {
+				return err
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			if err := os.Lchown(target, int(st.Uid), int(st.Gid)); err != nil {
+				return err
+			}
+			return copyTimes(target, fi)
+		case fi.Mode()&(os.ModeDevice|os.ModeNamedPipe) != 0:
+			if err := syscall.Mknod(target, st.Mode, int(st.Rdev)); err != nil {
+				return err
+			}
+		default:
+			// sockets belong to a running process, there is nothing to copy
+			return nil
+		}
+
+		return CopyMetadata(path, target, fi)
+	})
+	if err != nil {
+		return err
+	}
+
+	// directory timestamps change while their content is copied
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, err := filepath.Rel(src, dirs[i])
+		if err != nil {
+			return err
+		}
+		fi, err := os.Lstat(dirs[i])
+		if err != nil {
+			return err
+		}
+		if err := copyTimes(filepath.Join(dst, rel), fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CopyFile copies the content of a regular file. It tries to reflink the file
+// first and falls back to copying the bytes.
+func CopyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd()); errno != 0 {
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// CopyMetadata applies ownership, permissions, extended attributes and
+// timestamps of src (described by fi) to dst.
+func CopyMetadata(src, dst string, fi os.FileInfo) error {
+	st := fi.Sys().(*syscall.Stat_t)
+
+	if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+		return err
+	}
+	// chown clears setuid bits, so the mode is set afterwards
+	if err := os.Chmod(dst, fi.Mode()&os.ModePerm|fi.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	if err := copyXattrs(src, dst); err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return nil
+	}
+	return copyTimes(dst, fi)
+}
+
+// copyTimes sets the timestamps of dst, of the link itself if it's a symlink.
+func copyTimes(dst string, fi os.FileInfo) error {
+	st := fi.Sys().(*syscall.Stat_t)
+	ts := [2]syscall.Timespec{st.Atim, st.Mtim}
+
+	p, err := syscall.BytePtrFromString(dst)
+	if err != nil {
+		return err
+	}
+	// syscall.UtimesNano follows symlinks
+	cwd := atFdcwd
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(cwd), uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&ts[0])), atSymlinkNofollow, 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "utimensat", Path: dst, Err: errno}
+	}
+	return nil
+}
+
+func copyXattrs(src, dst string) error {
+	xattrs, err := Xattrs(src)
+	if err != nil {
+		return err
+	}
+	for name, value := range xattrs {
+		if err := setxattr(dst, name, value); err != nil {
+			return fmt.Errorf("Can't set xattr %s on %s: %v", name, dst, err)
+		}
+	}
+	return nil
+}
+
+// Xattrs returns the extended attributes of a file. Filesystems without xattr
+// support have none.
+func Xattrs(path string) (map[string][]byte, error) {
+	xattrs := map[string][]byte{}
+	size, err := syscall.Listxattr(path, nil)
+	if err == syscall.ENOTSUP || size == 0 {
+		return xattrs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range splitNull(buf[:size]) {
+		vsize, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, vsize)
+		if vsize > 0 {
+			if vsize, err = syscall.Getxattr(path, name, value); err != nil {
+				return nil, err
+			}
+		}
+		xattrs[name] = value[:vsize]
+	}
+	return xattrs, nil
+}
+
+// setxattr is syscall.Setxattr, which can't set empty values.
+func setxattr(path, name string, value []byte) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+
+	var v unsafe.Pointer
+	if len(value) > 0 {
+		v = unsafe.Pointer(&value[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)),
+		uintptr(v), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func splitNull(buf []byte) []string {
+	names := []string{}
+	start := 0
+	for i, b := range buf {
+		if b == 0 {
+			if i > start {
+				names = append(names, string(buf[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	return names
+}
+
+// CopyInto copies src to dst in the directory tree root, overwriting existing
+// files. If src is a directory, its content is merged into dst. Symlinks in
+// root are resolved with SecureJoin, so nothing is written outside of root.
+// Unlike CopyTree, all copied files are owned by uid and gid, only permissions
+// and timestamps are preserved. Files for which skip returns true aren't
+// copied, skip may be nil.
+func CopyInto(src, root, dst string, uid, gid int, skip func(path string) bool) error {
+	dirs := map[string]os.FileInfo{}
+
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if skip != nil && skip(path) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		// existing directories are merged, even if they are symlinks
+		var target string
+		if fi.IsDir() {
+			target, err = SecureJoin(root, filepath.Join(dst, rel))
+		} else {
+			target, err = SecureJoin(root, filepath.Dir(filepath.Join(dst, rel)))
+			target = filepath.Join(target, filepath.Base(filepath.Join(dst, rel)))
+		}
+		if err != nil {
+			return err
+		}
+
+		if existing, err := os.Lstat(target); err == nil && !(fi.IsDir() && existing.IsDir()) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+		// parents may have been skipped
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		switch {
+		case fi.IsDir():
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			dirs[target] = fi
+		case fi.Mode().IsRegular():
+			if err := CopyFile(path, target); err != nil {
+				return err
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			if err := os.Lchown(target, uid, gid); err != nil {
+				return err
+			}
+			return copyTimes(target, fi)
+		default:
+			return fmt.Errorf("Can't copy %s, only files, directories and symlinks are supported", path)
+		}
+
+		if err := os.Chown(target, uid, gid); err != nil {
+			return err
+		}
+		if err := os.Chmod(target, fi.Mode()&os.ModePerm|fi.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		return copyTimes(target, fi)
+	})
+	if err != nil {
+		return err
+	}
+
+	for dir, fi := range dirs {
+		if err := copyTimes(dir, fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
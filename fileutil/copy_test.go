@@ -0,0 +1,147 @@
+package fileutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCopyFile(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("conair"), 100000)
+	if err := ioutil.WriteFile(filepath.Join(dir, "src"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// reflinked where the filesystem supports it, copied otherwise
+	if err := CopyFile(filepath.Join(dir, "src"), filepath.Join(dir, "dst")); err != nil {
+		t.Fatal(err)
+	}
+	copied, err := ioutil.ReadFile(filepath.Join(dir, "dst"))
+	if err != nil || !bytes.Equal(copied, data) {
+		t.Errorf("copy differs: %d bytes %v", len(copied), err)
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	dst := filepath.Join(t.TempDir(), "dst")
+	old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	mkdir := func(name string) {
+		if err := os.MkdirAll(filepath.Join(src, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkdir("dir/sub")
+	if err := ioutil.WriteFile(filepath.Join(src, "dir/file"), []byte("content"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "dir/file"), filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "setuid"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "setuid"), 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/file", filepath.Join(src, "symlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(src, "fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	xattrs := setxattr(filepath.Join(src, "dir/file"), "user.conair", []byte("value")) == nil
+	device := syscall.Mknod(filepath.Join(src, "null"), syscall.S_IFCHR|0666, 1<<8|3) == nil
+	owner := os.Lchown(filepath.Join(src, "dir/file"), 1234, 5678) == nil
+	if owner {
+		os.Lchown(filepath.Join(src, "symlink"), 1234, 5678)
+	}
+	for _, name := range []string{"symlink", "dir/file", "dir/sub", "dir", ""} {
+		if err := lutimes(filepath.Join(src, name), old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := CopyTree(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	lstat := func(name string) (os.FileInfo, *syscall.Stat_t) {
+		fi, err := os.Lstat(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi, fi.Sys().(*syscall.Stat_t)
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(dst, "dir/file")); err != nil || string(data) != "content" {
+		t.Errorf("unexpected content %q %v", data, err)
+	}
+	file, fileSt := lstat("dir/file")
+	_, linkSt := lstat("link")
+	if fileSt.Ino != linkSt.Ino || fileSt.Nlink != 2 {
+		t.Error("hardlink wasn't preserved")
+	}
+	if file.Mode() != 0640 {
+		t.Errorf("file has mode %v", file.Mode())
+	}
+	if fi, _ := lstat("setuid"); fi.Mode() != 0755|os.ModeSetuid {
+		t.Errorf("setuid file has mode %v", fi.Mode())
+	}
+	if fi, _ := lstat("fifo"); fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("fifo has mode %v", fi.Mode())
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "symlink")); err != nil || link != "dir/file" {
+		t.Errorf("unexpected symlink %s %v", link, err)
+	}
+	for _, name := range []string{"symlink", "dir/file", "dir/sub", "dir", ""} {
+		if fi, _ := lstat(name); !fi.ModTime().Equal(old) {
+			t.Errorf("%s has modification time %v, want %v", name, fi.ModTime(), old)
+		}
+	}
+	if owner {
+		for _, name := range []string{"dir/file", "symlink"} {
+			if _, st := lstat(name); st.Uid != 1234 || st.Gid != 5678 {
+				t.Errorf("%s is owned by %d:%d", name, st.Uid, st.Gid)
+			}
+		}
+	}
+	if xattrs {
+		if x, err := Xattrs(filepath.Join(dst, "dir/file")); err != nil || string(x["user.conair"]) != "value" {
+			t.Errorf("xattrs weren't copied: %v %v", x, err)
+		}
+	}
+	if device {
+		if fi, st := lstat("null"); fi.Mode()&os.ModeCharDevice == 0 || st.Rdev != 1<<8|3 {
+			t.Errorf("device node has mode %v and device %x", fi.Mode(), st.Rdev)
+		}
+	}
+
+	if err := CopyTree(src, dst); err == nil {
+		t.Error("copy into an existing directory succeeded")
+	}
+}
+
+func lutimes(path string, t time.Time) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	st := *fi.Sys().(*syscall.Stat_t)
+	st.Atim = syscall.NsecToTimespec(t.UnixNano())
+	st.Mtim = st.Atim
+	return copyTimes(path, statInfo{fi, &st})
+}
+
+// statInfo replaces the stat of a FileInfo.
+type statInfo struct {
+	os.FileInfo
+	st *syscall.Stat_t
+}
+
+func (fi statInfo) Sys() interface{} { return fi.st }
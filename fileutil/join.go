@@ -0,0 +1,71 @@
+package fileutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maximum number of symlinks followed by SecureJoin, like the kernel
+const maxSymlinks = 40
+
+// SecureJoin joins path to root like filepath.Join, but resolves symlinks as if
+// root was the root directory. The result never points outside of root, even
+// if the tree under root contains absolute symlinks or "..".
+func SecureJoin(root, path string) (string, error) {
+	root = filepath.Clean(root)
+	resolved := ""
+	rest := filepath.ToSlash(path)
+	links := 0
+
+	for rest != "" {
+		var name string
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			name, rest = rest[:i], rest[i+1:]
+		} else {
+			name, rest = rest, ""
+		}
+
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			if resolved == "." || resolved == "/" {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := resolved + "/" + name
+		fi, err := os.Lstat(root + next)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// nothing to resolve below a missing entry
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("Too many levels of symbolic links in %s", path)
+		}
+		link, err := os.Readlink(root + next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			resolved = ""
+		}
+		rest = link + "/" + rest
+	}
+
+	return root + filepath.Clean("/"+resolved), nil
+}
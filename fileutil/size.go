@@ -0,0 +1,38 @@
+package fileutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Size returns the apparent size of all files below dir. Data shared with
+// other trees (reflinks, snapshots) is counted in full.
+func Size(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// FormatSize formats a number of bytes for humans, eg "1.5 MB".
+func FormatSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d %s", size, units[0])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/giantswarm/conair/fileutil"
+	"github.com/giantswarm/conair/image"
+	"github.com/giantswarm/conair/layer"
+	"github.com/giantswarm/conair/storage"
+)
+
+var (
+	flagGcDryRun    bool
+	flagGcKeepSince string
+	cmdGc           = &Command{
+		Name:    "gc",
+		Summary: "Remove layers no image or container uses",
+		Usage:   "[-dry-run] [-keep-since=DURATION]",
+		Run:     runGc,
+		Description: `Remove the layers of the build cache which no image or container uses
+
+Layers are used if an image was built from them or a container runs such an
+image. Layers created within -keep-since (eg 12h or 7d) are kept,
+so recent builds stay cached. -dry-run only prints what would be removed.
+
+The unfinished layers of builds which were killed are removed as well.
+
+conair gc -keep-since=7d
+`,
+	}
+)
+
+func init() {
+	cmdGc.Flags.BoolVar(&flagGcDryRun, "dry-run", false, "Only print the layers which would be removed")
+	cmdGc.Flags.StringVar(&flagGcKeepSince, "keep-since", "", "Keep layers created within this duration, eg 12h or 7d")
+}
+
+func runGc(args []string) (exit int) {
+	keepSince, err := parseAge(flagGcKeepSince)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't parse -keep-since.", err)
+		return 1
+	}
+
+	fs, err := initStorage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't populate filesystem for conair.", err)
+		return 1
+	}
+
+	layers, refs, err := layerRefs(fs, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't find the layers in use.", err)
+		return 1
+	}
+
+	// unfinished layers of killed builds are never used
+	volumes, err := fs.List()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't list volumes.", err)
+		return 1
+	}
+	stale := []string{}
+	for _, vol := range volumes {
+		if layer.IsStale(vol) {
+			stale = append(stale, vol)
+		}
+	}
+
+	var (
+		removed int
+		freed   int64
+	)
+	for _, l := range append(stale, layers...) {
+		if len(refs[l]) > 0 {
+			continue
+		}
+		created, err := layer.Created(home, l)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Couldn't find creation time of layer %s.", l), err)
+			return 1
+		}
+		if time.Since(created) < keepSince && !layer.IsStale(l) {
+			continue
+		}
+
+		size, err := fileutil.Size(fmt.Sprintf("%s/%s", home, l))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Couldn't compute size of layer %s.", l), err)
+			return 1
+		}
+		if !flagGcDryRun {
+			if err := fs.Remove(l); err != nil {
+				fmt.Fprintln(os.Stderr, fmt.Sprintf("Couldn't remove layer %s.", l), err)
+				return 1
+			}
+			layer.Forget(home, l)
+		}
+		fmt.Println(l, fileutil.FormatSize(size))
+		removed++
+		freed += size
+	}
+
+	if flagGcDryRun {
+		fmt.Printf("Would remove %d layers, %s.\n", removed, fileutil.FormatSize(freed))
+	} else {
+		fmt.Printf("Removed %d layers, %s.\n", removed, fileutil.FormatSize(freed))
+	}
+	return 0
+}
+
+// layerRefs returns all layers and the images and containers using each of
+// them. A volume uses the layers it was snapshotted from, directly or through
+// its parents, and the layers its manifest lists. The volume exclude (eg an
+// image which is about to be removed) doesn't count.
+func layerRefs(fs storage.Driver, exclude string) ([]string, map[string][]string, error) {
+	volumes, err := fs.List()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	layers := []string{}
+	refs := map[string][]string{}
+	use := func(l, vol string) {
+		for _, ref := range refs[l] {
+			if ref == vol {
+				return
+			}
+		}
+		refs[l] = append(refs[l], vol)
+	}
+
+	for _, vol := range volumes {
+		if layer.IsLayer(vol) {
+			layers = append(layers, vol)
+			continue
+		}
+		if vol == exclude {
+			continue
+		}
+
+		// containers reach the layers through their image
+		seen := map[string]bool{vol: true}
+		for current := vol; ; {
+			uuid, err := fs.GetSubvolumeParentUuid(current)
+			if err != nil {
+				return nil, nil, err
+			}
+			parent, err := fs.GetLayerByUuid(uuid)
+			if err != nil || seen[parent] {
+				break
+			}
+			if layer.IsLayer(parent) {
+				use(parent, vol)
+			}
+			seen[parent] = true
+			current = parent
+		}
+	}
+
+	manifests, err := image.List(home)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, m := range manifests {
+		if m.Name == exclude || !fs.Exists(m.Name) {
+			continue
+		}
+		for _, l := range m.Layers {
+			use(".cnr-"+l.Hash, m.Name)
+		}
+	}
+
+	sort.Strings(layers)
+	return layers, refs, nil
+}
+
+// parseAge parses a duration like time.ParseDuration, with days (7d) in
+// addition. An empty string is no duration.
+func parseAge(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,150 @@
+// Package hub reads and writes the files of an image hub. A hub is a http(s)
+// URL, which has to accept PUT requests to push images, or a directory, eg a
+// mounted network share.
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/giantswarm/conair/fetch"
+)
+
+// ErrNotFound is returned for files the hub doesn't have.
+var ErrNotFound = errors.New("Not found on hub")
+
+// client requests the documents of a hub, which are small, so a stalled hub
+// fails instead of hanging. Downloads and uploads take as long as they take.
+var client = &http.Client{Timeout: time.Minute}
+
+type Hub struct {
+	url string
+}
+
+func New(url string) *Hub {
+	return &Hub{url: strings.TrimSuffix(url, "/")}
+}
+
+func (h *Hub) String() string {
+	return h.url
+}
+
+func (h *Hub) isHTTP() bool {
+	return fetch.IsURL(h.url)
+}
+
+// path returns the location of a file, which is a slash separated path
+// relative to the hub.
+func (h *Hub) path(name string) string {
+	if h.isHTTP() {
+		return fmt.Sprintf("%s/%s", h.url, name)
+	}
+	return filepath.Join(h.url, filepath.FromSlash(name))
+}
+
+// Get opens a file of the hub.
+func (h *Hub) Get(name string) (io.ReadCloser, error) {
+	if !h.isHTTP() {
+		f, err := os.Open(h.path(name))
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return f, err
+	}
+
+	resp, err := client.Get(h.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Couldn't get %s: %s", h.path(name), resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// Download fetches a file of the hub into dest. Interrupted downloads are
+// continued by the next Download of the same dest.
+func (h *Hub) Download(name, dest string, progress io.Writer) (int64, error) {
+	n, err := fetch.Download(h.path(name), dest, progress)
+	if err == fetch.ErrNotFound {
+		return 0, ErrNotFound
+	}
+	return n, err
+}
+
+// Exists returns whether the hub has a file.
+func (h *Hub) Exists(name string) (bool, error) {
+	if !h.isHTTP() {
+		_, err := os.Stat(h.path(name))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	resp, err := client.Head(h.path(name))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("Couldn't check %s: %s", h.path(name), resp.Status)
+}
+
+// Put writes a file of size bytes to the hub. Files appear complete or not at
+// all, so pulls running at the same time don't read half of a file.
+func (h *Hub) Put(name string, r io.Reader, size int64) error {
+	if !h.isHTTP() {
+		path := h.path(name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		tmp := fmt.Sprintf("%s.tmp-%d", path, os.Getpid())
+		f, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+		if err != nil {
+			os.Remove(tmp)
+		}
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, h.path(name), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Couldn't put %s: %s", h.path(name), resp.Status)
+	}
+	return nil
+}
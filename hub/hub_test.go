@@ -0,0 +1,78 @@
+package hub
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGet(t *testing.T) {
+	stall := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a/index.json":
+			w.Write([]byte("{}"))
+		case "/stalled":
+			<-stall
+		case "/error":
+			http.Error(w, "broken", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+	defer close(stall)
+	timeout := client.Timeout
+	client.Timeout = 100 * time.Millisecond
+	defer func() { client.Timeout = timeout }()
+
+	h := New(s.URL + "/")
+	rd, err := h.Get("a/index.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(rd)
+	rd.Close()
+	if string(data) != "{}" {
+		t.Errorf("unexpected file %q", data)
+	}
+	if _, err := h.Get("missing"); err != ErrNotFound {
+		t.Errorf("missing file: %v", err)
+	}
+	if _, err := h.Get("error"); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("server error: %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := h.Get("stalled")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("stalled hub returned a file")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get hangs on a stalled hub")
+	}
+}
+
+func TestDir(t *testing.T) {
+	h := New(t.TempDir())
+	if err := h.Put("a/b", strings.NewReader("data"), 4); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := h.Exists("a/b"); err != nil || !ok {
+		t.Errorf("put file doesn't exist: %v", err)
+	}
+	if ok, err := h.Exists("a/c"); err != nil || ok {
+		t.Errorf("missing file exists: %v", err)
+	}
+	if _, err := h.Get("a/c"); err != ErrNotFound {
+		t.Errorf("missing file: %v", err)
+	}
+}
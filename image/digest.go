@@ -0,0 +1,84 @@
+package image
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ComputeDigest returns a sha256 over a root filesystem: the names, types,
+// permissions, ownership, symlink targets, device numbers and contents of all
+// files. Timestamps are left out, so the same files always have the same
+// digest, no matter when or where they were created.
+func ComputeDigest(dir string) (string, error) {
+	h := sha256.New()
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("Can't stat %s", path)
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00%d:%d\x00", rel, fi.Mode(), st.Uid, st.Gid)
+
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			io.WriteString(h, link)
+		case fi.Mode()&os.ModeDevice != 0:
+			fmt.Fprintf(h, "%d", st.Rdev)
+		case fi.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fmt.Fprintf(h, "%d\x00", fi.Size())
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+		io.WriteString(h, "\x00")
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
+// Digest returns the digest of an image. If the image has none yet, eg
+// because it was created by an older conair, it's computed and recorded in
+// the manifest.
+func Digest(home, name string) (string, error) {
+	m, err := Read(home, name)
+	if os.IsNotExist(err) {
+		m, err = New(name, SourceUnknown), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if m.Digest != "" {
+		return m.Digest, nil
+	}
+
+	if m.Digest, err = ComputeDigest(filepath.Join(home, name)); err != nil {
+		return "", fmt.Errorf("Couldn't compute digest of %s. %v", name, err)
+	}
+	if err := m.Write(home); err != nil {
+		return "", err
+	}
+	return m.Digest, nil
+}
@@ -0,0 +1,209 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Version of the manifest format. Manifests of newer versions are
+	// rejected, older ones are upgraded when they are read.
+	Version = 1
+
+	// directory below home holding the manifests
+	metaDir = ".cnr-meta"
+)
+
+// How an image was created.
+const (
+	SourceBuild     = "build"
+	SourceCommit    = "commit"
+	SourcePull      = "pull"
+	SourceBootstrap = "bootstrap"
+	SourceLoad      = "load"
+	// images which existed before they got a manifest
+	SourceUnknown = "unknown"
+)
+
+// Manifest describes an image. It's stored next to the image subvolume.
+type Manifest struct {
+	Version int       `json:"version"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Source  string    `json:"source"`
+	// Parent is the image this one is based on
+	Parent string `json:"parent,omitempty"`
+	// Origin is the location a pulled image was downloaded from, or the
+	// archive a loaded image was read from
+	Origin string `json:"origin,omitempty"`
+	// Digest identifies the content of the image, builds on top of it are
+	// cached by it. Pulled, bootstrapped and committed images have a sha256
+	// over their files, built images the hash of their last layer.
+	Digest string `json:"digest,omitempty"`
+	// Conairfile holds the build instructions of built images
+	Conairfile string  `json:"conairfile,omitempty"`
+	Layers     []Layer `json:"layers,omitempty"`
+	Config     Config  `json:"config"`
+}
+
+// Layer is a build step of an image.
+type Layer struct {
+	Hash        string `json:"hash"`
+	Instruction string `json:"instruction"`
+}
+
+// Config is the runtime configuration of an image.
+type Config struct {
+	Env     []string `json:"env,omitempty"`
+	Workdir string   `json:"workdir,omitempty"`
+	User    string   `json:"user,omitempty"`
+	Shell   []string `json:"shell,omitempty"`
+	// ExposedPorts are port/protocol pairs, eg 80/tcp
+	ExposedPorts []string          `json:"exposedPorts,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	// Volumes are paths which are kept out of the container's filesystem
+	Volumes []string `json:"volumes,omitempty"`
+	// Entrypoint and Cmd are run when the container doesn't boot
+	Entrypoint []string `json:"entrypoint,omitempty"`
+	Cmd        []string `json:"cmd,omitempty"`
+}
+
+// CleanVolume returns the clean path of a VOLUME. Volumes are absolute paths
+// below the root, the root itself would replace all of the container.
+func CleanVolume(volume string) (string, error) {
+	if !filepath.IsAbs(volume) {
+		return "", fmt.Errorf("VOLUME %s isn't an absolute path", volume)
+	}
+	clean := filepath.Clean(volume)
+	if clean == "/" {
+		return "", fmt.Errorf("VOLUME %s is the root of the image", volume)
+	}
+	return clean, nil
+}
+
+// Validate checks a configuration read from an archive or a registry.
+func (c Config) Validate() error {
+	for _, volume := range c.Volumes {
+		if _, err := CleanVolume(volume); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Command returns the command line of containers which don't boot.
+func (c Config) Command() []string {
+	return append(append([]string{}, c.Entrypoint...), c.Cmd...)
+}
+
+// New returns a manifest for an image created now.
+func New(name, source string) *Manifest {
+	return &Manifest{
+		Version: Version,
+		Name:    name,
+		Created: time.Now().UTC(),
+		Source:  source,
+	}
+}
+
+func path(home, name string) string {
+	return filepath.Join(home, metaDir, name+".json")
+}
+
+// Read returns the manifest of an image. Like os.Open, the error satisfies
+// os.IsNotExist if the image has no manifest.
+func Read(home, name string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path(home, name))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("Couldn't parse manifest of %s. %v", name, err)
+	}
+	if m.Version > Version {
+		return nil, fmt.Errorf("Manifest of %s has version %d, this conair supports up to %d", name, m.Version, Version)
+	}
+	m.Version = Version
+	return m, nil
+}
+
+// Write stores the manifest. The file is replaced atomically, so readers never
+// see a partial manifest.
+func (m *Manifest) Write(home string) error {
+	dir := filepath.Join(home, metaDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path(home, m.Name))
+}
+
+// Remove deletes the manifest of an image. Images without manifest are
+// ignored.
+func Remove(home, name string) error {
+	if err := os.Remove(path(home, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns the manifests of all images, sorted by name.
+func List(home string) ([]*Manifest, error) {
+	files, err := ioutil.ReadDir(filepath.Join(home, metaDir))
+	if os.IsNotExist(err) {
+		return []*Manifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := []*Manifest{}
+	for _, fi := range files {
+		if strings.HasPrefix(fi.Name(), ".") || !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		m, err := Read(home, strings.TrimSuffix(fi.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, m)
+	}
+	sort.Sort(byName(manifests))
+	return manifests, nil
+}
+
+type byName []*Manifest
+
+func (m byName) Len() int           { return len(m) }
+func (m byName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byName) Less(i, j int) bool { return m[i].Name < m[j].Name }
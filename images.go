@@ -1,33 +1,86 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
 	"strings"
+	"time"
+
+	"github.com/giantswarm/conair/image"
 )
 
 var cmdImages = &Command{
-	Name:        "images",
-	Description: "List all available conair images",
-	Summary:     "List all available conair images",
-	Run:         runImages,
+	Name:    "images",
+	Summary: "List all available conair images",
+	Usage:   "[<image>]",
+	Run:     runImages,
+	Description: `List all available conair images
+
+With an image name, the manifest of the image is printed. It records how the
+image was created, its parent, layers and configuration.
+`,
 }
 
 func runImages(args []string) (exit int) {
+	if len(args) > 0 {
+		m, err := image.Read(home, args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Couldn't read manifest of image %s.", args[0]), err)
+			return 1
+		}
+		data, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't print manifest.", err)
+			return 1
+		}
+		fmt.Println(string(data))
+		return 0
+	}
 
-	path, err := exec.LookPath("machinectl")
+	fs, err := initStorage()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "machinectl not found.")
+		fmt.Fprintln(os.Stderr, "Couldn't populate filesystem for conair.", err)
+		return 1
 	}
 
-	args = append([]string{"list-images"}, args...)
+	manifests, err := image.List(home)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't list images.", err)
+		return 1
+	}
+	byName := map[string]*image.Manifest{}
+	for _, m := range manifests {
+		byName[m.Name] = m
+	}
 
-	output, err := exec.Command(path, args...).CombinedOutput()
+	// images are the volumes of the storage driver, manifests of images
+	// removed without conair are left out. Hidden volumes are containers,
+	// layers and snapshots.
+	volumes, err := fs.List()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "machinectl failed: machinctl %v: %s (%s)", strings.Join(args, " "), output, err)
+		fmt.Fprintln(os.Stderr, "Couldn't list images.", err)
+		return 1
+	}
+
+	fmt.Fprintln(out, "NAME\tSOURCE\tPARENT\tLAYERS\tCREATED")
+	for _, name := range volumes {
+		if strings.HasPrefix(name, ".") || !fs.Exists(name) {
+			continue
+		}
+		m, ok := byName[name]
+		if !ok {
+			// images of pacstrap or from before manifests have none
+			fmt.Fprintf(out, "%s\t-\t-\t-\t-\n", name)
+			continue
+		}
+		parent := m.Parent
+		if parent == "" {
+			parent = "-"
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\t%d\t%s\n", m.Name, m.Source, parent, len(m.Layers), m.Created.Local().Format(time.RFC3339))
 	}
-	fmt.Fprintln(os.Stdout, string(output[:]))
+	out.Flush()
 
-	return
+	return 0
 }
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/giantswarm/conair/btrfs"
 	"github.com/giantswarm/conair/networkd"
 	"github.com/giantswarm/conair/nspawn"
 )
@@ -31,7 +30,7 @@ func runInit(args []string) (exit int) {
 		return 1
 	}
 
-	_, err = btrfs.Init(home)
+	_, err = initStorage()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Couldn't populate filesystem structure for conair.", err)
 		return 1
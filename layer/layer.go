@@ -1,14 +1,19 @@
 package layer
 
 import (
-	"bufio"
 	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/giantswarm/conair/btrfs"
+	"github.com/giantswarm/conair/storage"
 )
 
 type layer struct {
@@ -19,29 +24,38 @@ type layer struct {
 	ParentPath string
 	Path       string
 	Exists     bool
-	fs         *btrfs.Driver
+	Keys       []string
+	fs         storage.Driver
+	// TmpPath is the volume the layer is built in. It only gets the name of
+	// the layer when Commit marks it complete, so an interrupted build step
+	// never becomes a cache hit.
+	TmpPath string
 }
 
-func Create(fs *btrfs.Driver, verb, payload, parentPath string) (*layer, error) {
+// Create returns the layer for a build step on top of parentPath. The parentId
+// identifies the content of the parent: the hash of the parent layer or the
+// digest of the base image. The keys are further inputs of the step (eg its
+// environment) and take part in the cache key. As nothing host specific goes
+// into the hash, the same build produces the same layers on every host.
+func Create(fs storage.Driver, verb, payload, parentPath, parentId string, keys ...string) (*layer, error) {
 	l := &layer{
 		Verb:       verb,
 		Payload:    payload,
+		ParentId:   parentId,
 		ParentPath: parentPath,
+		Keys:       keys,
 		Exists:     false,
 		fs:         fs,
 	}
-	var err error
-	l.ParentId, err = l.getParentId()
-	if err != nil {
-		return nil, err
-	}
 
+	var err error
 	l.Hash, err = l.createHash()
 	if err != nil {
 		return nil, err
 	}
 
 	l.Path = fmt.Sprintf(".cnr-%s", l.Hash)
+	l.TmpPath = TempPath(l.Hash)
 	if err = l.createLayer(); err != nil {
 		return nil, err
 	}
@@ -49,70 +63,126 @@ func Create(fs *btrfs.Driver, verb, payload, parentPath string) (*layer, error)
 	return l, nil
 }
 
-func (l *layer) getParentId() (string, error) {
-	var (
-		parentId string
-		err      error
-	)
-	if !strings.HasPrefix(l.ParentPath, ".cnr-") {
-		parentId, err = l.fs.GetSubvolumeParentUuid(l.ParentPath)
-	} else {
-		parentId, err = l.fs.GetSubvolumeUuid(l.ParentPath)
-	}
-	if err != nil {
-		return "", err
-	}
-
-	return parentId, nil
-}
-
 func (l *layer) createHash() (string, error) {
 	h := sha1.New()
 
-	io.WriteString(h, l.ParentId)
-	io.WriteString(h, l.Verb)
-	io.WriteString(h, l.Payload)
-
-	if l.Verb == "ADD" {
-		p := strings.Split(l.Payload, " ")
-		sourceFile := p[0]
-
-		f, err := os.Open(sourceFile)
-		if err != nil {
-			return "", err
-		}
-		defer f.Close()
-		reader := bufio.NewReader(f)
-
-		_, err = io.Copy(h, reader)
-		if err != nil {
-			return "", err
-		}
+	// fields are terminated, so distinct steps can't concatenate to the
+	// same input
+	for _, field := range append([]string{l.ParentId, l.Verb, l.Payload}, l.Keys...) {
+		io.WriteString(h, field)
+		h.Write([]byte{0})
 	}
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
 func (l *layer) createLayer() error {
-	if l.fs.Exists(l.Path) {
-		if l.Verb == "RUN_NOCACHE" {
-			if err := l.Remove(); err != nil {
-				return fmt.Errorf("Couldn't remove existing layer. %v", err)
-			}
-		} else {
-			l.Exists = true
-			return nil
-		}
+	// RUN_NOCACHE layers are replaced by Commit
+	if l.fs.Exists(l.Path) && l.Verb != "RUN_NOCACHE" {
+		l.Exists = true
+		return nil
 	}
 
-	if err := l.fs.Snapshot(l.ParentPath, l.Path, false); err != nil {
+	if err := l.fs.Snapshot(l.ParentPath, l.TmpPath, false); err != nil {
 		return fmt.Errorf("Couldn't create filesystem for layer. %v", err)
 	}
 	return nil
 }
 
+// Commit marks the layer complete after its build step succeeded. If a
+// parallel build completed the same layer in the meantime, that one is kept.
+func (l *layer) Commit() error {
+	if l.fs.Exists(l.Path) {
+		if l.Verb != "RUN_NOCACHE" {
+			return l.Remove()
+		}
+		if err := l.fs.Remove(l.Path); err != nil {
+			return fmt.Errorf("Couldn't remove existing layer. %v", err)
+		}
+	}
+	if err := l.fs.Rename(l.TmpPath, l.Path); err != nil {
+		return fmt.Errorf("Couldn't complete layer. %v", err)
+	}
+	return nil
+}
+
+// Remove removes the unfinished layer of a failed build step.
 func (l *layer) Remove() error {
-	if err := l.fs.Remove(l.Path); err != nil {
+	if !l.fs.Exists(l.TmpPath) {
+		return nil
+	}
+	if err := l.fs.Remove(l.TmpPath); err != nil {
 		return fmt.Errorf("Couldn't remove layer. %v", err)
 	}
 	return nil
 }
+
+// TempPath returns the name of a volume which is built by this process under
+// the given name. The name of the volume contains the pid, so parallel builds
+// don't get in each other's way and IsStale finds the volumes of builds which
+// were killed.
+func TempPath(name string) string {
+	return fmt.Sprintf(".cnr-tmp-%s-%d", name, os.Getpid())
+}
+
+// IsStale returns whether a volume is left over from a build that doesn't run
+// anymore.
+func IsStale(vol string) bool {
+	if !strings.HasPrefix(vol, ".cnr-tmp-") {
+		return false
+	}
+	pid, err := strconv.Atoi(vol[strings.LastIndex(vol, "-")+1:])
+	if err != nil || pid <= 0 {
+		return false
+	}
+	// signal 0 only checks whether the process exists
+	return syscall.Kill(pid, 0) == syscall.ESRCH
+}
+
+// IsLayer returns whether a volume is a layer of the build cache.
+func IsLayer(vol string) bool {
+	hash := strings.TrimPrefix(vol, ".cnr-")
+	if hash == vol || len(hash) != sha1.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// createdDir is the directory below the home which records when layers were
+// created, next to the manifests of the images. Snapshots keep the
+// modification time of their parent, so the layer itself doesn't tell.
+const createdDir = ".cnr-meta/layers"
+
+// MarkCreated records that a layer was created now.
+func MarkCreated(home, vol string) error {
+	dir := filepath.Join(home, createdDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, vol), []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0644)
+}
+
+// Created returns when a layer was created. Layers from before this was
+// recorded fall back to the modification time of their root directory.
+func Created(home, vol string) (time.Time, error) {
+	data, err := ioutil.ReadFile(filepath.Join(home, createdDir, vol))
+	if err == nil {
+		return time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	}
+	if !os.IsNotExist(err) {
+		return time.Time{}, err
+	}
+	fi, err := os.Stat(filepath.Join(home, vol))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// Forget removes the record of a removed layer.
+func Forget(home, vol string) error {
+	if err := os.Remove(filepath.Join(home, createdDir, vol)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
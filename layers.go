@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/giantswarm/conair/fileutil"
+	"github.com/giantswarm/conair/layer"
+)
+
+var cmdLayers = &Command{
+	Name:    "layers",
+	Summary: "List the layers of the build cache",
+	Usage:   "ls",
+	Run:     runLayers,
+	Description: `List the layers of the build cache
+
+conair layers ls
+
+Shows the size of every layer and the images and containers using it. Layers
+nobody uses can be removed with conair gc.
+`,
+}
+
+func runLayers(args []string) (exit int) {
+	if len(args) < 1 || args[0] != "ls" {
+		fmt.Fprintln(os.Stderr, "Unknown or missing subcommand. Use: conair layers ls")
+		return 1
+	}
+
+	fs, err := initStorage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't populate filesystem for conair.", err)
+		return 1
+	}
+
+	layers, refs, err := layerRefs(fs, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't find the layers in use.", err)
+		return 1
+	}
+
+	fmt.Fprintln(out, "LAYER\tSIZE\tCREATED\tUSED BY")
+	for _, l := range layers {
+		dir := fmt.Sprintf("%s/%s", home, l)
+		created, err := layer.Created(home, l)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Couldn't find creation time of layer %s.", l), err)
+			return 1
+		}
+		size, err := fileutil.Size(dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Couldn't compute size of layer %s.", l), err)
+			return 1
+		}
+
+		usedBy := strings.Join(refs[l], ",")
+		if usedBy == "" {
+			usedBy = "-"
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\n", l, fileutil.FormatSize(size), created.Local().Format(time.RFC3339), usedBy)
+	}
+	out.Flush()
+
+	return 0
+}
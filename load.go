@@ -0,0 +1,438 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/giantswarm/conair/archive"
+	"github.com/giantswarm/conair/fileutil"
+	"github.com/giantswarm/conair/image"
+	"github.com/giantswarm/conair/layer"
+	"github.com/giantswarm/conair/oci"
+	"github.com/giantswarm/conair/storage"
+)
+
+var (
+	flagLoadInput string
+	flagLoadCache bool
+	cmdLoad       = &Command{
+		Name:    "load",
+		Summary: "Load an image from a tar archive",
+		Usage:   "[-i FILE] [-cache] [<image>]",
+		Run:     runLoad,
+		Description: `Load an image from a tar archive written by conair save
+
+Archives of conair save, OCI image layouts and archives of docker save are
+read from stdin unless -i is given. The image gets the name it was saved with,
+or the given one. An existing image of that name is replaced.
+
+The layers of an archive are extracted into the image. With -cache the layers
+of built images go into the build cache instead, layers which are cached
+already aren't extracted again, and builds on top of the same layers are
+cached. Builds trust the content of cached layers, so only use -cache for
+archives you trust.
+
+conair load < my-image.tar
+conair load -i nginx.tar nginx
+conair load -cache -i my-image.tar
+`,
+	}
+)
+
+func init() {
+	cmdLoad.Flags.StringVar(&flagLoadInput, "i", "", "Read the archive from this file instead of stdin")
+	cmdLoad.Flags.BoolVar(&flagLoadCache, "cache", false, "Put the layers of built images into the build cache")
+}
+
+// loadedImage is an image found in an archive. The files of its layers are
+// relative to the extracted archive, their digests are the sha256 of the
+// uncompressed tar.
+type loadedImage struct {
+	name     string
+	manifest *image.Manifest
+	layers   []savedLayer
+}
+
+func runLoad(args []string) (exit int) {
+	fs, err := initStorage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't populate filesystem for conair.", err)
+		return 1
+	}
+
+	var r io.Reader = os.Stdin
+	if flagLoadInput != "" {
+		f, err := os.Open(flagLoadInput)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't open archive.", err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	} else if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprintln(os.Stderr, "Refusing to read the archive from a terminal. Please redirect stdin or use -i.")
+		return 1
+	}
+
+	// OCI layouts can have their files in any order, so the archive is
+	// extracted before it's read. It goes below the home, the temporary
+	// directory is often in memory.
+	downloads, err := downloadDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't create temporary directory.", err)
+		return 1
+	}
+	tmp, err := ioutil.TempDir(downloads, "load-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't create temporary directory.", err)
+		return 1
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := archive.Untar(r, tmp); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't read archive.", err)
+		return 1
+	}
+
+	var img *loadedImage
+	switch {
+	case exists(tmp, archiveFile):
+		img, err = readConairArchive(tmp)
+	case exists(tmp, "index.json"):
+		img, err = readOCILayout(tmp, args)
+	case exists(tmp, "manifest.json"):
+		img, err = readDockerArchive(tmp)
+	default:
+		err = fmt.Errorf("It's neither an archive of conair save, an OCI layout nor an archive of docker save.")
+	}
+	if err == nil {
+		err = img.manifest.Config.Validate()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't read archive.", err)
+		return 1
+	}
+
+	name := img.name
+	if len(args) > 0 {
+		name = args[0]
+	}
+	if name == "" || strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("%q can't be the name of an image. Please name it: conair load <image>.", name))
+		return 1
+	}
+
+	tmpPath, err := loadLayers(fs, tmp, name, img.layers, flagLoadCache)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't load layers of image.", err)
+		return 1
+	}
+
+	// an existing image is replaced once the new one is complete
+	if fs.Exists(name) {
+		if err := fs.Remove(name); err != nil {
+			fs.Remove(tmpPath)
+			fmt.Fprintln(os.Stderr, "Couldn't remove existing image.", err)
+			return 1
+		}
+	}
+	if err := fs.Rename(tmpPath, name); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't create filesystem for image.", err)
+		return 1
+	}
+
+	// the digest of the archive isn't trusted, builds are cached by it
+	m := img.manifest
+	m.Name, m.Source, m.Origin = name, image.SourceLoad, flagLoadInput
+	if m.Digest, err = image.ComputeDigest(fmt.Sprintf("%s/%s", home, name)); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't compute digest of image.", err)
+		return 1
+	}
+	if err := m.Write(home); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't write manifest of image.", err)
+		return 1
+	}
+
+	fmt.Printf("Loaded %s (%s).\n", name, m.Digest)
+	return 0
+}
+
+// loadLayers applies the layers of an image and returns the temporary volume
+// holding the image. If cache is set, layers with an ID go into the build
+// cache, or are taken from it.
+func loadLayers(fs storage.Driver, dir, name string, layers []savedLayer, cache bool) (string, error) {
+	// parent is the volume the next layer is applied on, work the volume of
+	// the image once a layer without ID came
+	parent, work := "", ""
+	create := func(vol string) error {
+		if parent == "" {
+			return fs.Subvolume(vol)
+		}
+		return fs.Snapshot(parent, vol, false)
+	}
+
+	for _, l := range layers {
+		if cache && work == "" && l.ID != "" && layer.IsLayer(".cnr-"+l.ID) {
+			vol := ".cnr-" + l.ID
+			if !fs.Exists(vol) {
+				tmpPath := layer.TempPath(l.ID)
+				if err := create(tmpPath); err != nil {
+					return "", err
+				}
+				if err := applyLayer(dir, l, fmt.Sprintf("%s/%s", home, tmpPath)); err != nil {
+					fs.Remove(tmpPath)
+					return "", err
+				}
+				// a parallel load or build may have created the layer
+				if err := fs.Rename(tmpPath, vol); err != nil {
+					fs.Remove(tmpPath)
+					if !fs.Exists(vol) {
+						return "", err
+					}
+				}
+				if err := layer.MarkCreated(home, vol); err != nil {
+					return "", err
+				}
+			}
+			parent = vol
+			continue
+		}
+
+		if work == "" {
+			work = layer.TempPath(name)
+			if err := create(work); err != nil {
+				return "", err
+			}
+		}
+		if err := applyLayer(dir, l, fmt.Sprintf("%s/%s", home, work)); err != nil {
+			fs.Remove(work)
+			return "", err
+		}
+	}
+
+	if work == "" {
+		work = layer.TempPath(name)
+		if err := create(work); err != nil {
+			return "", err
+		}
+	}
+	return work, nil
+}
+
+// applyLayer extracts a layer onto dest and verifies its digest.
+func applyLayer(dir string, l savedLayer, dest string) error {
+	f, err := openFile(dir, l.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dr, err := archive.Decompress(f)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	h := sha256.New()
+	r := io.TeeReader(dr, h)
+	if err := archive.ApplyLayer(r, dest); err != nil {
+		return err
+	}
+	// the tar reader stops at the end of the archive, the digest covers the
+	// whole file
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+	if digest := fmt.Sprintf("sha256:%x", h.Sum(nil)); digest != l.Digest {
+		return fmt.Errorf("Digest of layer %s doesn't match, the archive is corrupt.", l.file)
+	}
+	return nil
+}
+
+func readConairArchive(dir string) (*loadedImage, error) {
+	a := savedArchive{}
+	if err := readJSON(dir, archiveFile, &a); err != nil {
+		return nil, err
+	}
+	if a.Version > archiveVersion {
+		return nil, fmt.Errorf("The archive has version %d, this conair supports up to %d.", a.Version, archiveVersion)
+	}
+	if a.Manifest == nil {
+		return nil, fmt.Errorf("The archive has no manifest.")
+	}
+	for i := range a.Layers {
+		a.Layers[i].file = layerFile(a.Layers[i].Digest)
+	}
+	return &loadedImage{name: a.Manifest.Name, manifest: a.Manifest, layers: a.Layers}, nil
+}
+
+// readOCILayout reads the image of an OCI layout. Layouts with several images
+// need the name of the image.
+func readOCILayout(dir string, args []string) (*loadedImage, error) {
+	index := oci.Index{}
+	if err := readJSON(dir, "index.json", &index); err != nil {
+		return nil, err
+	}
+
+	var desc *oci.Descriptor
+	name := ""
+	for i, d := range index.Manifests {
+		ref := d.Annotations[oci.AnnotationImageName]
+		if ref == "" {
+			ref = d.Annotations[oci.AnnotationRefName]
+		}
+		if len(index.Manifests) == 1 || (len(args) > 0 && imageName(ref) == imageName(args[0])) {
+			desc, name = &index.Manifests[i], imageName(ref)
+			break
+		}
+	}
+	if desc == nil {
+		return nil, fmt.Errorf("The layout has %d images. Please name the one to load.", len(index.Manifests))
+	}
+
+	// multi platform images list a manifest per platform
+	for desc.MediaType == oci.MediaTypeIndex || desc.MediaType == oci.MediaTypeDockerManifestList {
+		platforms := oci.Index{}
+		if err := readBlob(dir, desc.Digest, &platforms); err != nil {
+			return nil, err
+		}
+		desc = nil
+		for i, d := range platforms.Manifests {
+			if d.Platform != nil && d.Platform.OS == "linux" && d.Platform.Architecture == runtime.GOARCH {
+				desc = &platforms.Manifests[i]
+				break
+			}
+		}
+		if desc == nil {
+			return nil, fmt.Errorf("The image isn't available for linux/%s.", runtime.GOARCH)
+		}
+	}
+
+	manifest := oci.Manifest{}
+	if err := readBlob(dir, desc.Digest, &manifest); err != nil {
+		return nil, err
+	}
+	config := oci.Image{}
+	if err := readBlob(dir, manifest.Config.Digest, &config); err != nil {
+		return nil, err
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("The image has %d layers, but %d diff ids.", len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+
+	img := &loadedImage{name: name, manifest: image.New(name, image.SourceLoad)}
+	img.manifest.Config = config.Config.ImageConfig()
+	for i, l := range manifest.Layers {
+		file, err := oci.BlobPath(l.Digest)
+		if err != nil {
+			return nil, err
+		}
+		img.layers = append(img.layers, savedLayer{
+			ID:     l.Annotations[oci.AnnotationLayer],
+			Digest: config.RootFS.DiffIDs[i],
+			file:   file,
+		})
+	}
+	return img, nil
+}
+
+// readDockerArchive reads the first image of an archive of docker save.
+func readDockerArchive(dir string) (*loadedImage, error) {
+	manifests := []oci.DockerManifest{}
+	if err := readJSON(dir, "manifest.json", &manifests); err != nil {
+		return nil, err
+	}
+	if len(manifests) == 0 {
+		return nil, fmt.Errorf("The archive has no images.")
+	}
+	manifest := manifests[0]
+
+	config := oci.Image{}
+	if err := readJSON(dir, manifest.Config, &config); err != nil {
+		return nil, err
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("The image has %d layers, but %d diff ids.", len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+
+	name := ""
+	if len(manifest.RepoTags) > 0 {
+		name = imageName(manifest.RepoTags[0])
+	}
+	img := &loadedImage{name: name, manifest: image.New(name, image.SourceLoad)}
+	img.manifest.Config = config.Config.ImageConfig()
+	for i, file := range manifest.Layers {
+		img.layers = append(img.layers, savedLayer{Digest: config.RootFS.DiffIDs[i], file: file})
+	}
+	return img, nil
+}
+
+// imageName turns a docker reference into the name of an image: the last
+// part of the repository, and the tag unless it's latest.
+func imageName(ref string) string {
+	if i := strings.LastIndex(ref, "/"); i >= 0 {
+		ref = ref[i+1:]
+	}
+	return strings.TrimSuffix(ref, ":latest")
+}
+
+func readBlob(dir, digest string, v interface{}) error {
+	file, err := oci.BlobPath(digest)
+	if err != nil {
+		return err
+	}
+	return readJSON(dir, file, v)
+}
+
+// readJSON parses a file of the extracted archive.
+func readJSON(dir, name string, v interface{}) error {
+	f, err := openFile(dir, name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Couldn't parse %s. %v", name, err)
+	}
+	return nil
+}
+
+func exists(dir, name string) bool {
+	f, err := openFile(dir, name)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// openFile opens a regular file of the extracted archive. Names and symlinks
+// can't point outside of it.
+func openFile(dir, name string) (*os.File, error) {
+	file, err := fileutil.SecureJoin(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil && !fi.Mode().IsRegular() {
+		err = fmt.Errorf("%s isn't a regular file", name)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
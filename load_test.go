@@ -0,0 +1,264 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/giantswarm/conair/image"
+	"github.com/giantswarm/conair/oci"
+)
+
+// setupSaveLoad resets the flags of save and load after a test.
+func setupSaveLoad(t *testing.T) {
+	format, output, input, cache := flagSaveFormat, flagSaveOutput, flagLoadInput, flagLoadCache
+	t.Cleanup(func() {
+		flagSaveFormat, flagSaveOutput, flagLoadInput, flagLoadCache = format, output, input, cache
+	})
+}
+
+// buildAndSave builds app on base and saves it in the given format.
+func buildAndSave(t *testing.T, format string) (*image.Manifest, string) {
+	setupRoot(t)
+	createBaseImage(t, "base")
+	ctx := t.TempDir()
+	writeFile(t, path.Join(ctx, "hello.txt"), "hello\n")
+	writeFile(t, path.Join(ctx, "Conairfile"), `FROM base
+COPY hello.txt /srv/hello.txt
+ENV GREETING=hello
+CMD ["/bin/true"]
+`)
+	flagContext = ctx
+	if exit := runBuild([]string{"app"}); exit != 0 {
+		t.Fatalf("build failed with %d", exit)
+	}
+	// a file removed after the last layer
+	if err := os.Remove(path.Join(home, "app/etc/os-release")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := image.Read(home, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flagSaveFormat, flagSaveOutput = format, path.Join(t.TempDir(), "app.tar")
+	if exit := runSave([]string{"app"}); exit != 0 {
+		t.Fatalf("save failed with %d", exit)
+	}
+	return m, flagSaveOutput
+}
+
+// checkLoaded checks an image loaded from an archive of app.
+func checkLoaded(t *testing.T, name string, saved *image.Manifest) {
+	data, err := ioutil.ReadFile(path.Join(home, name, "srv/hello.txt"))
+	if err != nil || string(data) != "hello\n" {
+		t.Errorf("loaded image lacks hello.txt: %q %v", data, err)
+	}
+	if _, err := os.Stat(path.Join(home, name, "etc/os-release")); !os.IsNotExist(err) {
+		t.Errorf("removed file was loaded: %v", err)
+	}
+	m, err := image.Read(home, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Source != image.SourceLoad || len(m.Config.Cmd) != 1 || m.Config.Cmd[0] != saved.Config.Cmd[0] {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+	if digest, err := image.ComputeDigest(path.Join(home, name)); err != nil || m.Digest != digest {
+		t.Errorf("loaded image has digest %s, not %s %v", m.Digest, digest, err)
+	}
+}
+
+func cachedLayers(t *testing.T, m *image.Manifest) int {
+	n := 0
+	for _, l := range m.Layers {
+		if _, err := os.Stat(path.Join(home, ".cnr-"+l.Hash)); err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSaveLoad(t *testing.T) {
+	setupSaveLoad(t)
+	saved, file := buildAndSave(t, formatConair)
+	if len(saved.Layers) == 0 {
+		t.Fatal("app has no layers")
+	}
+
+	// the layers of another host aren't trusted
+	setupRoot(t)
+	flagLoadInput = file
+	if exit := runLoad(nil); exit != 0 {
+		t.Fatalf("load failed with %d", exit)
+	}
+	checkLoaded(t, "app", saved)
+	if n := cachedLayers(t, saved); n != 0 {
+		t.Errorf("load put %d layers into the build cache", n)
+	}
+
+	setupRoot(t)
+	flagLoadCache = true
+	if exit := runLoad([]string{"copy"}); exit != 0 {
+		t.Fatalf("load -cache failed with %d", exit)
+	}
+	checkLoaded(t, "copy", saved)
+	if n := cachedLayers(t, saved); n != len(saved.Layers) {
+		t.Errorf("load -cache put %d of %d layers into the build cache", n, len(saved.Layers))
+	}
+	// cached layers are reused
+	if exit := runLoad([]string{"again"}); exit != 0 {
+		t.Fatalf("second load failed with %d", exit)
+	}
+	checkLoaded(t, "again", saved)
+}
+
+func TestSaveLoadOCI(t *testing.T) {
+	setupSaveLoad(t)
+	saved, file := buildAndSave(t, formatOCI)
+
+	names := map[string]bool{}
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names[hdr.Name] = true
+	}
+	for _, name := range []string{"oci-layout", "index.json", "manifest.json"} {
+		if !names[name] {
+			t.Errorf("layout lacks %s", name)
+		}
+	}
+
+	setupRoot(t)
+	flagLoadInput = file
+	if exit := runLoad([]string{"app"}); exit != 0 {
+		t.Fatalf("load failed with %d", exit)
+	}
+	checkLoaded(t, "app", saved)
+	if n := cachedLayers(t, saved); n != 0 {
+		t.Errorf("load put %d layers into the build cache", n)
+	}
+}
+
+// dockerArchive writes an archive like docker save of an image with the given
+// layers.
+func dockerArchive(t *testing.T, layers ...[]byte) string {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	add := func(name string, data []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(data)
+	}
+
+	config := oci.Image{OS: "linux", Config: oci.Config{Env: []string{"A=1"}, Cmd: []string{"nginx"}}, RootFS: oci.RootFS{Type: "layers"}}
+	manifest := oci.DockerManifest{Config: "config.json", RepoTags: []string{"library/nginx:latest"}}
+	for i, l := range layers {
+		data := l
+		// docker compresses layers in newer versions
+		if i%2 == 1 {
+			gz := &bytes.Buffer{}
+			w := gzip.NewWriter(gz)
+			w.Write(l)
+			w.Close()
+			data = gz.Bytes()
+		}
+		name := fmt.Sprintf("%d/layer.tar", i)
+		add(name, data)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, fmt.Sprintf("sha256:%x", sha256.Sum256(l)))
+		manifest.Layers = append(manifest.Layers, name)
+	}
+	data, _ := json.Marshal(config)
+	add("config.json", data)
+	data, _ = json.Marshal([]oci.DockerManifest{manifest})
+	add("manifest.json", data)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file := path.Join(t.TempDir(), "nginx.tar")
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func layerTar(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLoadDockerArchive(t *testing.T) {
+	setupSaveLoad(t)
+	setupRoot(t)
+
+	flagLoadInput = dockerArchive(t,
+		layerTar(t, map[string]string{"etc/nginx.conf": "old", "etc/removed": "x"}),
+		layerTar(t, map[string]string{"etc/nginx.conf": "new", "etc/.wh.removed": ""}),
+	)
+	if exit := runLoad(nil); exit != 0 {
+		t.Fatalf("load failed with %d", exit)
+	}
+	data, err := ioutil.ReadFile(path.Join(home, "nginx/etc/nginx.conf"))
+	if err != nil || string(data) != "new" {
+		t.Errorf("layers weren't applied in order: %q %v", data, err)
+	}
+	if _, err := os.Stat(path.Join(home, "nginx/etc/removed")); !os.IsNotExist(err) {
+		t.Errorf("whiteout wasn't applied: %v", err)
+	}
+	m, err := image.Read(home, "nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Config.Env) != 1 || m.Config.Env[0] != "A=1" || len(m.Config.Cmd) != 1 || m.Config.Cmd[0] != "nginx" {
+		t.Errorf("unexpected configuration %+v", m.Config)
+	}
+}
+
+func TestLoadCorruptLayer(t *testing.T) {
+	setupSaveLoad(t)
+	setupRoot(t)
+
+	flagLoadInput = dockerArchive(t, layerTar(t, map[string]string{"a": "original"}))
+	// the layer doesn't match its diff id anymore
+	data, err := ioutil.ReadFile(flagLoadInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.Replace(data, []byte("original"), []byte("modified"), 1)
+	if err := ioutil.WriteFile(flagLoadInput, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if exit := runLoad(nil); exit == 0 {
+		t.Fatal("archive with a corrupt layer was loaded")
+	}
+	if _, err := os.Stat(path.Join(home, "nginx")); !os.IsNotExist(err) {
+		t.Errorf("image of a corrupt archive was created: %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/giantswarm/conair/nspawn"
+	"github.com/giantswarm/conair/parser"
+	"github.com/giantswarm/conair/pkgmgr"
+	"github.com/giantswarm/conair/storage"
+)
+
+const cachePrefix = ".cnr-cache-"
+
+// buildMounts are the sources of the mounts of RUN instructions: the secrets
+// and ssh agents given to conair build -secret and -ssh, and the cache
+// volumes.
+type buildMounts struct {
+	secrets map[string]string
+	agents  map[string]string
+	fs      storage.Driver
+	// noCache skips cache mounts, eg for a clean build
+	noCache bool
+}
+
+// newBuildMounts parses the -secret (id=ID,src=FILE) and -ssh (ID or
+// ID=SOCKET) flags. -ssh without a socket uses the agent of $SSH_AUTH_SOCK.
+func newBuildMounts(fs storage.Driver, secrets, agents []string, noCache bool) (*buildMounts, error) {
+	b := &buildMounts{
+		secrets: map[string]string{},
+		agents:  map[string]string{},
+		fs:      fs,
+		noCache: noCache,
+	}
+
+	for _, secret := range secrets {
+		var id, src string
+		for _, option := range strings.Split(secret, ",") {
+			kv := strings.SplitN(option, "=", 2)
+			if len(kv) < 2 {
+				return nil, fmt.Errorf("Secret %s is unreadable. Please use id=ID,src=FILE notation.", secret)
+			}
+			switch kv[0] {
+			case "id":
+				id = kv[1]
+			case "src", "source":
+				src = kv[1]
+			case "type":
+				if kv[1] != "file" {
+					return nil, fmt.Errorf("Secret %s: only file secrets are supported.", secret)
+				}
+			default:
+				return nil, fmt.Errorf("Secret %s: unknown option %s.", secret, kv[0])
+			}
+		}
+		if src == "" {
+			return nil, fmt.Errorf("Secret %s has no source. Please use id=ID,src=FILE notation.", secret)
+		}
+		if id == "" {
+			id = path.Base(src)
+		}
+		if fi, err := os.Stat(src); err != nil {
+			return nil, fmt.Errorf("Couldn't read secret %s. %v", id, err)
+		} else if !fi.Mode().IsRegular() {
+			return nil, fmt.Errorf("Secret %s isn't a regular file.", id)
+		}
+		b.secrets[id] = src
+	}
+
+	for _, agent := range agents {
+		kv := strings.SplitN(agent, "=", 2)
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if len(kv) > 1 {
+			socket = kv[1]
+		}
+		if socket == "" {
+			return nil, fmt.Errorf("SSH_AUTH_SOCK isn't set. Please start an ssh agent or use -ssh %s=SOCKET.", kv[0])
+		}
+		if fi, err := os.Stat(socket); err != nil {
+			return nil, fmt.Errorf("Couldn't find ssh agent %s. %v", kv[0], err)
+		} else if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s isn't the socket of an ssh agent.", socket)
+		}
+		b.agents[kv[0]] = socket
+	}
+	return b, nil
+}
+
+// resolve returns the nspawn mounts for the --mount flags of a RUN
+// instruction. Secrets are bound from private copies with the uid, gid and
+// mode of the mount, the returned function removes them after the step. Cache
+// volumes are created on first use.
+func (b *buildMounts) resolve(mounts []parser.Mount) ([]nspawn.Mount, func(), error) {
+	result := []nspawn.Mount{}
+	dir := ""
+	cleanup := func() {
+		if dir != "" {
+			os.RemoveAll(dir)
+		}
+	}
+
+	for i, m := range mounts {
+		switch m.Type {
+		case parser.MountSecret:
+			src, ok := b.secrets[m.ID]
+			if !ok {
+				if m.Required {
+					cleanup()
+					return nil, nil, fmt.Errorf("Secret %s is required. Please use -secret id=%s,src=FILE.", m.ID, m.ID)
+				}
+				continue
+			}
+			if dir == "" {
+				var err error
+				if dir, err = ioutil.TempDir("", "conair-secrets-"); err != nil {
+					return nil, nil, err
+				}
+			}
+			file := fmt.Sprintf("%s/%d", dir, i)
+			if err := copySecret(src, file, m); err != nil {
+				cleanup()
+				return nil, nil, fmt.Errorf("Couldn't mount secret %s. %v", m.ID, err)
+			}
+			result = append(result, nspawn.Mount{Source: file, Target: m.Target, ReadOnly: true})
+		case parser.MountSSH:
+			socket, ok := b.agents[m.ID]
+			if !ok {
+				if m.Required {
+					cleanup()
+					return nil, nil, fmt.Errorf("SSH agent %s is required. Please use -ssh %s.", m.ID, m.ID)
+				}
+				continue
+			}
+			result = append(result, nspawn.Mount{
+				Source: socket,
+				Target: m.Target,
+				Env:    "SSH_AUTH_SOCK=" + m.Target,
+			})
+		case parser.MountCache:
+			if b.noCache {
+				continue
+			}
+			vol, err := b.cache(m)
+			if err != nil {
+				cleanup()
+				return nil, nil, fmt.Errorf("Couldn't create cache %s. %v", m.ID, err)
+			}
+			result = append(result, nspawn.Mount{
+				Source:   fmt.Sprintf("%s/%s", home, vol),
+				Target:   m.Target,
+				ReadOnly: m.ReadOnly,
+			})
+		}
+	}
+	return result, cleanup, nil
+}
+
+func copySecret(src, dst string, m parser.Mount) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(dst, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Chown(dst, m.Uid, m.Gid); err != nil {
+		return err
+	}
+	return os.Chmod(dst, os.FileMode(m.Mode))
+}
+
+// packageCache returns the cache mount which keeps the packages downloaded by
+// PKG out of the layers. Every package manager has a cache of its own.
+func packageCache(m *pkgmgr.Manager) parser.Mount {
+	return parser.Mount{
+		Type:   parser.MountCache,
+		ID:     m.Name,
+		Target: m.CacheDir,
+		Mode:   0755,
+	}
+}
+
+// cache returns the volume of a cache mount. New caches get the uid, gid and
+// mode of the mount.
+func (b *buildMounts) cache(m parser.Mount) (string, error) {
+	vol := cacheVolume(m.ID)
+	if b.fs.Exists(vol) {
+		return vol, nil
+	}
+	// a parallel build may create the cache at the same time
+	if err := b.fs.Subvolume(vol); err != nil && !b.fs.Exists(vol) {
+		return "", err
+	}
+
+	dir := fmt.Sprintf("%s/%s", home, vol)
+	if err := os.Chown(dir, m.Uid, m.Gid); err != nil {
+		return "", err
+	}
+	return vol, os.Chmod(dir, os.FileMode(m.Mode))
+}
+
+// cacheVolume returns the name of the volume of a cache. Cache ids are often
+// paths, so they are escaped.
+func cacheVolume(id string) string {
+	return cachePrefix + url.PathEscape(id)
+}
+
+// cacheID returns the id of a cache volume, or false if the volume isn't a
+// cache.
+func cacheID(vol string) (string, bool) {
+	if !strings.HasPrefix(vol, cachePrefix) {
+		return "", false
+	}
+	id, err := url.PathUnescape(strings.TrimPrefix(vol, cachePrefix))
+	return id, err == nil
+}
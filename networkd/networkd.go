@@ -6,6 +6,8 @@ import (
 	"os/exec"
 	"strings"
 	"text/template"
+
+	"github.com/giantswarm/conair/runner"
 )
 
 type networkDevice struct {
@@ -13,6 +15,10 @@ type networkDevice struct {
 	Destination string
 }
 
+// Root is prepended to all host paths. It allows to write the network
+// definitions somewhere else than the host's /etc, eg in tests.
+var Root = ""
+
 const (
 	networkdPath         = "/etc/systemd/network"
 	bridgeHostFile       = "80-container-bridge.netdev"
@@ -75,13 +81,13 @@ func DefineHostNetwork(bridge, destination string) error {
 		Destination: strings.Replace(destination, ".0/24", "", 1),
 	}
 
-	bridgeHostPath := fmt.Sprintf("%s/%s", networkdPath, bridgeHostFile)
+	bridgeHostPath := fmt.Sprintf("%s%s/%s", Root, networkdPath, bridgeHostFile)
 	err := storeNetworkDefinition(dev, bridgeHostTemplate, bridgeHostPath)
 	if err != nil {
 		return err
 	}
 
-	networkHostPath := fmt.Sprintf("%s/%s", networkdPath, networkHostFile)
+	networkHostPath := fmt.Sprintf("%s%s/%s", Root, networkdPath, networkHostFile)
 	err = storeNetworkDefinition(dev, networkHostTemplate, networkHostPath)
 	if err != nil {
 		return err
@@ -100,12 +106,12 @@ func DefineContainerNetwork(containerPath, destination string) error {
 }
 
 func RemoveHostNetwork() error {
-	err := os.Remove(fmt.Sprintf("%s/%s", networkdPath, bridgeHostFile))
+	err := os.Remove(fmt.Sprintf("%s%s/%s", Root, networkdPath, bridgeHostFile))
 	if err != nil {
 		return err
 	}
 
-	err = os.Remove(fmt.Sprintf("%s/%s", networkdPath, networkHostFile))
+	err = os.Remove(fmt.Sprintf("%s%s/%s", Root, networkdPath, networkHostFile))
 	if err != nil {
 		return err
 	}
@@ -114,5 +120,5 @@ func RemoveHostNetwork() error {
 }
 
 func restart() error {
-	return exec.Command("systemctl", "restart", "systemd-networkd").Run()
+	return runner.Default.Run(exec.Command("systemctl", "restart", "systemd-networkd"))
 }
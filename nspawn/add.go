@@ -0,0 +1,234 @@
+package nspawn
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/giantswarm/conair/archive"
+	"github.com/giantswarm/conair/buildcontext"
+	"github.com/giantswarm/conair/fileutil"
+	"github.com/giantswarm/conair/parser"
+)
+
+// copy executes ADD and COPY instructions. Sources are read from the build
+// context, ADD additionally downloads URLs and extracts local tar archives.
+func (c *Container) copy(ctx context.Context, verb, payload string) error {
+	args, err := parser.ParseCopy(payload)
+	if err != nil {
+		return err
+	}
+	if c.Context == nil {
+		return fmt.Errorf("No build context to %s from", verb)
+	}
+
+	uid, gid, err := c.lookupOwner(args.Chown)
+	if err != nil {
+		return err
+	}
+
+	dest := args.Dest
+	if !path.IsAbs(dest) {
+		dest = path.Join("/", c.Workdir, dest)
+	}
+
+	sources := []string{}
+	for _, source := range args.Sources {
+		if buildcontext.IsURL(source) {
+			if verb != "ADD" {
+				return fmt.Errorf("COPY doesn't support URLs, use ADD for %s", source)
+			}
+			sources = append(sources, source)
+			continue
+		}
+		matches, err := c.Context.Glob(source)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, matches...)
+	}
+
+	// like docker, several sources need a directory as destination
+	destIsDir := strings.HasSuffix(args.Dest, "/")
+	if len(sources) > 1 && !destIsDir {
+		return fmt.Errorf("When adding several sources, the destination must be a directory ending with /")
+	}
+	if target, err := fileutil.SecureJoin(c.Path, dest); err == nil {
+		if fi, err := os.Stat(target); err == nil && fi.IsDir() {
+			destIsDir = true
+		}
+	}
+
+	for _, source := range sources {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if buildcontext.IsURL(source) {
+			if err := c.download(ctx, source, dest, destIsDir, uid, gid); err != nil {
+				return fmt.Errorf("Couldn't download %s. %v", source, err)
+			}
+			continue
+		}
+
+		fi, err := os.Stat(source)
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.IsDir():
+			// the content of directories is copied, not the directory itself.
+			// A trailing slash follows symlinked directories.
+			err = fileutil.CopyInto(source+"/", c.Path, dest, uid, gid, c.Context.Ignored)
+		case verb == "ADD" && archive.IsArchive(source):
+			var target string
+			if target, err = fileutil.SecureJoin(c.Path, dest); err == nil {
+				err = archive.ExtractFile(source, target)
+			}
+		case destIsDir:
+			err = fileutil.CopyInto(source, c.Path, path.Join(dest, path.Base(source)), uid, gid, nil)
+		default:
+			err = fileutil.CopyInto(source, c.Path, dest, uid, gid, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("Couldn't add %s. %v", source, err)
+		}
+	}
+	return nil
+}
+
+// download fetches a URL into the image. Downloaded files aren't extracted.
+func (c *Container) download(ctx context.Context, source, dest string, destIsDir bool, uid, gid int) error {
+	if destIsDir {
+		u, err := url.Parse(source)
+		if err != nil {
+			return err
+		}
+		name := path.Base(u.Path)
+		if name == "/" || name == "." {
+			return fmt.Errorf("Can't determine a file name, please add a file name to the destination")
+		}
+		dest = path.Join(dest, name)
+	}
+
+	dir, err := fileutil.SecureJoin(c.Path, path.Dir(dest))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	target := path.Join(dir, path.Base(dest))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", source, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Server responded with %s", resp.Status)
+	}
+
+	// like docker, downloaded files are only readable by their owner
+	os.Remove(target)
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Chown(target, uid, gid)
+}
+
+// lookupOwner resolves the user:group of a --chown flag with the passwd and
+// group files of the image. Without a group, the group id is the user id.
+func (c *Container) lookupOwner(chown string) (int, int, error) {
+	if chown == "" {
+		return 0, 0, nil
+	}
+
+	fields := strings.SplitN(chown, ":", 2)
+	uid, err := c.lookupId("etc/passwd", fields[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(fields) < 2 {
+		return uid, uid, nil
+	}
+	gid, err := c.lookupId("etc/group", fields[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// lookupId returns the id of a name in a passwd or group file of the image.
+// Numeric names are returned unchanged.
+func (c *Container) lookupId(file, name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	path, err := fileutil.SecureJoin(c.Path, file)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't look up %s. %v", name, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) > 2 && fields[0] == name {
+			return strconv.Atoi(fields[2])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("%s not found in /%s of the image", name, file)
+}
+
+// primaryGroup returns the group id of a user, a name or uid, in the passwd
+// file of the image.
+func (c *Container) primaryGroup(user string) (int, error) {
+	file, err := fileutil.SecureJoin(c.Path, "etc/passwd")
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't look up %s. %v", user, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) > 3 && (fields[0] == user || fields[2] == user) {
+			return strconv.Atoi(fields[3])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("%s not found in /etc/passwd of the image", user)
+}
@@ -2,35 +2,62 @@ package nspawn
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 
 	"os"
 	"os/exec"
+	"path"
 	"strings"
+	"syscall"
 	"text/template"
+	"time"
 
 	"code.google.com/p/go-uuid/uuid"
+
+	"github.com/giantswarm/conair/buildcontext"
+	"github.com/giantswarm/conair/fileutil"
+	"github.com/giantswarm/conair/parser"
+	"github.com/giantswarm/conair/pkgmgr"
+	"github.com/giantswarm/conair/runner"
 )
 
 const (
 	nspawnConfigTemplate string = `[Service]
 Environment="MACHINE_ID={{.MachineId}}"
 Environment="BIND={{.Bind}}"
-`
+Environment="PORT={{.Port}}"
+{{if .Exec}}
+# run the command of the image instead of booting
+Type=oneshot
+ExecStart=
+ExecStart=/usr/bin/systemd-nspawn --machine %i --uuid=${MACHINE_ID} --capability=all --quiet --network-veth --network-bridge={{.Bridge}} --keep-unit --as-pid2 --link-journal=try-guest --directory={{.Directory}} ${BIND} ${PORT} {{.Exec}}
+{{end}}`
 	nspawnMachineIdTemplate string = `{{.MachineId}}
 `
 	buildstepTemplate string = `#!/bin/sh
-mkdir -p /run/systemd/resolve
+{{if .Root}}mkdir -p /run/systemd/resolve
 echo 'nameserver 8.8.8.8' > /run/systemd/resolve/resolv.conf
 
-{{.Payload}}
+{{end}}{{if .Workdir}}cd {{.Workdir}} || exit 1
 
-rc=$?
+{{end}}{{.Payload}}
 
+rc=$?
+{{if .Root}}
 rm -f /run/systemd/resolve/resolv.conf
-
+{{end}}
 exit $rc
 `
+	// unprivileged build steps can't write to /run, so the resolv.conf is
+	// bind mounted from the build container's root directory
+	buildResolvConf    = ".conairresolv"
+	buildResolvContent = "nameserver 8.8.8.8\n"
+
+	// time a canceled build step gets to shut down before it is killed
+	stopTimeout = 10 * time.Second
 )
 
 type Container struct {
@@ -41,11 +68,49 @@ type Container struct {
 	ConfigPath string
 	Binds      []string
 	Snapshots  []string
+	// Env is persisted into the image, BuildArgs are only set in build steps
+	Env       []string
+	BuildArgs []string
+	// Workdir, User and Shell of RUN build steps
+	Workdir string
+	User    string
+	Shell   []string
+	// Context holds the sources of ADD and COPY
+	Context *buildcontext.Context
+	// Ports forwarded from the host, eg 80/tcp
+	Ports []string
+	// Command is run instead of booting the container
+	Command []string
+	Bridge  string
+	// Stdout and Stderr receive the output of build steps
+	Stdout io.Writer
+	Stderr io.Writer
+	// Mounts are bound into build steps
+	Mounts []Mount
+	// PkgManager installs the packages of PKG, it is detected if unset
+	PkgManager *pkgmgr.Manager
+	// mount points nspawn creates for the mounts of a build step
+	mountPoints []string
+	runner      runner.Runner
+}
+
+// Mount binds a file or socket of the host into a single build step, eg a
+// secret or the socket of the ssh agent. It never becomes part of the layer.
+type Mount struct {
+	Source   string
+	Target   string
+	ReadOnly bool
+	// Env is set in the build step, eg SSH_AUTH_SOCK=/run/conair/ssh_agent
+	Env string
 }
 
 type config struct {
 	MachineId string
 	Bind      string
+	Port      string
+	Exec      string
+	Bridge    string
+	Directory string
 }
 
 func Init(name, path string) Container {
@@ -56,12 +121,19 @@ func Init(name, path string) Container {
 		Buildstep: ".conairbuildstep",
 		Binds:     make([]string, 0),
 		Snapshots: make([]string, 0),
+		Stdout:    os.Stdout,
+		Stderr:    os.Stderr,
+		runner:    runner.Default,
 	}
-	c.ConfigPath = fmt.Sprintf("%s/%s.d", systemdPath, c.Unit)
+	c.ConfigPath = fmt.Sprintf("%s%s/%s.d", Root, systemdPath, c.Unit)
 
 	return c
 }
 
+func (c *Container) SetRunner(r runner.Runner) {
+	c.runner = r
+}
+
 func (c *Container) SetSnapshots(snapshots []string) {
 	c.Snapshots = snapshots
 }
@@ -70,6 +142,54 @@ func (c *Container) SetBinds(binds []string) {
 	c.Binds = binds
 }
 
+func (c *Container) SetEnv(env []string) {
+	c.Env = env
+}
+
+func (c *Container) SetBuildArgs(args []string) {
+	c.BuildArgs = args
+}
+
+func (c *Container) SetWorkdir(workdir string) {
+	c.Workdir = workdir
+}
+
+func (c *Container) SetUser(user string) {
+	c.User = user
+}
+
+func (c *Container) SetShell(shell []string) {
+	c.Shell = shell
+}
+
+func (c *Container) SetContext(ctx *buildcontext.Context) {
+	c.Context = ctx
+}
+
+func (c *Container) SetOutput(stdout, stderr io.Writer) {
+	c.Stdout = stdout
+	c.Stderr = stderr
+}
+
+func (c *Container) SetMounts(mounts []Mount) {
+	c.Mounts = mounts
+}
+
+func (c *Container) SetPackageManager(m *pkgmgr.Manager) {
+	c.PkgManager = m
+}
+
+func (c *Container) SetPorts(ports []string) {
+	c.Ports = ports
+}
+
+// SetCommand makes the container run command (with the Env, Workdir and User
+// of the container) instead of booting. It needs the bridge of the network.
+func (c *Container) SetCommand(command []string, bridge string) {
+	c.Command = command
+	c.Bridge = bridge
+}
+
 func (c *Container) createConfig() error {
 	conf := config{
 		MachineId: strings.Replace(uuid.New(), "-", "", -1),
@@ -84,6 +204,26 @@ func (c *Container) createConfig() error {
 		conf.Bind = strings.Join(tmp, " ")
 	}
 
+	ports := []string{}
+	for _, port := range c.Ports {
+		fields := strings.SplitN(port, "/", 2)
+		if len(fields) < 2 {
+			fields = append(fields, "tcp")
+		}
+		ports = append(ports, fmt.Sprintf("--port=%s:%s:%s", fields[1], fields[0], fields[0]))
+	}
+	conf.Port = strings.Join(ports, " ")
+
+	if len(c.Command) > 0 {
+		args, err := c.execArgs()
+		if err != nil {
+			return err
+		}
+		conf.Exec = args
+		conf.Bridge = c.Bridge
+		conf.Directory = c.Path
+	}
+
 	if err := os.Mkdir(c.ConfigPath, 0755); err != nil {
 		return err
 	}
@@ -110,6 +250,55 @@ func (c *Container) createConfig() error {
 	return nil
 }
 
+// execArgs returns the nspawn arguments to run the command of the container,
+// quoted for an ExecStart line.
+func (c *Container) execArgs() (string, error) {
+	args := []string{}
+	for _, env := range c.Env {
+		args = append(args, "--setenv="+env)
+	}
+	if c.Workdir != "" {
+		args = append(args, "--chdir="+c.Workdir)
+	}
+	if c.User != "" {
+		user, err := c.runAs(c.User)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "--user="+user)
+	}
+	args = append(append(args, "--"), c.Command...)
+
+	quoted := []string{}
+	for _, arg := range args {
+		arg = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "%", "%%", "$", "$$").Replace(arg)
+		quoted = append(quoted, `"`+arg+`"`)
+	}
+	return strings.Join(quoted, " "), nil
+}
+
+// runAs returns the user for nspawn --user. nspawn switches to the primary
+// group of the user, so USER user:group with another group is rejected
+// instead of dropping the group.
+func (c *Container) runAs(user string) (string, error) {
+	fields := strings.SplitN(user, ":", 2)
+	if len(fields) < 2 {
+		return user, nil
+	}
+	gid, err := c.lookupId("etc/group", fields[1])
+	if err != nil {
+		return "", err
+	}
+	primary, err := c.primaryGroup(fields[0])
+	if err != nil {
+		return "", err
+	}
+	if gid != primary {
+		return "", fmt.Errorf("Can't run as %s, systemd-nspawn only runs commands with the primary group of the user (%d).", user, primary)
+	}
+	return fields[0], nil
+}
+
 func (c *Container) removeConfig() error {
 	if err := os.Remove(fmt.Sprintf("%s/10-container.conf", c.ConfigPath)); err != nil {
 		return err
@@ -125,11 +314,11 @@ func (c *Container) Enable() error {
 		return err
 	}
 
-	return exec.Command("systemctl", "enable", c.Unit).Run()
+	return c.runner.Run(exec.Command("systemctl", "enable", c.Unit))
 }
 
 func (c *Container) Start() error {
-	return exec.Command("systemctl", "start", c.Unit).Run()
+	return c.runner.Run(exec.Command("systemctl", "start", c.Unit))
 }
 
 func (c *Container) Disable() error {
@@ -137,15 +326,15 @@ func (c *Container) Disable() error {
 		return err
 	}
 
-	return exec.Command("systemctl", "disable", c.Unit).Run()
+	return c.runner.Run(exec.Command("systemctl", "disable", c.Unit))
 }
 
 func (c *Container) Stop() error {
-	return exec.Command("systemctl", "stop", c.Unit).Run()
+	return c.runner.Run(exec.Command("systemctl", "stop", c.Unit))
 }
 
 func (c *Container) Status() (string, error) {
-	o, err := exec.Command("systemctl", "status", c.Unit).Output()
+	o, err := c.runner.Output(exec.Command("systemctl", "status", c.Unit))
 
 	if err != nil {
 		return "", err
@@ -176,18 +365,22 @@ func (c *Container) Attach() error {
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
 
-	cmd.Run()
+	c.runner.Run(cmd)
 
 	return nil
 }
 
 func (c *Container) getLeader() (string, error) {
-	o, err := exec.Command("machinectl", "-p", "Leader", "show", c.Name).Output()
+	o, err := c.runner.Output(exec.Command("machinectl", "-p", "Leader", "show", c.Name))
 	if err != nil {
 		return "", err
 	}
 
-	return strings.TrimSpace(strings.Split(bytes.NewBuffer(o).String(), "=")[1]), nil
+	fields := strings.SplitN(bytes.NewBuffer(o).String(), "=", 2)
+	if len(fields) < 2 {
+		return "", fmt.Errorf("Couldn't find leader of %s", c.Name)
+	}
+	return strings.TrimSpace(fields[1]), nil
 }
 
 func (c *Container) Execute(payload string) (string, error) {
@@ -210,7 +403,7 @@ func (c *Container) Execute(payload string) (string, error) {
 	}
 	cmd.Stdin = strings.NewReader(payload)
 
-	bs, err := cmd.Output()
+	bs, err := c.runner.Output(cmd)
 	if err != nil {
 		return "", err
 	}
@@ -230,29 +423,29 @@ func (c *Container) Ip() (string, error) {
 	return strings.Trim(ip, "\n"), nil
 }
 
-func (c *Container) Build(verb, payload string) error {
+// Build executes a build step. Canceling ctx stops the running step.
+func (c *Container) Build(ctx context.Context, verb, payload string) error {
 	var (
 		cmd *exec.Cmd
 		err error
 	)
 
-	if verb == "PKG" {
-		if err := c.Build("RUN", "pacman -Sy --noconfirm"); err != nil {
-			return err
-		}
+	if verb == "ENV" {
+		return c.persistEnv()
+	}
+	if verb == "ADD" || verb == "COPY" {
+		return c.copy(ctx, verb, payload)
 	}
 
 	switch verb {
 	case "RUN":
-		cmd, err = c.run(payload)
+		cmd, err = c.run(ctx, c.shell(payload), c.User)
 	case "RUN_NOCACHE":
-		cmd, err = c.run(payload)
-	case "ADD":
-		cmd, err = c.add(payload)
+		cmd, err = c.run(ctx, c.shell(payload), c.User)
 	case "PKG":
-		cmd, err = c.pkg(payload)
+		cmd, err = c.pkg(ctx, payload)
 	case "ENABLE":
-		cmd, err = c.enable(payload)
+		cmd, err = c.enable(ctx, payload)
 	default:
 		return nil
 	}
@@ -261,6 +454,10 @@ func (c *Container) Build(verb, payload string) error {
 		return err
 	}
 
+	return c.runBuildstep(cmd, true)
+}
+
+func (c *Container) runBuildstep(cmd *exec.Cmd, cleanup bool) error {
 	cmd.Env = []string{
 		"TERM=vt102",
 		"SHELL=/bin/bash",
@@ -270,58 +467,148 @@ func (c *Container) Build(verb, payload string) error {
 		"PWD=/root",
 		"PATH=/usr/local/sbin:/usr/local/bin:/usr/bin:/usr/bin/core_perl",
 	}
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = c.Stdout
+	cmd.Stderr = c.Stderr
 	cmd.Stdin = os.Stdin
 
-	if err := cmd.Run(); err != nil {
-		return err
-	}
+	err := c.runner.Run(cmd)
 
-	if verb != "ADD" {
+	if cleanup {
 		if err := c.cleanupBuildstep(); err != nil {
 			return err
 		}
 	}
-	return nil
+	return err
 }
 
-func (c *Container) run(payload string) (*exec.Cmd, error) {
-	if err := c.prepareBuildstep(payload); err != nil {
+// shell wraps the payload into the interpreter set by SHELL.
+func (c *Container) shell(payload string) string {
+	if len(c.Shell) == 0 {
+		return payload
+	}
+	return parser.Quote(append(append([]string{}, c.Shell...), payload))
+}
+
+// run prepares a build step executing payload as the given user. Build steps
+// of an empty user run as root.
+func (c *Container) run(ctx context.Context, payload, user string) (*exec.Cmd, error) {
+	runAs, err := c.runAs(user)
+	if err != nil {
 		return nil, err
 	}
+	if err := c.prepareBuildstep(payload, user); err != nil {
+		return nil, err
+	}
+	mountPoints, err := c.missingMountPoints()
+	if err != nil {
+		return nil, err
+	}
+	c.mountPoints = append(c.mountPoints, mountPoints...)
 
 	params := make([]string, 0)
 	params = append(params, "--quiet", fmt.Sprintf("--directory=%s", c.Path))
 	for _, bind := range c.Binds {
 		params = append(params, fmt.Sprintf("--bind=%s", bind))
 	}
+	for _, env := range append(append([]string{}, c.BuildArgs...), c.Env...) {
+		params = append(params, fmt.Sprintf("--setenv=%s", env))
+	}
+	if user != "" {
+		params = append(params, fmt.Sprintf("--user=%s", runAs))
+		params = append(params, fmt.Sprintf("--bind-ro=%s/%s:/run/systemd/resolve/resolv.conf", c.Path, buildResolvConf))
+	}
+	for _, m := range c.Mounts {
+		bind := "--bind"
+		if m.ReadOnly {
+			bind = "--bind-ro"
+		}
+		params = append(params, fmt.Sprintf("%s=%s:%s", bind, m.Source, m.Target))
+		if m.Env != "" {
+			params = append(params, fmt.Sprintf("--setenv=%s", m.Env))
+		}
+	}
 	params = append(params, fmt.Sprintf("/%s", c.Buildstep))
 
-	return exec.Command("/usr/bin/systemd-nspawn", params...), nil
+	cmd := exec.CommandContext(ctx, "/usr/bin/systemd-nspawn", params...)
+	// nspawn stops the container on SIGTERM, it is only killed if it hangs
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = stopTimeout
+	return cmd, nil
 }
 
-func (c *Container) add(payload string) (*exec.Cmd, error) {
-	paths := strings.Split(payload, " ")
-	if len(paths) < 2 {
-		return nil, fmt.Errorf("Failed to add: %s", payload)
+// missingMountPoints returns the targets of the mounts and their parent
+// directories which don't exist in the container yet, innermost first. nspawn
+// creates them, so they are removed after the build step.
+func (c *Container) missingMountPoints() ([]string, error) {
+	missing := []string{}
+	for _, m := range c.Mounts {
+		target, err := fileutil.SecureJoin(c.Path, m.Target)
+		if err != nil {
+			return nil, err
+		}
+		for p := target; len(p) > len(c.Path); p = path.Dir(p) {
+			if _, err := os.Lstat(p); err == nil {
+				break
+			}
+			missing = append(missing, p)
+		}
 	}
-	return exec.Command("cp", paths[0], fmt.Sprintf("%s%s", c.Path, paths[1])), nil
+	return missing, nil
 }
 
-func (c *Container) enable(payload string) (*exec.Cmd, error) {
-	return c.run(fmt.Sprintf("systemctl enable %s", payload))
+func (c *Container) enable(ctx context.Context, payload string) (*exec.Cmd, error) {
+	return c.run(ctx, fmt.Sprintf("systemctl enable %s", payload), "")
 }
 
-func (c *Container) pkg(payload string) (*exec.Cmd, error) {
-	return c.run(fmt.Sprintf("pacman -S --noconfirm %s", payload))
+// pkg refreshes the package index and installs the packages with the package
+// manager of the image.
+func (c *Container) pkg(ctx context.Context, payload string) (*exec.Cmd, error) {
+	m := c.PkgManager
+	if m == nil {
+		var err error
+		if m, err = pkgmgr.Detect(c.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	packages, err := parser.SplitWords(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(packages) == 0 {
+		return nil, fmt.Errorf("PKG requires at least one package")
+	}
+
+	// the downloads are kept if a cache is mounted
+	cached := false
+	for _, mount := range c.Mounts {
+		cached = cached || mount.Target == m.CacheDir
+	}
+	return c.run(ctx, m.Script(packages, cached), "")
 }
 
-func (c *Container) prepareBuildstep(payload string) error {
+func (c *Container) prepareBuildstep(payload, user string) error {
 	if err := c.replaceMachineId(strings.Replace(uuid.New(), "-", "", -1)); err != nil {
 		return fmt.Errorf("Couldn't set machine-id for temporary build container. %v", err)
 	}
-	if err := c.createBuildstep(payload); err != nil {
+	if c.Workdir != "" {
+		workdir, err := fileutil.SecureJoin(c.Path, c.Workdir)
+		if err != nil {
+			return fmt.Errorf("Couldn't create working directory %s. %v", c.Workdir, err)
+		}
+		if err := os.MkdirAll(workdir, 0755); err != nil {
+			return fmt.Errorf("Couldn't create working directory %s. %v", c.Workdir, err)
+		}
+	}
+	if user != "" {
+		resolv := fmt.Sprintf("%s/%s", c.Path, buildResolvConf)
+		if err := ioutil.WriteFile(resolv, []byte(buildResolvContent), 0644); err != nil {
+			return fmt.Errorf("Couldn't create resolv.conf for temporary build container. %v", err)
+		}
+	}
+	if err := c.createBuildstep(payload, user); err != nil {
 		return fmt.Errorf("Couldn't buildstep for temporary build container. %v", err)
 	}
 
@@ -337,6 +624,16 @@ func (c *Container) cleanupBuildstep() error {
 		return fmt.Errorf("Couldn't remove buildstep for temporary build container. %v", err)
 	}
 
+	if err := os.Remove(fmt.Sprintf("%s/%s", c.Path, buildResolvConf)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Couldn't remove resolv.conf of temporary build container. %v", err)
+	}
+
+	// mount points are empty, directories the build step filled are kept
+	for _, p := range c.mountPoints {
+		os.Remove(p)
+	}
+	c.mountPoints = nil
+
 	return nil
 }
 
@@ -369,9 +666,11 @@ func (c *Container) replaceMachineId(machineId string) error {
 
 type buildstep struct {
 	Payload string
+	Workdir string
+	Root    bool
 }
 
-func (c *Container) createBuildstep(payload string) error {
+func (c *Container) createBuildstep(payload, user string) error {
 	file := fmt.Sprintf("%s/%s", c.Path, c.Buildstep)
 	f, err := os.Create(file)
 	if err != nil {
@@ -392,9 +691,14 @@ func (c *Container) createBuildstep(payload string) error {
 	if err != nil {
 		return err
 	}
-	return tmpl.Execute(f, buildstep{
-		payload,
-	})
+	step := buildstep{
+		Payload: payload,
+		Root:    user == "",
+	}
+	if c.Workdir != "" {
+		step.Workdir = parser.Quote([]string{c.Workdir})
+	}
+	return tmpl.Execute(f, step)
 }
 
 func (c *Container) removeBuildstep() error {
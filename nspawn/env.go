@@ -0,0 +1,88 @@
+package nspawn
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/giantswarm/conair/fileutil"
+)
+
+const (
+	environmentFile = "etc/environment"
+	// drop-in setting the environment of all services in the container
+	environmentDropIn = "etc/systemd/system.conf.d/10-conair-env.conf"
+)
+
+// persistEnv writes the environment of the container into the image, so it's
+// available to login shells (pam_env) and systemd services.
+func (c *Container) persistEnv() error {
+	if err := c.writeEnvironmentFile(); err != nil {
+		return fmt.Errorf("Couldn't write /%s. %v", environmentFile, err)
+	}
+	if err := c.writeEnvironmentDropIn(); err != nil {
+		return fmt.Errorf("Couldn't write /%s. %v", environmentDropIn, err)
+	}
+	return nil
+}
+
+func (c *Container) writeEnvironmentFile() error {
+	// symlinks of the image must not lead to the host
+	file, err := fileutil.SecureJoin(c.Path, environmentFile)
+	if err != nil {
+		return err
+	}
+
+	keys := map[string]bool{}
+	for _, env := range c.Env {
+		keys[envKey(env)] = true
+	}
+
+	// keep everything that isn't overwritten
+	lines := []string{}
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if line != "" && !keys[envKey(line)] {
+			lines = append(lines, line)
+		}
+	}
+
+	for _, env := range c.Env {
+		key, value := envKey(env), strings.TrimPrefix(env, envKey(env)+"=")
+		if strings.ContainsAny(value, " \t") {
+			value = fmt.Sprintf("%q", value)
+		}
+		lines = append(lines, fmt.Sprintf("%s=%s", key, value))
+	}
+
+	return ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+func (c *Container) writeEnvironmentDropIn() error {
+	file, err := fileutil.SecureJoin(c.Path, environmentDropIn)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	quoted := []string{}
+	for _, env := range c.Env {
+		env = strings.Replace(env, `\`, `\\`, -1)
+		env = strings.Replace(env, `"`, `\"`, -1)
+		quoted = append(quoted, fmt.Sprintf(`"%s"`, env))
+	}
+
+	content := fmt.Sprintf("[Manager]\nDefaultEnvironment=%s\n", strings.Join(quoted, " "))
+	return ioutil.WriteFile(file, []byte(content), 0644)
+}
+
+func envKey(env string) string {
+	return strings.SplitN(env, "=", 2)[0]
+}
@@ -0,0 +1,170 @@
+// Package oci holds the documents of the OCI image layout and of docker save
+// archives, which conair save writes and conair load reads.
+package oci
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/giantswarm/conair/image"
+)
+
+const (
+	LayoutVersion = "1.0.0"
+
+	MediaTypeIndex     = "application/vnd.oci.image.index.v1+json"
+	MediaTypeManifest  = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeConfig    = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayer     = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeLayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	// docker's media types, found in archives of docker save
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// AnnotationRefName is the name of an image in the index
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+	// AnnotationImageName is the full reference in layouts of docker save,
+	// which only have the tag as ref name
+	AnnotationImageName = "io.containerd.image.name"
+	// AnnotationLayer is the conair layer a layer of the image was saved from
+	AnnotationLayer = "com.giantswarm.conair.layer"
+)
+
+// Layout is the oci-layout file.
+type Layout struct {
+	Version string `json:"imageLayoutVersion"`
+}
+
+// Descriptor references a blob.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Platform of an image in an index.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// Index is the index.json of a layout, or a blob listing the images of
+// several platforms.
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// Manifest lists the config and layers of an image.
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Image is the configuration blob of an image.
+type Image struct {
+	Created      *time.Time `json:"created,omitempty"`
+	Architecture string     `json:"architecture"`
+	OS           string     `json:"os"`
+	Config       Config     `json:"config"`
+	RootFS       RootFS     `json:"rootfs"`
+	History      []History  `json:"history,omitempty"`
+}
+
+// Config is the runtime configuration of an image.
+type Config struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+}
+
+// RootFS lists the digests of the uncompressed layers.
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// History describes how a layer was created.
+type History struct {
+	Created    *time.Time `json:"created,omitempty"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	EmptyLayer bool       `json:"empty_layer,omitempty"`
+}
+
+// DockerManifest is an entry of the manifest.json of docker save archives.
+// Paths are relative to the archive.
+type DockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// FromConfig converts the configuration of a conair image.
+func FromConfig(c image.Config) Config {
+	config := Config{
+		User:       c.User,
+		Env:        c.Env,
+		Entrypoint: c.Entrypoint,
+		Cmd:        c.Cmd,
+		WorkingDir: c.Workdir,
+		Labels:     c.Labels,
+	}
+	for _, port := range c.ExposedPorts {
+		if config.ExposedPorts == nil {
+			config.ExposedPorts = map[string]struct{}{}
+		}
+		config.ExposedPorts[port] = struct{}{}
+	}
+	for _, volume := range c.Volumes {
+		if config.Volumes == nil {
+			config.Volumes = map[string]struct{}{}
+		}
+		config.Volumes[volume] = struct{}{}
+	}
+	return config
+}
+
+// ImageConfig converts the configuration to the one of a conair image.
+func (c Config) ImageConfig() image.Config {
+	config := image.Config{
+		Env:        c.Env,
+		Workdir:    c.WorkingDir,
+		User:       c.User,
+		Labels:     c.Labels,
+		Entrypoint: c.Entrypoint,
+		Cmd:        c.Cmd,
+	}
+	for port := range c.ExposedPorts {
+		config.ExposedPorts = append(config.ExposedPorts, port)
+	}
+	for volume := range c.Volumes {
+		config.Volumes = append(config.Volumes, volume)
+	}
+	// maps have no order
+	sort.Strings(config.ExposedPorts)
+	sort.Strings(config.Volumes)
+	return config
+}
+
+// BlobPath returns the path of a blob in a layout.
+func BlobPath(digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" || len(parts[1]) != 64 || strings.ContainsAny(parts[1], "/.") {
+		return "", fmt.Errorf("Unsupported digest %s", digest)
+	}
+	return "blobs/sha256/" + parts[1], nil
+}
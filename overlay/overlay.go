@@ -0,0 +1,561 @@
+package overlay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"code.google.com/p/go-uuid/uuid"
+
+	"github.com/giantswarm/conair/runner"
+)
+
+const (
+	// directory below the conair home where the layer data is stored
+	storageDir = ".cnr-overlay"
+	indexFile  = "volumes.json"
+	lockFile   = "lock"
+	emptyDir   = "empty"
+)
+
+var (
+	ErrPrerequisites = errors.New("prerequisites for driver not satisfied (overlayfs not supported?)")
+
+	// the kernel interface, replaced by tests
+	sysMount    = syscall.Mount
+	sysUnmount  = syscall.Unmount
+	isMounted   = mounted
+	isSupported = supported
+)
+
+// volume is a mounted stack of layers. Every volume owns a writable upper layer
+// on top of the read-only lower layers it was snapshotted from.
+type volume struct {
+	Uuid       string   `json:"uuid"`
+	ParentUuid string   `json:"parentUuid,omitempty"`
+	Upper      string   `json:"upper"`
+	Lowers     []string `json:"lowers,omitempty"`
+	ReadOnly   bool     `json:"readonly,omitempty"`
+}
+
+type Driver struct {
+	home    string
+	root    string
+	volumes map[string]*volume
+	// runner copies the upper layers of busy volumes
+	runner runner.Runner
+}
+
+func Init(home string) (*Driver, error) {
+	if !isSupported() {
+		return nil, ErrPrerequisites
+	}
+
+	d := &Driver{
+		home:    home,
+		root:    fmt.Sprintf("%s/%s", home, storageDir),
+		volumes: map[string]*volume{},
+		runner:  runner.Default,
+	}
+
+	if err := os.MkdirAll(fmt.Sprintf("%s/%s", d.root, emptyDir), 0700); err != nil {
+		return nil, err
+	}
+
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+
+	// mounts don't survive a reboot. parents are mounted before nested volumes.
+	names := d.names()
+	sort.Strings(names)
+	for _, name := range names {
+		if err := d.mount(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+// SetRunner sets the runner used to call cp.
+func (d *Driver) SetRunner(r runner.Runner) {
+	d.runner = r
+}
+
+func (d *Driver) Snapshot(from, to string, readonly bool) error {
+	fromPath := d.volumePath(from)
+	toPath := d.volumePath(to)
+
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	src, ok := d.volumes[from]
+	if !ok {
+		return fmt.Errorf("Volume does not exist: %s", fromPath)
+	}
+	if d.Exists(to) {
+		return fmt.Errorf("Snapshot already exists: %s", toPath)
+	}
+
+	lowers, err := d.freeze(from)
+	if err != nil {
+		return fmt.Errorf("Couldn't freeze volume %s: %v", fromPath, err)
+	}
+
+	upper, err := d.createLayer()
+	if err != nil {
+		return err
+	}
+
+	d.volumes[to] = &volume{
+		Uuid:       uuid.New(),
+		ParentUuid: src.Uuid,
+		Upper:      upper,
+		Lowers:     lowers,
+		ReadOnly:   readonly,
+	}
+	return d.commit(to)
+}
+
+func (d *Driver) Subvolume(vol string) error {
+	volPath := d.volumePath(vol)
+	if _, err := os.Stat(volPath); err == nil {
+		return fmt.Errorf("Subvolume already exists: %s", volPath)
+	}
+
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	upper, err := d.createLayer()
+	if err != nil {
+		return err
+	}
+
+	d.volumes[vol] = &volume{
+		Uuid:  uuid.New(),
+		Upper: upper,
+	}
+	return d.commit(vol)
+}
+
+func (d *Driver) Exists(vol string) bool {
+	_, err := os.Stat(d.volumePath(vol))
+	return err == nil
+}
+
+func (d *Driver) GetSubvolumeUuid(vol string) (string, error) {
+	v, ok := d.volumes[vol]
+	if !ok {
+		return "", fmt.Errorf("Volume does not exist: %s", d.volumePath(vol))
+	}
+	return v.Uuid, nil
+}
+
+func (d *Driver) GetSubvolumeParentUuid(vol string) (string, error) {
+	v, ok := d.volumes[vol]
+	if !ok {
+		return "", fmt.Errorf("Volume does not exist: %s", d.volumePath(vol))
+	}
+	if v.ParentUuid == "" {
+		return "-", nil
+	}
+	return v.ParentUuid, nil
+}
+
+func (d *Driver) GetLayerByUuid(uuid string) (string, error) {
+	for name, v := range d.volumes {
+		if v.Uuid == uuid && !strings.Contains(name, "/") {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("No layer found")
+}
+
+func (d *Driver) List() ([]string, error) {
+	names := []string{}
+	for name := range d.volumes {
+		if !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (d *Driver) Remove(vol string) error {
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, ok := d.volumes[vol]; !ok {
+		return fmt.Errorf("Volume does not exist: %s", d.volumePath(vol))
+	}
+	if err := d.remove(vol); err != nil {
+		return err
+	}
+	return d.prune()
+}
+
+func (d *Driver) remove(vol string) error {
+	// remove nested volumes first
+	for _, name := range d.names() {
+		if strings.HasPrefix(name, vol+"/") {
+			if err := d.remove(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := d.unmount(vol); err != nil {
+		return err
+	}
+	if err := os.Remove(d.volumePath(vol)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	delete(d.volumes, vol)
+	return d.save()
+}
+
+// Rename moves a volume and its nested volumes to a new mount point.
+func (d *Driver) Rename(from, to string) error {
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, ok := d.volumes[from]; !ok {
+		return fmt.Errorf("Volume does not exist: %s", d.volumePath(from))
+	}
+	if d.Exists(to) {
+		return fmt.Errorf("Volume already exists: %s", d.volumePath(to))
+	}
+
+	// nested volumes are unmounted before their parent
+	names := []string{}
+	for _, name := range d.names() {
+		if name == from || strings.HasPrefix(name, from+"/") {
+			names = append(names, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, name := range names {
+		if err := d.unmount(name); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(d.volumePath(from), d.volumePath(to)); err != nil {
+		return err
+	}
+	moved := []string{}
+	for _, name := range names {
+		newName := to + strings.TrimPrefix(name, from)
+		d.volumes[newName] = d.volumes[name]
+		delete(d.volumes, name)
+		moved = append(moved, newName)
+	}
+	if err := d.save(); err != nil {
+		return err
+	}
+
+	sort.Strings(moved)
+	for _, name := range moved {
+		if err := d.mount(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lock serializes changes of the index between conair processes (eg parallel
+// builds) and reloads the index. The returned function releases the lock.
+func (d *Driver) lock() (func(), error) {
+	f, err := os.OpenFile(fmt.Sprintf("%s/%s", d.root, lockFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := d.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// freeze returns a stack of read-only layers with the current content of the
+// volume. Idle volumes hand over their upper layer and get a fresh one, the
+// upper layer of busy volumes (eg running containers) is copied. Volumes
+// without changes keep their stack, otherwise every run of an image would add
+// a layer until the mount options overflow.
+func (d *Driver) freeze(vol string) ([]string, error) {
+	v := d.volumes[vol]
+
+	empty, err := isEmpty(d.diffPath(v.Upper))
+	if err != nil {
+		return nil, err
+	}
+	if empty {
+		return append([]string{}, v.Lowers...), nil
+	}
+	if v.ReadOnly {
+		// the upper layer can't change anymore, it's shared as it is
+		return append([]string{v.Upper}, v.Lowers...), nil
+	}
+
+	err = d.unmount(vol)
+	if err == syscall.EBUSY {
+		lower, err := d.createLayer()
+		if err != nil {
+			return nil, err
+		}
+		// cp -a keeps the whiteouts and xattrs overlayfs relies on
+		cmd := exec.Command("cp", "-a", fmt.Sprintf("%s/.", d.diffPath(v.Upper)), d.diffPath(lower))
+		if out, err := d.runner.CombinedOutput(cmd); err != nil {
+			return nil, fmt.Errorf("%v: %s", err, out)
+		}
+		return append([]string{lower}, v.Lowers...), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	upper, err := d.createLayer()
+	if err != nil {
+		return nil, err
+	}
+	v.Lowers = append([]string{v.Upper}, v.Lowers...)
+	v.Upper = upper
+
+	if err := d.commit(vol); err != nil {
+		return nil, err
+	}
+	return append([]string{}, v.Lowers...), nil
+}
+
+// commit persists the volume index and mounts the volume.
+func (d *Driver) commit(vol string) error {
+	if err := d.save(); err != nil {
+		return err
+	}
+	return d.mount(vol)
+}
+
+func (d *Driver) mount(vol string) error {
+	v := d.volumes[vol]
+	volPath := d.volumePath(vol)
+
+	if err := os.MkdirAll(volPath, 0755); err != nil {
+		return err
+	}
+	if isMounted(volPath) {
+		return nil
+	}
+
+	lowers := []string{}
+	for _, l := range v.Lowers {
+		lowers = append(lowers, d.diffPath(l))
+	}
+	if len(lowers) == 0 {
+		lowers = append(lowers, fmt.Sprintf("%s/%s", d.root, emptyDir))
+	}
+
+	var flags uintptr
+	if v.ReadOnly {
+		flags |= syscall.MS_RDONLY
+	}
+
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowers, ":"),
+		d.diffPath(v.Upper), d.workPath(v.Upper))
+	if err := sysMount("overlay", volPath, "overlay", flags, data); err != nil {
+		return fmt.Errorf("Couldn't mount volume %s: %v", volPath, err)
+	}
+	return nil
+}
+
+func (d *Driver) unmount(vol string) error {
+	volPath := d.volumePath(vol)
+	if !isMounted(volPath) {
+		return nil
+	}
+	return sysUnmount(volPath, 0)
+}
+
+// createLayer creates the directories of a new empty layer and returns its id.
+func (d *Driver) createLayer() (string, error) {
+	id := strings.Replace(uuid.New(), "-", "", -1)[:16]
+
+	if err := os.MkdirAll(d.diffPath(id), 0755); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(d.workPath(id), 0700); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// isEmpty reports whether a layer directory has no entries.
+func isEmpty(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+// prune removes all layers which aren't used by a volume anymore.
+func (d *Driver) prune() error {
+	used := map[string]bool{emptyDir: true}
+	for _, v := range d.volumes {
+		used[v.Upper] = true
+		for _, l := range v.Lowers {
+			used[l] = true
+		}
+	}
+
+	entries, err := ioutil.ReadDir(d.root)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || used[entry.Name()] {
+			continue
+		}
+		if err := os.RemoveAll(fmt.Sprintf("%s/%s", d.root, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Driver) load() error {
+	data, err := ioutil.ReadFile(d.indexPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	volumes := map[string]*volume{}
+	if err := json.Unmarshal(data, &volumes); err != nil {
+		return err
+	}
+	d.volumes = volumes
+	return nil
+}
+
+func (d *Driver) save() error {
+	data, err := json.MarshalIndent(d.volumes, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write atomically, a broken index would lose all volumes
+	tmp := d.indexPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.indexPath())
+}
+
+func (d *Driver) names() []string {
+	names := []string{}
+	for name := range d.volumes {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (d *Driver) volumePath(vol string) string {
+	return fmt.Sprintf("%s/%s", d.home, vol)
+}
+
+func (d *Driver) diffPath(id string) string {
+	return fmt.Sprintf("%s/%s/diff", d.root, id)
+}
+
+func (d *Driver) workPath(id string) string {
+	return fmt.Sprintf("%s/%s/work", d.root, id)
+}
+
+func (d *Driver) indexPath() string {
+	return fmt.Sprintf("%s/%s", d.root, indexFile)
+}
+
+// mounted reports whether a directory is a mount point. overlayfs reports the
+// device of the underlying filesystem, so the mount table has to be consulted.
+func mounted(dir string) bool {
+	data, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	dir = path.Clean(dir)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 4 && unescape(fields[4]) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// unescape decodes the octal escapes used in the mount table.
+func unescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				out = append(out, byte(n))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+// supported checks if the kernel knows about overlayfs.
+func supported() bool {
+	data, err := ioutil.ReadFile("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasSuffix(line, "\toverlay") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,265 @@
+package overlay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/giantswarm/conair/runner"
+)
+
+// fakeKernel records the mounts of a test instead of mounting.
+type fakeKernel struct {
+	mounts map[string]string
+	busy   map[string]bool
+}
+
+func setupKernel(t *testing.T) *fakeKernel {
+	k := &fakeKernel{mounts: map[string]string{}, busy: map[string]bool{}}
+	oldMount, oldUnmount, oldMounted, oldSupported := sysMount, sysUnmount, isMounted, isSupported
+	sysMount = func(source, target, fstype string, flags uintptr, data string) error {
+		if flags&syscall.MS_RDONLY != 0 {
+			data += ",ro"
+		}
+		k.mounts[target] = data
+		return nil
+	}
+	sysUnmount = func(target string, flags int) error {
+		if k.busy[target] {
+			return syscall.EBUSY
+		}
+		delete(k.mounts, target)
+		return nil
+	}
+	isMounted = func(dir string) bool {
+		_, ok := k.mounts[dir]
+		return ok
+	}
+	isSupported = func() bool { return true }
+	t.Cleanup(func() {
+		sysMount, sysUnmount, isMounted, isSupported = oldMount, oldUnmount, oldMounted, oldSupported
+	})
+	return k
+}
+
+func initDriver(t *testing.T, home string) *Driver {
+	d, err := Init(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// write changes a volume the way a write through its mount would.
+func write(t *testing.T, d *Driver, vol, file string) {
+	if err := ioutil.WriteFile(fmt.Sprintf("%s/%s", d.diffPath(d.volumes[vol].Upper), file), []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotStacksLayers(t *testing.T) {
+	k := setupKernel(t)
+	home := t.TempDir()
+	d := initDriver(t, home)
+
+	if err := d.Subvolume("base"); err != nil {
+		t.Fatal(err)
+	}
+	base := d.volumes["base"].Upper
+	if data := k.mounts[home+"/base"]; !strings.HasPrefix(data, fmt.Sprintf("lowerdir=%s/%s/%s,", home, storageDir, emptyDir)) {
+		t.Errorf("empty volume isn't mounted on the empty layer: %s", data)
+	}
+	write(t, d, "base", "a")
+
+	// the changes of base become a lower layer of both volumes
+	if err := d.Snapshot("base", "layer", true); err != nil {
+		t.Fatal(err)
+	}
+	if v := d.volumes["base"]; len(v.Lowers) != 1 || v.Lowers[0] != base || v.Upper == base {
+		t.Errorf("base wasn't frozen: %+v", v)
+	}
+	layer := d.volumes["layer"]
+	if len(layer.Lowers) != 1 || layer.Lowers[0] != base || !layer.ReadOnly {
+		t.Errorf("unexpected snapshot %+v", layer)
+	}
+	if !strings.HasSuffix(k.mounts[home+"/layer"], ",ro") {
+		t.Errorf("read-only snapshot is mounted writable: %s", k.mounts[home+"/layer"])
+	}
+	if uuid, _ := d.GetSubvolumeParentUuid("layer"); uuid != d.volumes["base"].Uuid {
+		t.Errorf("snapshot has parent %s", uuid)
+	}
+
+	// read-only volumes share their upper layer, unchanged ones their stack
+	write(t, d, "layer", "b")
+	if err := d.Snapshot("layer", "container", false); err != nil {
+		t.Fatal(err)
+	}
+	container := d.volumes["container"]
+	if len(container.Lowers) != 2 || container.Lowers[0] != layer.Upper || container.Lowers[1] != base {
+		t.Errorf("unexpected stack %v", container.Lowers)
+	}
+	if err := d.Snapshot("base", "unchanged", false); err != nil {
+		t.Fatal(err)
+	}
+	if v := d.volumes["unchanged"]; len(v.Lowers) != 1 || v.Lowers[0] != base {
+		t.Errorf("snapshot of an unchanged volume has stack %v", v.Lowers)
+	}
+	data := k.mounts[home+"/container"]
+	want := fmt.Sprintf("lowerdir=%s:%s,upperdir=%s,workdir=%s", d.diffPath(layer.Upper), d.diffPath(base),
+		d.diffPath(container.Upper), d.workPath(container.Upper))
+	if data != want {
+		t.Errorf("container is mounted with %s, want %s", data, want)
+	}
+}
+
+func TestSnapshotBusy(t *testing.T) {
+	k := setupKernel(t)
+	home := t.TempDir()
+	d := initDriver(t, home)
+	rec := &runner.Recorder{}
+	d.SetRunner(rec)
+
+	if err := d.Subvolume("web"); err != nil {
+		t.Fatal(err)
+	}
+	write(t, d, "web", "a")
+	upper := d.volumes["web"].Upper
+	k.busy[home+"/web"] = true
+
+	// the upper layer of a running container is copied
+	if err := d.Snapshot("web", "image", false); err != nil {
+		t.Fatal(err)
+	}
+	if d.volumes["web"].Upper != upper {
+		t.Error("busy volume got a new upper layer")
+	}
+	lowers := d.volumes["image"].Lowers
+	if len(lowers) != 1 || lowers[0] == upper {
+		t.Fatalf("unexpected stack %v", lowers)
+	}
+	want := fmt.Sprintf("cp -a %s/. %s", d.diffPath(upper), d.diffPath(lowers[0]))
+	if cmds := rec.Commands(); len(cmds) != 1 || cmds[0] != want {
+		t.Errorf("unexpected commands %v, want %s", cmds, want)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	k := setupKernel(t)
+	home := t.TempDir()
+	d := initDriver(t, home)
+
+	if err := d.Subvolume("base"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Subvolume("base/nested"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Rename("base", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+
+	// after a reboot the volumes are mounted again from the index
+	k.mounts = map[string]string{}
+	d = initDriver(t, home)
+	if names, _ := d.List(); len(names) != 1 || names[0] != "renamed" {
+		t.Errorf("unexpected volumes %v", names)
+	}
+	for _, vol := range []string{"renamed", "renamed/nested"} {
+		if _, ok := k.mounts[home+"/"+vol]; !ok {
+			t.Errorf("%s wasn't mounted", vol)
+		}
+	}
+	uuid, err := d.GetSubvolumeUuid("renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, err := d.GetLayerByUuid(uuid); err != nil || name != "renamed" {
+		t.Errorf("volume of uuid %s is %s %v", uuid, name, err)
+	}
+	if _, err := os.Stat(d.indexPath() + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary index was left: %v", err)
+	}
+}
+
+func TestRemovePrunes(t *testing.T) {
+	setupKernel(t)
+	home := t.TempDir()
+	d := initDriver(t, home)
+
+	if err := d.Subvolume("base"); err != nil {
+		t.Fatal(err)
+	}
+	write(t, d, "base", "a")
+	if err := d.Snapshot("base", "image", false); err != nil {
+		t.Fatal(err)
+	}
+	shared := d.volumes["image"].Lowers[0]
+	imageUpper := d.volumes["image"].Upper
+	baseUpper := d.volumes["base"].Upper
+
+	if err := d.Remove("base"); err != nil {
+		t.Fatal(err)
+	}
+	exists := func(id string) bool {
+		_, err := os.Stat(fmt.Sprintf("%s/%s/%s", home, storageDir, id))
+		return err == nil
+	}
+	if exists(baseUpper) {
+		t.Error("upper layer of the removed volume was kept")
+	}
+	if !exists(shared) || !exists(imageUpper) || !exists(emptyDir) {
+		t.Error("layers in use were removed")
+	}
+	if d.Exists("base") {
+		t.Error("mount point of the removed volume was kept")
+	}
+
+	if err := d.Remove("image"); err != nil {
+		t.Fatal(err)
+	}
+	if exists(shared) {
+		t.Error("unused layer was kept")
+	}
+}
+
+func TestLock(t *testing.T) {
+	setupKernel(t)
+	home := t.TempDir()
+	d1 := initDriver(t, home)
+	d2 := initDriver(t, home)
+
+	unlock, err := d1.lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- d2.Subvolume("second") }()
+
+	// the second process waits for the first one, and sees its changes
+	select {
+	case err := <-done:
+		t.Fatalf("volume was created while the index was locked: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	d1.volumes["first"] = &volume{Uuid: "1", Upper: emptyDir}
+	if err := d1.save(); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d2.volumes["first"]; !ok {
+		t.Error("index wasn't reloaded under the lock")
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	if s := unescape(`/var/lib/machines/a\040b`); s != "/var/lib/machines/a b" {
+		t.Errorf("unexpected path %s", s)
+	}
+}
@@ -0,0 +1,54 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseLabel parses the payload of a LABEL instruction. Both LABEL KEY=VALUE
+// ... and the legacy LABEL KEY VALUE are supported.
+func ParseLabel(payload string) (map[string]string, error) {
+	words, err := SplitWords(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("LABEL requires at least one label")
+	}
+
+	labels := map[string]string{}
+	if !strings.Contains(words[0], "=") {
+		if len(words) < 2 {
+			return nil, fmt.Errorf("LABEL requires a key and a value")
+		}
+		labels[words[0]] = strings.Join(words[1:], " ")
+		return labels, nil
+	}
+
+	for _, word := range words {
+		kv := strings.SplitN(word, "=", 2)
+		if len(kv) < 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid label %q, use KEY=VALUE", word)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
+
+// ParsePort normalizes a port of an EXPOSE instruction to port/protocol, eg
+// 80 to 80/tcp.
+func ParsePort(port string) (string, error) {
+	fields := strings.SplitN(strings.ToLower(port), "/", 2)
+	proto := "tcp"
+	if len(fields) > 1 {
+		proto = fields[1]
+	}
+	if proto != "tcp" && proto != "udp" {
+		return "", fmt.Errorf("invalid protocol %q in port %s, use tcp or udp", proto, port)
+	}
+	if n, err := strconv.Atoi(fields[0]); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid port %s", port)
+	}
+	return fields[0] + "/" + proto, nil
+}
@@ -0,0 +1,82 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// CopyArgs are the arguments of an ADD or COPY instruction.
+type CopyArgs struct {
+	Sources []string
+	Dest    string
+	Chown   string
+	// From is a stage or an image to copy from instead of the build context
+	From string
+}
+
+// ParseCopy parses the payload of an ADD or COPY instruction, eg
+// "--chown=http:http src/ /srv/", "--from=builder /app /app" or
+// `["my file", "/srv/"]`.
+func ParseCopy(payload string) (*CopyArgs, error) {
+	flags, rest, err := parseFlags(payload, "chown", "from")
+	if err != nil {
+		return nil, err
+	}
+
+	var args []string
+	if strings.HasPrefix(rest, "[") {
+		if err := json.Unmarshal([]byte(rest), &args); err != nil {
+			return nil, fmt.Errorf("invalid JSON form: %v", err)
+		}
+	} else if args, err = SplitWords(rest); err != nil {
+		return nil, err
+	}
+
+	if len(args) < 2 {
+		return nil, fmt.Errorf("requires at least one source and a destination")
+	}
+
+	c := &CopyArgs{
+		Sources: args[:len(args)-1],
+		Dest:    args[len(args)-1],
+	}
+	if chown := flags["chown"]; len(chown) > 0 {
+		c.Chown = chown[len(chown)-1]
+	}
+	if from := flags["from"]; len(from) > 0 {
+		c.From = from[len(from)-1]
+	}
+	return c, nil
+}
+
+// parseFlags splits leading --name=value flags from a payload. Only the given
+// flag names are accepted, flags may be repeated.
+func parseFlags(payload string, allowed ...string) (map[string][]string, string, error) {
+	flags := map[string][]string{}
+	rest := strings.TrimSpace(payload)
+
+	for strings.HasPrefix(rest, "--") {
+		fields := strings.SplitN(rest, " ", 2)
+		flag := strings.TrimPrefix(fields[0], "--")
+		if len(fields) > 1 {
+			rest = strings.TrimSpace(fields[1])
+		} else {
+			rest = ""
+		}
+
+		kv := strings.SplitN(flag, "=", 2)
+		known := false
+		for _, name := range allowed {
+			known = known || kv[0] == name
+		}
+		if !known {
+			return nil, "", fmt.Errorf("unknown flag --%s", kv[0])
+		}
+		if len(kv) < 2 || kv[1] == "" {
+			return nil, "", fmt.Errorf("flag --%s requires a value", kv[0])
+		}
+		flags[kv[0]] = append(flags[kv[0]], kv[1])
+	}
+	return flags, rest, nil
+}
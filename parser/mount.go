@@ -0,0 +1,147 @@
+package parser
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	MountSecret = "secret"
+	MountSSH    = "ssh"
+	MountCache  = "cache"
+
+	// SSHAgentTarget is where the ssh agent socket is bound by default
+	SSHAgentTarget = "/run/conair/ssh_agent"
+)
+
+// Mount is a --mount flag of a RUN instruction. The mount is only available
+// while the instruction runs and never becomes part of the layer.
+type Mount struct {
+	Type string
+	// ID of the secret or ssh agent given to conair build -secret or -ssh, or
+	// of the cache
+	ID     string
+	Target string
+	// Required mounts fail the build if conair build didn't get their source,
+	// otherwise the mount is skipped
+	Required bool
+	ReadOnly bool
+	// Uid, Gid and Mode of the mounted secret file or of a new cache
+	Uid  int
+	Gid  int
+	Mode uint32
+}
+
+// ParseRun splits the --mount flags from the payload of a RUN instruction, eg
+// "--mount=type=secret,id=npmrc,target=/root/.npmrc npm install" or
+// "--mount=type=cache,target=/root/.cache/go-build go build".
+func ParseRun(payload string) ([]Mount, string, error) {
+	flags, rest, err := parseFlags(payload, "mount")
+	if err != nil {
+		return nil, "", err
+	}
+	if rest == "" {
+		return nil, "", fmt.Errorf("requires a command")
+	}
+
+	mounts := []Mount{}
+	for _, flag := range flags["mount"] {
+		m, err := parseMount(flag)
+		if err != nil {
+			return nil, "", err
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, rest, nil
+}
+
+// parseMount parses the comma separated key=value options of a --mount flag.
+func parseMount(flag string) (Mount, error) {
+	m := Mount{}
+	for _, option := range strings.Split(flag, ",") {
+		kv := strings.SplitN(option, "=", 2)
+		key, value := strings.ToLower(kv[0]), ""
+		if len(kv) > 1 {
+			value = kv[1]
+		}
+
+		var err error
+		switch key {
+		case "type":
+			m.Type = value
+		case "id":
+			m.ID = value
+		case "target", "dst", "destination":
+			m.Target = value
+		case "required":
+			m.Required = true
+			if value != "" {
+				m.Required, err = strconv.ParseBool(value)
+			}
+		case "readonly", "ro":
+			m.ReadOnly = true
+			if value != "" {
+				m.ReadOnly, err = strconv.ParseBool(value)
+			}
+		case "uid":
+			m.Uid, err = strconv.Atoi(value)
+		case "gid":
+			m.Gid, err = strconv.Atoi(value)
+		case "mode":
+			var mode uint64
+			mode, err = strconv.ParseUint(value, 8, 32)
+			m.Mode = uint32(mode)
+		default:
+			return m, fmt.Errorf("unknown mount option %q", kv[0])
+		}
+		if err != nil {
+			return m, fmt.Errorf("invalid mount option %q", option)
+		}
+	}
+
+	switch m.Type {
+	case MountSecret:
+		if m.ID == "" && m.Target == "" {
+			return m, fmt.Errorf("secret mounts require an id or a target")
+		}
+		if m.ID == "" {
+			m.ID = path.Base(m.Target)
+		}
+		if m.Target == "" {
+			m.Target = "/run/secrets/" + m.ID
+		}
+		if m.Mode == 0 {
+			m.Mode = 0400
+		}
+	case MountSSH:
+		if m.ID == "" {
+			m.ID = "default"
+		}
+		if m.Target == "" {
+			m.Target = SSHAgentTarget
+		}
+	case MountCache:
+		if m.Target == "" {
+			return m, fmt.Errorf("cache mounts require a target")
+		}
+		// like docker, caches are identified by their target by default
+		if m.ID == "" {
+			m.ID = path.Clean(m.Target)
+		}
+		if m.Mode == 0 {
+			m.Mode = 0755
+		}
+	case "":
+		return m, fmt.Errorf("mount requires a type")
+	default:
+		return m, fmt.Errorf("unsupported mount type %q, use secret, ssh or cache", m.Type)
+	}
+
+	if !path.IsAbs(m.Target) {
+		return m, fmt.Errorf("mount target %s isn't an absolute path", m.Target)
+	}
+	m.Target = path.Clean(m.Target)
+	return m, nil
+}
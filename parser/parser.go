@@ -1,7 +1,10 @@
 package parser
 
 import (
-	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 )
@@ -9,68 +12,380 @@ import (
 type Command struct {
 	Verb    string
 	Payload string
+	// Args holds the arguments of the exec form, eg RUN ["a", "b"]
+	Args []string
+	JSON bool
+	Line int
+	// Mounts are the --mount flags of RUN, they aren't part of the payload
+	Mounts []Mount
+}
+
+// ShellPayload returns the payload as a shell command line. Arguments of the
+// exec form are quoted, so they reach the command unchanged.
+func (c Command) ShellPayload() string {
+	if !c.JSON {
+		return c.Payload
+	}
+	return Quote(c.Args)
+}
+
+// Stage is a FROM instruction and the instructions up to the next FROM.
+type Stage struct {
+	From string
+	// Name set with FROM <image> AS <name>
+	Name     string
+	Line     int
+	Commands []Command
 }
 
 type Conairfile struct {
-	From      string
 	Snapshots []string
 	Binds     []string
-	Commands  []Command
+	// ARG instructions before FROM, they can only be used in FROM
+	Args []Command
+	// Stages in order of appearance, the last one is the resulting image
+	Stages []*Stage
+}
+
+// Error is a syntax error in a Conairfile.
+type Error struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
 }
 
-func readFile(path string) ([]string, error) {
+// instruction is a single logical line of a Conairfile, after continuation
+// lines and heredocs have been resolved.
+type instruction struct {
+	verb    string
+	payload string
+	line    int
+}
+
+var (
+	// instructions which are executed as build steps
+	buildVerbs = map[string]bool{
+		"ADD":         true,
+		"COPY":        true,
+		"RUN":         true,
+		"RUN_NOCACHE": true,
+		"PKG":         true,
+		"ENABLE":      true,
+		"ENV":         true,
+	}
+
+	// instructions which configure the following build steps of a stage
+	stageVerbs = map[string]bool{
+		"WORKDIR":     true,
+		"USER":        true,
+		"SHELL":       true,
+		"LABEL":       true,
+		"EXPOSE":      true,
+		"VOLUME":      true,
+		"CMD":         true,
+		"ENTRYPOINT":  true,
+		"PKG_MANAGER": true,
+	}
+
+	// instructions which may appear before FROM
+	globalVerbs = map[string]bool{
+		"FROM":       true,
+		"ARG":        true,
+		"BIND":       true,
+		"SNAPSHOT":   true,
+		"MAINTAINER": true,
+	}
+
+	// instructions which accept the JSON exec form
+	execVerbs = map[string]bool{
+		"RUN":         true,
+		"RUN_NOCACHE": true,
+		"SHELL":       true,
+		"VOLUME":      true,
+		"CMD":         true,
+		"ENTRYPOINT":  true,
+	}
+
+	// Dockerfile instructions conair doesn't implement
+	unsupportedVerbs = map[string]bool{
+		"HEALTHCHECK": true,
+		"ONBUILD":     true,
+		"STOPSIGNAL":  true,
+	}
+)
+
+func Parse(path string) (*Conairfile, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	var lines []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
-	}
-	return lines, scanner.Err()
+	return ParseReader(path, file)
 }
 
-func Parse(path string) (*Conairfile, error) {
-	lines, err := readFile(path)
+// ParseReader parses a Conairfile. The name is used in error messages.
+func ParseReader(name string, r io.Reader) (*Conairfile, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	instructions, err := tokenize(name, string(data))
 	if err != nil {
 		return nil, err
 	}
 
 	d := &Conairfile{}
 	d.Snapshots = make([]string, 0)
+	var stage *Stage
+
+	for _, i := range instructions {
+		fail := func(format string, a ...interface{}) error {
+			return &Error{name, i.line, fmt.Sprintf(format, a...)}
+		}
+
+		if i.payload == "" {
+			return nil, fail("%s requires at least one argument", i.verb)
+		}
+
+		cmd := Command{
+			Verb:    i.verb,
+			Payload: i.payload,
+			Line:    i.line,
+		}
 
-	for _, line := range lines {
-		if !strings.HasPrefix(line, "#") {
-			l := strings.SplitN(line, " ", 2)
-			if len(l) > 1 {
-				cmd := Command{
-					Verb:    l[0],
-					Payload: l[1],
+		if cmd.Verb == "RUN" || cmd.Verb == "RUN_NOCACHE" {
+			mounts, rest, err := ParseRun(cmd.Payload)
+			if err != nil {
+				return nil, fail("%s %v", cmd.Verb, err)
+			}
+			cmd.Payload = rest
+			cmd.Mounts = mounts
+		}
+
+		if execVerbs[cmd.Verb] && strings.HasPrefix(cmd.Payload, "[") {
+			// like docker, anything that isn't valid JSON is run by the shell
+			var args []string
+			if err := json.Unmarshal([]byte(cmd.Payload), &args); err == nil {
+				if len(args) == 0 {
+					return nil, fail("%s requires at least one argument", i.verb)
 				}
+				cmd.Args = args
+				cmd.JSON = true
+			}
+		}
 
-				switch cmd.Verb {
-				case "FROM":
-					d.From = cmd.Payload
-				case "BIND":
-					d.Binds = append(d.Binds, strings.Split(cmd.Payload, " ")...)
-				case "SNAPSHOT":
-					d.Snapshots = append(d.Snapshots, strings.Split(cmd.Payload, " ")...)
-				case "ADD":
-					d.Commands = append(d.Commands, cmd)
-				case "RUN":
-					d.Commands = append(d.Commands, cmd)
-				case "RUN_NOCACHE":
-					d.Commands = append(d.Commands, cmd)
-				case "PKG":
-					d.Commands = append(d.Commands, cmd)
-				case "ENABLE":
-					d.Commands = append(d.Commands, cmd)
+		if stage == nil && !globalVerbs[cmd.Verb] && (buildVerbs[cmd.Verb] || stageVerbs[cmd.Verb]) {
+			return nil, fail("%s before FROM", cmd.Verb)
+		}
+
+		switch {
+		case cmd.Verb == "FROM":
+			fields := strings.Fields(cmd.Payload)
+			stage = &Stage{From: fields[0], Line: cmd.Line}
+			switch {
+			case len(fields) == 3 && strings.ToUpper(fields[1]) == "AS":
+				stage.Name = strings.ToLower(fields[2])
+				if !validStageName(stage.Name) {
+					return nil, fail("invalid stage name %q", fields[2])
+				}
+				if d.Stage(stage.Name) != nil {
+					return nil, fail("duplicate stage name %q", fields[2])
 				}
+			case len(fields) != 1:
+				return nil, fail("FROM requires an image and an optional AS <name>")
+			}
+			d.Stages = append(d.Stages, stage)
+		case cmd.Verb == "BIND":
+			d.Binds = append(d.Binds, strings.Fields(cmd.Payload)...)
+		case cmd.Verb == "SNAPSHOT":
+			d.Snapshots = append(d.Snapshots, strings.Fields(cmd.Payload)...)
+		case cmd.Verb == "MAINTAINER":
+			// deprecated and without effect
+		case cmd.Verb == "ADD" || cmd.Verb == "COPY":
+			args, err := ParseCopy(cmd.Payload)
+			if err != nil {
+				return nil, fail("%s %v", cmd.Verb, err)
+			}
+			if args.From != "" && cmd.Verb == "ADD" {
+				return nil, fail("ADD doesn't support --from, use COPY")
+			}
+			stage.Commands = append(stage.Commands, cmd)
+		case cmd.Verb == "ENV":
+			if _, err := ParseEnv(cmd.Payload); err != nil {
+				return nil, fail("%v", err)
 			}
+			stage.Commands = append(stage.Commands, cmd)
+		case cmd.Verb == "ARG":
+			if _, _, _, err := ParseArg(cmd.Payload); err != nil {
+				return nil, fail("%v", err)
+			}
+			if stage == nil {
+				d.Args = append(d.Args, cmd)
+			} else {
+				stage.Commands = append(stage.Commands, cmd)
+			}
+		case cmd.Verb == "USER":
+			if len(strings.Fields(cmd.Payload)) != 1 {
+				return nil, fail("USER requires exactly one user")
+			}
+			stage.Commands = append(stage.Commands, cmd)
+		case cmd.Verb == "PKG_MANAGER":
+			if len(strings.Fields(cmd.Payload)) != 1 {
+				return nil, fail("PKG_MANAGER requires exactly one package manager")
+			}
+			stage.Commands = append(stage.Commands, cmd)
+		case cmd.Verb == "SHELL":
+			if !cmd.JSON {
+				return nil, fail(`SHELL requires the JSON form, eg SHELL ["/bin/bash", "-c"]`)
+			}
+			stage.Commands = append(stage.Commands, cmd)
+		case cmd.Verb == "LABEL":
+			if _, err := ParseLabel(cmd.Payload); err != nil {
+				return nil, fail("%v", err)
+			}
+			stage.Commands = append(stage.Commands, cmd)
+		case stageVerbs[cmd.Verb]:
+			stage.Commands = append(stage.Commands, cmd)
+		case buildVerbs[cmd.Verb]:
+			stage.Commands = append(stage.Commands, cmd)
+		case unsupportedVerbs[cmd.Verb]:
+			return nil, fail("instruction %s is not supported", cmd.Verb)
+		default:
+			return nil, fail("unknown instruction %s", cmd.Verb)
 		}
 	}
+
+	if len(d.Stages) == 0 {
+		return nil, &Error{name, 1, "no FROM instruction found"}
+	}
 	return d, nil
 }
+
+// Stage returns the stage with the given name, or nil.
+func (d *Conairfile) Stage(name string) *Stage {
+	for _, stage := range d.Stages {
+		if stage.Name != "" && stage.Name == strings.ToLower(name) {
+			return stage
+		}
+	}
+	return nil
+}
+
+func validStageName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || i > 0 && strings.IndexByte("-_.", c) >= 0) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// tokenize splits a Conairfile into instructions. Comments and empty lines are
+// skipped, lines ending with a backslash are joined with the next one and
+// heredocs (<<EOF) are read until their delimiter.
+func tokenize(name, data string) ([]instruction, error) {
+	var (
+		instructions []instruction
+		current      *instruction
+	)
+
+	lines := strings.Split(strings.Replace(data, "\r\n", "\n", -1), "\n")
+	for n := 0; n < len(lines); n++ {
+		line := lines[n]
+		trimmed := strings.TrimSpace(line)
+
+		if current == nil {
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+
+			verb := strings.Fields(trimmed)[0]
+			current = &instruction{
+				verb: strings.ToUpper(verb),
+				line: n + 1,
+			}
+			line = strings.TrimPrefix(trimmed, verb)
+		} else if strings.HasPrefix(trimmed, "#") {
+			// comments within continuation lines are dropped
+			continue
+		}
+
+		// continue with the next line
+		right := strings.TrimRight(line, " \t")
+		if strings.HasSuffix(right, "\\") {
+			current.payload += strings.TrimSuffix(right, "\\")
+			if n == len(lines)-1 {
+				return nil, &Error{name, current.line, "unexpected end of file after line continuation"}
+			}
+			continue
+		}
+		current.payload += line
+		current.payload = strings.TrimSpace(current.payload)
+
+		if delim, strip, ok := heredoc(current.payload); ok {
+			body := []string{}
+			found := false
+			for n++; n < len(lines); n++ {
+				l := lines[n]
+				if strip {
+					l = strings.TrimLeft(l, "\t")
+				}
+				if strings.TrimRight(l, " \t") == delim {
+					found = true
+					break
+				}
+				body = append(body, l)
+			}
+			if !found {
+				return nil, &Error{name, current.line, fmt.Sprintf("heredoc %s is never terminated", delim)}
+			}
+
+			// a heredoc on its own is the script, otherwise it's passed to the
+			// command like in a shell
+			if strings.HasPrefix(current.payload, "<<") && len(strings.Fields(current.payload)) == 1 {
+				current.payload = strings.Join(body, "\n")
+			} else {
+				current.payload = strings.Join(append([]string{current.payload}, append(body, delim)...), "\n")
+			}
+		}
+
+		instructions = append(instructions, *current)
+		current = nil
+	}
+	return instructions, nil
+}
+
+// heredoc finds a heredoc marker like <<EOF, <<-EOF or <<"EOF" in an
+// instruction. It returns the delimiter and whether leading tabs are stripped.
+func heredoc(payload string) (string, bool, bool) {
+	for _, field := range strings.Fields(payload) {
+		if !strings.HasPrefix(field, "<<") || strings.HasPrefix(field, "<<<") {
+			continue
+		}
+
+		marker := strings.TrimPrefix(field, "<<")
+		strip := strings.HasPrefix(marker, "-")
+		marker = strings.Trim(strings.TrimPrefix(marker, "-"), `"'`)
+		if marker != "" {
+			return marker, strip, true
+		}
+	}
+	return "", false, false
+}
+
+// Quote joins arguments to a shell command line that passes every argument
+// unchanged.
+func Quote(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, "'"+strings.Replace(arg, "'", `'\''`, -1)+"'")
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,151 @@
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		commands []Command
+	}{
+		{
+			name:  "continuation",
+			input: "FROM base\nRUN echo a \\\n  && echo b\n",
+			commands: []Command{
+				{Verb: "RUN", Payload: "echo a   && echo b", Line: 2},
+			},
+		},
+		{
+			name:  "comments",
+			input: "# comment\nFROM base\n\n  # indented\nRUN echo a \\\n# inside\n  b\nENV A=1\n",
+			commands: []Command{
+				{Verb: "RUN", Payload: "echo a   b", Line: 5},
+				{Verb: "ENV", Payload: "A=1", Line: 8},
+			},
+		},
+		{
+			name:  "lower case",
+			input: "from base\nrun true\n",
+			commands: []Command{
+				{Verb: "RUN", Payload: "true", Line: 2},
+			},
+		},
+		{
+			name:  "crlf",
+			input: "FROM base\r\nRUN true\r\n",
+			commands: []Command{
+				{Verb: "RUN", Payload: "true", Line: 2},
+			},
+		},
+		{
+			name:  "heredoc script",
+			input: "FROM base\nRUN <<EOF\necho a\necho b\nEOF\nENV A=1\n",
+			commands: []Command{
+				{Verb: "RUN", Payload: "echo a\necho b", Line: 2},
+				{Verb: "ENV", Payload: "A=1", Line: 6},
+			},
+		},
+		{
+			name:  "heredoc argument",
+			input: "FROM base\nRUN cat > /f <<-\"END\"\n\tline\nEND\n",
+			commands: []Command{
+				{Verb: "RUN", Payload: "cat > /f <<-\"END\"\nline\nEND", Line: 2},
+			},
+		},
+		{
+			name:  "exec form",
+			input: "FROM base\nRUN [\"/bin/echo\", \"a b\"]\nCMD [\"/bin/true\"]\n",
+			commands: []Command{
+				{Verb: "RUN", Payload: `["/bin/echo", "a b"]`, Args: []string{"/bin/echo", "a b"}, JSON: true, Line: 2},
+				{Verb: "CMD", Payload: `["/bin/true"]`, Args: []string{"/bin/true"}, JSON: true, Line: 3},
+			},
+		},
+		{
+			name:  "invalid JSON is shell form",
+			input: "FROM base\nRUN [ -f /etc/os-release ]\n",
+			commands: []Command{
+				{Verb: "RUN", Payload: "[ -f /etc/os-release ]", Line: 2},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		d, err := ParseReader("Conairfile", strings.NewReader(test.input))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(d.Stages) != 1 || d.Stages[0].From != "base" {
+			t.Errorf("%s: unexpected stages %+v", test.name, d.Stages)
+			continue
+		}
+		for i := range d.Stages[0].Commands {
+			// RUN has empty mounts
+			if len(d.Stages[0].Commands[i].Mounts) == 0 {
+				d.Stages[0].Commands[i].Mounts = nil
+			}
+		}
+		if !reflect.DeepEqual(d.Stages[0].Commands, test.commands) {
+			t.Errorf("%s: got %+v, want %+v", test.name, d.Stages[0].Commands, test.commands)
+		}
+	}
+}
+
+func TestParseStages(t *testing.T) {
+	d, err := ParseReader("Conairfile", strings.NewReader("ARG V=1\nFROM base AS Build\nRUN make\nFROM base\nCOPY --from=build /out /\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Args) != 1 || d.Args[0].Payload != "V=1" {
+		t.Errorf("unexpected global args %+v", d.Args)
+	}
+	if len(d.Stages) != 2 || d.Stages[0].Name != "build" || d.Stages[1].Line != 4 {
+		t.Fatalf("unexpected stages %+v", d.Stages)
+	}
+	if d.Stage("BUILD") != d.Stages[0] || d.Stage("other") != nil {
+		t.Error("stages aren't found by name")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"", "Conairfile:1: no FROM instruction found"},
+		{"RUN true\n", "Conairfile:1: RUN before FROM"},
+		{"FROM base\n\nFOO bar\n", "Conairfile:3: unknown instruction FOO"},
+		{"FROM base\nHEALTHCHECK NONE\n", "Conairfile:2: instruction HEALTHCHECK is not supported"},
+		{"FROM base\nRUN\n", "Conairfile:2: RUN requires at least one argument"},
+		{"FROM base\nCMD []\n", "Conairfile:2: CMD requires at least one argument"},
+		{"FROM base\nRUN echo \\", "Conairfile:2: unexpected end of file after line continuation"},
+		{"FROM base\n# comment\nRUN <<EOF\necho\n", "Conairfile:3: heredoc EOF is never terminated"},
+		{"FROM base\nRUN a \\\n  b\nUSER a b\n", "Conairfile:4: USER requires exactly one user"},
+		{"FROM base\nSHELL /bin/sh -c\n", `Conairfile:2: SHELL requires the JSON form, eg SHELL ["/bin/bash", "-c"]`},
+		{"FROM base AS a\nFROM base AS A\n", `Conairfile:2: duplicate stage name "A"`},
+		{"FROM base AS -a\n", `Conairfile:1: invalid stage name "-a"`},
+		{"FROM base AS\n", "Conairfile:1: FROM requires an image and an optional AS <name>"},
+		{"FROM base\nADD --from=a / /\n", "Conairfile:2: ADD doesn't support --from, use COPY"},
+	}
+
+	for _, test := range tests {
+		_, err := ParseReader("Conairfile", strings.NewReader(test.input))
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%q: got error %v, want %s", test.input, err, test.err)
+			continue
+		}
+		if _, ok := err.(*Error); !ok {
+			t.Errorf("%q: error %T isn't positioned", test.input, err)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	if got := Quote([]string{"echo", "it's", "a b"}); got != `'echo' 'it'\''s' 'a b'` {
+		t.Errorf("unexpected quoting %s", got)
+	}
+}
@@ -0,0 +1,195 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Expand replaces $VAR, ${VAR}, ${VAR:-default} and ${VAR:+alternative} in s.
+// Unknown variables are replaced by an empty string, \$ is a literal dollar.
+func Expand(s string, lookup func(string) (string, bool)) string {
+	var out []byte
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == '$':
+			out = append(out, '$')
+			i++
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '{':
+			end := closingBrace(s[i:])
+			if end < 0 {
+				out = append(out, s[i:]...)
+				return string(out)
+			}
+			out = append(out, expandBraces(s[i+2:i+end], lookup)...)
+			i += end
+		case s[i] == '$' && i+1 < len(s) && isNameChar(s[i+1], true):
+			j := i + 1
+			for j < len(s) && isNameChar(s[j], false) {
+				j++
+			}
+			value, _ := lookup(s[i+1 : j])
+			out = append(out, value...)
+			i = j - 1
+		default:
+			out = append(out, s[i])
+		}
+	}
+	return string(out)
+}
+
+// closingBrace returns the index of the brace closing the ${ s starts with,
+// defaults may contain variables in braces themselves.
+func closingBrace(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			i++
+		case s[i] == '{':
+			depth++
+		case s[i] == '}':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func expandBraces(expr string, lookup func(string) (string, bool)) string {
+	if i := strings.Index(expr, ":-"); i >= 0 {
+		if value, ok := lookup(expr[:i]); ok && value != "" {
+			return value
+		}
+		return Expand(expr[i+2:], lookup)
+	}
+	if i := strings.Index(expr, ":+"); i >= 0 {
+		if value, ok := lookup(expr[:i]); ok && value != "" {
+			return Expand(expr[i+2:], lookup)
+		}
+		return ""
+	}
+	value, _ := lookup(expr)
+	return value
+}
+
+func isNameChar(c byte, first bool) bool {
+	if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+		return true
+	}
+	return !first && c >= '0' && c <= '9'
+}
+
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isNameChar(name[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// SplitWords splits s at whitespace. Single and double quotes group words and
+// are removed, a backslash escapes the next character.
+func SplitWords(s string) ([]string, error) {
+	var (
+		words   []string
+		word    []byte
+		inWord  bool
+		quote   byte
+		escaped bool
+	)
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			word = append(word, c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word = append(word, c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, string(word))
+				word = word[:0]
+				inWord = false
+			}
+		default:
+			word = append(word, c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return words, nil
+}
+
+// ParseEnv parses the payload of an ENV instruction to a list of KEY=VALUE
+// pairs. Both ENV KEY=VALUE ... and the legacy ENV KEY VALUE are supported.
+func ParseEnv(payload string) ([]string, error) {
+	words, err := SplitWords(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("ENV requires at least one variable")
+	}
+
+	if !strings.Contains(words[0], "=") {
+		payload = strings.TrimSpace(payload)
+		i := strings.IndexAny(payload, " \t")
+		if i < 0 || !validName(payload[:i]) {
+			return nil, fmt.Errorf("ENV requires a name and a value")
+		}
+		return []string{fmt.Sprintf("%s=%s", payload[:i], strings.TrimSpace(payload[i:]))}, nil
+	}
+
+	env := []string{}
+	for _, word := range words {
+		kv := strings.SplitN(word, "=", 2)
+		if len(kv) < 2 || !validName(kv[0]) {
+			return nil, fmt.Errorf("invalid ENV variable %q, use KEY=VALUE", word)
+		}
+		env = append(env, word)
+	}
+	return env, nil
+}
+
+// ParseArg parses the payload of an ARG instruction. It returns the name and
+// the default value if there is one.
+func ParseArg(payload string) (string, string, bool, error) {
+	words, err := SplitWords(payload)
+	if err != nil {
+		return "", "", false, err
+	}
+	if len(words) != 1 {
+		return "", "", false, fmt.Errorf("ARG requires exactly one variable")
+	}
+
+	kv := strings.SplitN(words[0], "=", 2)
+	if !validName(kv[0]) {
+		return "", "", false, fmt.Errorf("invalid ARG name %q", kv[0])
+	}
+	if len(kv) < 2 {
+		return kv[0], "", false, nil
+	}
+	return kv[0], kv[1], true, nil
+}
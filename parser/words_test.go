@@ -0,0 +1,76 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	vars := map[string]string{"A": "a", "B": "b", "EMPTY": ""}
+	lookup := func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+
+	tests := []struct {
+		in, out string
+	}{
+		{"$A", "a"},
+		{"$A/$B", "a/b"},
+		{"${A}x", "ax"},
+		{"$Ax", ""},
+		{"$UNKNOWN-", "-"},
+		{"${A:-def}", "a"},
+		{"${UNKNOWN:-def}", "def"},
+		{"${EMPTY:-def}", "def"},
+		{"${A:+alt}", "alt"},
+		{"${UNKNOWN:+alt}", ""},
+		{"${EMPTY:+alt}", ""},
+		{`\$A`, "$A"},
+		{`\${A}`, "${A}"},
+		{`${UNKNOWN:-\$A}`, "$A"},
+		{"${UNKNOWN:-${B}}", "b"},
+		{"${UNKNOWN:-${OTHER:-${A}}}/", "a/"},
+		{"${A:+${B}x}y", "bxy"},
+		{"${A", "${A"},
+		{"$", "$"},
+		{"a$1", "a$1"},
+	}
+	for _, test := range tests {
+		if out := Expand(test.in, lookup); out != test.out {
+			t.Errorf("Expand(%q) = %q, want %q", test.in, out, test.out)
+		}
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	tests := []struct {
+		in  string
+		env []string
+	}{
+		{"A=1", []string{"A=1"}},
+		{`A=1 B="two words" C=a\ b`, []string{"A=1", "B=two words", "C=a b"}},
+		{"A value with spaces", []string{"A=value with spaces"}},
+		{"A\tvalue", []string{"A=value"}},
+		{"A \t value\t", []string{"A=value"}},
+	}
+	for _, test := range tests {
+		env, err := ParseEnv(test.in)
+		if err != nil || !reflect.DeepEqual(env, test.env) {
+			t.Errorf("ParseEnv(%q) = %q %v, want %q", test.in, env, err, test.env)
+		}
+	}
+
+	for _, in := range []string{"A", "1A=b", "-x y", `A="b`} {
+		if env, err := ParseEnv(in); err == nil {
+			t.Errorf("ParseEnv(%q) = %q, want an error", in, env)
+		}
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	words, err := SplitWords(`a "b c" 'd $e' f\ g` + "\th")
+	if err != nil || !reflect.DeepEqual(words, []string{"a", "b c", "d $e", "f g", "h"}) {
+		t.Errorf("unexpected words %q %v", words, err)
+	}
+}
@@ -0,0 +1,201 @@
+// Package pkgmgr knows how to install packages with the package managers of
+// the distributions conair builds images for.
+package pkgmgr
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/giantswarm/conair/fileutil"
+	"github.com/giantswarm/conair/parser"
+)
+
+// Manager is a package manager backend for PKG.
+type Manager struct {
+	Name string
+	// Env is exported before the commands run
+	Env []string
+	// Refresh updates the package index, Install is followed by the packages
+	Refresh string
+	Install string
+	// CacheDir is where downloaded packages (and for some managers the
+	// index) are kept. PKG mounts a cache there unless cache mounts are
+	// disabled.
+	CacheDir string
+	// KeepCache is appended to Install if the cache is mounted, for managers
+	// which remove their downloads otherwise
+	KeepCache string
+	// Clean removes files which don't belong into a layer, CleanCache
+	// additionally removes the downloads if no cache is mounted
+	Clean      string
+	CleanCache string
+}
+
+var managers = map[string]*Manager{
+	"pacman": {
+		Name:       "pacman",
+		Refresh:    "pacman -Sy --noconfirm",
+		Install:    "pacman -S --noconfirm",
+		CacheDir:   "/var/cache/pacman/pkg",
+		CleanCache: "rm -rf /var/cache/pacman/pkg/*",
+	},
+	"apt": {
+		Name: "apt",
+		Env:  []string{"DEBIAN_FRONTEND=noninteractive"},
+		// apt doesn't download into an empty cache without the partial dir
+		Refresh:    "mkdir -p /var/cache/apt/archives/partial && apt-get update",
+		Install:    "apt-get install -y --no-install-recommends",
+		CacheDir:   "/var/cache/apt/archives",
+		KeepCache:  "-o APT::Keep-Downloaded-Packages=true -o Binary::apt::APT::Keep-Downloaded-Packages=true",
+		Clean:      "rm -rf /var/lib/apt/lists/*",
+		CleanCache: "apt-get clean",
+	},
+	"dnf": {
+		Name:       "dnf",
+		Refresh:    "dnf makecache",
+		Install:    "dnf install -y --setopt=install_weak_deps=False",
+		CacheDir:   "/var/cache/dnf",
+		KeepCache:  "--setopt=keepcache=True",
+		CleanCache: "dnf clean all",
+	},
+	"zypper": {
+		Name:       "zypper",
+		Refresh:    "zypper --non-interactive refresh",
+		Install:    "zypper --non-interactive install --no-recommends",
+		CacheDir:   "/var/cache/zypp",
+		CleanCache: "zypper --non-interactive clean --all",
+	},
+	"apk": {
+		Name:       "apk",
+		Refresh:    "apk update",
+		Install:    "apk add",
+		CacheDir:   "/var/cache/apk",
+		KeepCache:  "--cache-dir /var/cache/apk",
+		CleanCache: "rm -rf /var/cache/apk/*",
+	},
+}
+
+// distributions maps the ID (or ID_LIKE) of os-release to a package manager.
+var distributions = map[string]string{
+	"arch":        "pacman",
+	"archarm":     "pacman",
+	"manjaro":     "pacman",
+	"endeavouros": "pacman",
+	"debian":      "apt",
+	"ubuntu":      "apt",
+	"fedora":      "dnf",
+	"rhel":        "dnf",
+	"centos":      "dnf",
+	"rocky":       "dnf",
+	"almalinux":   "dnf",
+	"suse":        "zypper",
+	"opensuse":    "zypper",
+	"sles":        "zypper",
+	"alpine":      "apk",
+}
+
+// Get returns the package manager with the given name.
+func Get(name string) (*Manager, error) {
+	if m, ok := managers[strings.ToLower(name)]; ok {
+		return m, nil
+	}
+	return nil, fmt.Errorf("Unknown package manager %s. Please use one of %s.", name, strings.Join(Names(), ", "))
+}
+
+// Names returns the names of all package managers.
+func Names() []string {
+	names := []string{}
+	for name := range managers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Detect finds the package manager of the root filesystem from its
+// os-release. Images without os-release which have pacman are treated as
+// archlinux, like conair always did.
+func Detect(root string) (*Manager, error) {
+	for _, file := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		// os-release is usually a symlink, resolved within the image
+		path, err := fileutil.SecureJoin(root, file)
+		if err != nil {
+			return nil, err
+		}
+		release, err := readOSRelease(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ids := append([]string{release["ID"]}, strings.Fields(release["ID_LIKE"])...)
+		for _, id := range ids {
+			// eg opensuse-leap or opensuse-tumbleweed
+			id = strings.SplitN(strings.ToLower(id), "-", 2)[0]
+			if name, ok := distributions[id]; ok {
+				return managers[name], nil
+			}
+		}
+		return nil, fmt.Errorf("Couldn't find a package manager for %s. Please set one with PKG_MANAGER.", release["ID"])
+	}
+
+	if _, err := os.Stat(root + "/usr/bin/pacman"); err == nil {
+		return managers["pacman"], nil
+	}
+	return nil, fmt.Errorf("Couldn't detect the distribution of the image. Please set a package manager with PKG_MANAGER.")
+}
+
+// Script returns the shell commands which install the packages. cached tells
+// whether a cache is mounted at CacheDir.
+func (m *Manager) Script(packages []string, cached bool) string {
+	install := m.Install
+	if cached && m.KeepCache != "" {
+		install += " " + m.KeepCache
+	}
+	steps := []string{m.Refresh, install + " " + parser.Quote(packages)}
+	if m.Clean != "" {
+		steps = append(steps, m.Clean)
+	}
+	if !cached && m.CleanCache != "" {
+		steps = append(steps, m.CleanCache)
+	}
+
+	script := ""
+	for _, env := range m.Env {
+		script += "export " + env + "\n"
+	}
+	return script + strings.Join(steps, " && ")
+}
+
+// readOSRelease parses the KEY=value lines of an os-release file.
+func readOSRelease(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	release := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) < 2 {
+			continue
+		}
+		value := kv[1]
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		release[kv[0]] = value
+	}
+	return release, scanner.Err()
+}
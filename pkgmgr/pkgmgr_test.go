@@ -0,0 +1,172 @@
+package pkgmgr
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+var releases = map[string]string{
+	"debian": `PRETTY_NAME="Debian GNU/Linux 12 (bookworm)"
+NAME="Debian GNU/Linux"
+VERSION_ID="12"
+ID=debian
+`,
+	"ubuntu": `NAME="Ubuntu"
+VERSION_ID="24.04"
+ID=ubuntu
+ID_LIKE=debian
+`,
+	"mint": `NAME="Linux Mint"
+ID=linuxmint
+ID_LIKE="ubuntu debian"
+`,
+	"fedora": `NAME="Fedora Linux"
+VERSION_ID=40
+ID=fedora
+`,
+	"rocky": `NAME="Rocky Linux"
+ID="rocky"
+ID_LIKE="rhel centos fedora"
+`,
+	"opensuse": `NAME="openSUSE Leap"
+VERSION="15.6"
+ID="opensuse-leap"
+ID_LIKE="suse opensuse"
+`,
+	"tumbleweed": `# comments are ignored
+NAME='openSUSE Tumbleweed'
+ID='opensuse-tumbleweed'
+`,
+	"alpine": `NAME="Alpine Linux"
+ID=alpine
+VERSION_ID=3.20.0
+`,
+	"arch": `NAME="Arch Linux"
+ID=arch
+BUILD_ID=rolling
+`,
+	"gentoo": `NAME=Gentoo
+ID=gentoo
+`,
+}
+
+func writeRelease(t *testing.T, root, file, release string) {
+	if err := os.MkdirAll(root+"/etc", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(root+"/usr/lib", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(root+file, []byte(release), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		release, manager string
+	}{
+		{"debian", "apt"},
+		{"ubuntu", "apt"},
+		{"mint", "apt"},
+		{"fedora", "dnf"},
+		{"rocky", "dnf"},
+		{"opensuse", "zypper"},
+		{"tumbleweed", "zypper"},
+		{"alpine", "apk"},
+		{"arch", "pacman"},
+	}
+	for _, test := range tests {
+		root := t.TempDir()
+		writeRelease(t, root, "/etc/os-release", releases[test.release])
+		m, err := Detect(root)
+		if err != nil || m.Name != test.manager {
+			t.Errorf("%s: got %v %v, want %s", test.release, m, err, test.manager)
+		}
+	}
+
+	root := t.TempDir()
+	writeRelease(t, root, "/etc/os-release", releases["gentoo"])
+	if _, err := Detect(root); err == nil || !strings.Contains(err.Error(), "gentoo") {
+		t.Errorf("unknown distribution: %v", err)
+	}
+}
+
+func TestDetectFallback(t *testing.T) {
+	// /etc/os-release is an absolute symlink, resolved within the image
+	root := t.TempDir()
+	writeRelease(t, root, "/usr/lib/os-release", releases["alpine"])
+	if err := os.Symlink("/usr/lib/os-release", root+"/etc/os-release"); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := Detect(root); err != nil || m.Name != "apk" {
+		t.Errorf("symlinked os-release: %v %v", m, err)
+	}
+
+	root = t.TempDir()
+	writeRelease(t, root, "/usr/lib/os-release", releases["fedora"])
+	if m, err := Detect(root); err != nil || m.Name != "dnf" {
+		t.Errorf("/usr/lib/os-release: %v %v", m, err)
+	}
+
+	// old archlinux images have no os-release
+	root = t.TempDir()
+	if _, err := Detect(root); err == nil {
+		t.Error("empty image was detected")
+	}
+	if err := os.MkdirAll(root+"/usr/bin", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(root+"/usr/bin/pacman", nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := Detect(root); err != nil || m.Name != "pacman" {
+		t.Errorf("image with pacman: %v %v", m, err)
+	}
+}
+
+func TestScript(t *testing.T) {
+	packages := []string{"git", "a b"}
+	tests := []struct {
+		manager string
+		cached  bool
+		script  string
+	}{
+		{"pacman", true, "pacman -Sy --noconfirm && pacman -S --noconfirm 'git' 'a b'"},
+		{"pacman", false, "pacman -Sy --noconfirm && pacman -S --noconfirm 'git' 'a b' && rm -rf /var/cache/pacman/pkg/*"},
+		{"apt", true, "export DEBIAN_FRONTEND=noninteractive\n" +
+			"mkdir -p /var/cache/apt/archives/partial && apt-get update && " +
+			"apt-get install -y --no-install-recommends -o APT::Keep-Downloaded-Packages=true -o Binary::apt::APT::Keep-Downloaded-Packages=true 'git' 'a b' && " +
+			"rm -rf /var/lib/apt/lists/*"},
+		{"apt", false, "export DEBIAN_FRONTEND=noninteractive\n" +
+			"mkdir -p /var/cache/apt/archives/partial && apt-get update && " +
+			"apt-get install -y --no-install-recommends 'git' 'a b' && rm -rf /var/lib/apt/lists/* && apt-get clean"},
+		{"dnf", true, "dnf makecache && dnf install -y --setopt=install_weak_deps=False --setopt=keepcache=True 'git' 'a b'"},
+		{"dnf", false, "dnf makecache && dnf install -y --setopt=install_weak_deps=False 'git' 'a b' && dnf clean all"},
+		{"zypper", true, "zypper --non-interactive refresh && zypper --non-interactive install --no-recommends 'git' 'a b'"},
+		{"zypper", false, "zypper --non-interactive refresh && zypper --non-interactive install --no-recommends 'git' 'a b' && " +
+			"zypper --non-interactive clean --all"},
+		{"apk", true, "apk update && apk add --cache-dir /var/cache/apk 'git' 'a b'"},
+		{"apk", false, "apk update && apk add 'git' 'a b' && rm -rf /var/cache/apk/*"},
+	}
+	for _, test := range tests {
+		m, err := Get(test.manager)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if script := m.Script(packages, test.cached); script != test.script {
+			t.Errorf("%s cached=%v: got %q, want %q", test.manager, test.cached, script, test.script)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	if m, err := Get("APT"); err != nil || m.Name != "apt" {
+		t.Errorf("Get(APT) = %v %v", m, err)
+	}
+	if _, err := Get("yum"); err == nil || !strings.Contains(err.Error(), "apk, apt, dnf, pacman, zypper") {
+		t.Errorf("Get(yum) = %v", err)
+	}
+}
@@ -0,0 +1,258 @@
+// Package progress reports the events of a build. The build emits events, a
+// Reporter renders them as a readable progress view, only the final image ID
+// or one JSON object per line.
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Type string
+
+const (
+	// Stage starts a build stage
+	Stage Type = "stage"
+	// StepStart starts an instruction
+	StepStart Type = "step-start"
+	// CacheHit reports that the layer of a step is reused
+	CacheHit Type = "cache-hit"
+	// Output is a line written by a build step
+	Output Type = "output"
+	// StepEnd finishes a step with its duration and exit code
+	StepEnd Type = "step-end"
+	// Done finishes the build with the ID of the image
+	Done Type = "done"
+	// Failed aborts the build
+	Failed Type = "error"
+)
+
+// Event is a single build event. Fields which don't apply to the type of the
+// event are left empty.
+type Event struct {
+	Type  Type
+	Time  time.Time
+	Stage int
+	// Step counts the instructions of all stages, starting with 1
+	Step        int
+	Steps       int
+	Instruction string
+	Layer       string
+	// Cached is set on the StepEnd event of a reused layer
+	Cached bool
+	// Stream is stdout or stderr for Output events
+	Stream   string
+	Line     string
+	Duration time.Duration
+	ExitCode int
+	Image    string
+	Digest   string
+	Error    string
+}
+
+// MarshalJSON encodes the event with the duration in seconds. The exit code is
+// only part of StepEnd events.
+func (e Event) MarshalJSON() ([]byte, error) {
+	type event struct {
+		Type        Type      `json:"type"`
+		Time        time.Time `json:"time"`
+		Stage       int       `json:"stage"`
+		Step        int       `json:"step,omitempty"`
+		Steps       int       `json:"steps,omitempty"`
+		Instruction string    `json:"instruction,omitempty"`
+		Layer       string    `json:"layer,omitempty"`
+		Cached      bool      `json:"cached,omitempty"`
+		Stream      string    `json:"stream,omitempty"`
+		Line        *string   `json:"line,omitempty"`
+		Duration    *float64  `json:"duration,omitempty"`
+		ExitCode    *int      `json:"exitCode,omitempty"`
+		Image       string    `json:"image,omitempty"`
+		Digest      string    `json:"digest,omitempty"`
+		Error       string    `json:"error,omitempty"`
+	}
+	out := event{
+		Type:        e.Type,
+		Time:        e.Time,
+		Stage:       e.Stage,
+		Step:        e.Step,
+		Steps:       e.Steps,
+		Instruction: e.Instruction,
+		Layer:       e.Layer,
+		Cached:      e.Cached,
+		Stream:      e.Stream,
+		Image:       e.Image,
+		Digest:      e.Digest,
+		Error:       e.Error,
+	}
+	if e.Type == Output {
+		// empty lines are output as well
+		out.Line = &e.Line
+	}
+	if e.Type == StepEnd || e.Type == Done {
+		seconds := e.Duration.Seconds()
+		out.Duration = &seconds
+	}
+	if e.Type == StepEnd {
+		out.ExitCode = &e.ExitCode
+	}
+	return json.Marshal(out)
+}
+
+// Reporter renders build events. Reporters are safe for concurrent use, the
+// output of a step arrives from stdout and stderr at the same time.
+type Reporter interface {
+	Report(e Event)
+}
+
+// NewReporter returns the reporter for a -progress mode: text, json or quiet.
+func NewReporter(mode string, stdout, stderr io.Writer) (Reporter, error) {
+	switch mode {
+	case "text", "":
+		return &text{out: stdout, err: stderr}, nil
+	case "json":
+		return &jsonReporter{enc: json.NewEncoder(stdout)}, nil
+	case "quiet":
+		return &quiet{out: stdout, err: stderr}, nil
+	}
+	return nil, fmt.Errorf("Unknown progress mode %s. Please use text, json or quiet.", mode)
+}
+
+// text is the readable progress view.
+type text struct {
+	mu  sync.Mutex
+	out io.Writer
+	err io.Writer
+}
+
+func (t *text) Report(e Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch e.Type {
+	case Stage:
+		fmt.Fprintf(t.out, "Stage %d: %s\n", e.Stage, e.Instruction)
+	case StepStart:
+		fmt.Fprintf(t.out, "Step %d/%d: %s\n", e.Step, e.Steps, e.Instruction)
+	case CacheHit:
+		fmt.Fprintf(t.out, " ---> %s (cached)\n", short(e.Layer))
+	case Output:
+		if e.Stream == "stderr" {
+			fmt.Fprintln(t.err, e.Line)
+		} else {
+			fmt.Fprintln(t.out, e.Line)
+		}
+	case StepEnd:
+		switch {
+		case e.ExitCode != 0:
+			fmt.Fprintf(t.out, " ---> failed with exit code %d after %s\n", e.ExitCode, round(e.Duration))
+		case e.Layer != "" && !e.Cached:
+			fmt.Fprintf(t.out, " ---> %s (%s)\n", short(e.Layer), round(e.Duration))
+		}
+	case Done:
+		fmt.Fprintf(t.out, "Built %s (%s) in %s\n", e.Image, short(e.Digest), round(e.Duration))
+	}
+	// errors are printed by the command
+}
+
+// jsonReporter writes one JSON object per event.
+type jsonReporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (j *jsonReporter) Report(e Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.enc.Encode(e)
+}
+
+// quiet only prints the ID of the image. The output of a failed step is
+// printed to stderr.
+type quiet struct {
+	mu     sync.Mutex
+	out    io.Writer
+	err    io.Writer
+	output bytes.Buffer
+}
+
+func (q *quiet) Report(e Event) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	switch e.Type {
+	case StepStart:
+		q.output.Reset()
+	case Output:
+		fmt.Fprintln(&q.output, e.Line)
+	case StepEnd:
+		if e.ExitCode != 0 {
+			q.output.WriteTo(q.err)
+		}
+	case Done:
+		fmt.Fprintln(q.out, e.Digest)
+	}
+}
+
+// Writer returns a writer which reports every line written to it as an Output
+// event based on e. Close reports an incomplete last line.
+func Writer(r Reporter, e Event, stream string) io.WriteCloser {
+	e.Type = Output
+	e.Stream = stream
+	return &lineWriter{r: r, e: e}
+}
+
+type lineWriter struct {
+	r   Reporter
+	e   Event
+	buf []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.report(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) Close() error {
+	if len(w.buf) > 0 {
+		w.report(string(w.buf))
+		w.buf = nil
+	}
+	return nil
+}
+
+func (w *lineWriter) report(line string) {
+	e := w.e
+	e.Time = time.Now()
+	e.Line = strings.TrimSuffix(line, "\r")
+	w.r.Report(e)
+}
+
+// short abbreviates layer hashes and digests.
+func short(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func round(d time.Duration) time.Duration {
+	if d < time.Second {
+		return d - d%time.Millisecond
+	}
+	return d - d%(100*time.Millisecond)
+}
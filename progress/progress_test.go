@@ -0,0 +1,131 @@
+package progress
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+// build returns the events of a build with a cached and a failing step.
+func build() []Event {
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+	return []Event{
+		{Type: Stage, Time: at(0), Stage: 0, Instruction: "FROM base"},
+		{Type: StepStart, Time: at(0), Step: 1, Steps: 3, Instruction: "ENV A=1"},
+		{Type: CacheHit, Time: at(0), Step: 1, Layer: "0123456789abcdef0123"},
+		{Type: StepEnd, Time: at(0), Step: 1, Layer: "0123456789abcdef0123", Cached: true},
+		{Type: StepStart, Time: at(1), Step: 2, Steps: 3, Instruction: "RUN make"},
+		{Type: Output, Time: at(2), Step: 2, Stream: "stdout", Line: "building"},
+		{Type: Output, Time: at(2), Step: 2, Stream: "stdout", Line: ""},
+		{Type: Output, Time: at(3), Step: 2, Stream: "stderr", Line: "warning"},
+		{Type: StepEnd, Time: at(4), Step: 2, Layer: "fedcba9876543210fedc", Duration: 1500 * time.Millisecond},
+		{Type: StepStart, Time: at(4), Step: 3, Steps: 3, Instruction: "RUN false"},
+		{Type: Output, Time: at(5), Step: 3, Stream: "stderr", Line: "failed"},
+		{Type: StepEnd, Time: at(5), Step: 3, Duration: 500500 * time.Microsecond, ExitCode: 1},
+		{Type: Done, Time: at(6), Image: "app", Digest: "sha256:00112233445566778899", Duration: 6 * time.Second},
+		{Type: Failed, Time: at(6), Error: "Line 3: exit status 1"},
+	}
+}
+
+func report(t *testing.T, mode string) (string, string) {
+	var stdout, stderr bytes.Buffer
+	r, err := NewReporter(mode, &stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range build() {
+		r.Report(e)
+	}
+	return stdout.String(), stderr.String()
+}
+
+func TestJSON(t *testing.T) {
+	stdout, stderr := report(t, "json")
+	golden := `{"type":"stage","time":"2026-10-18T12:00:00Z","stage":0,"instruction":"FROM base"}
+{"type":"step-start","time":"2026-10-18T12:00:00Z","stage":0,"step":1,"steps":3,"instruction":"ENV A=1"}
+{"type":"cache-hit","time":"2026-10-18T12:00:00Z","stage":0,"step":1,"layer":"0123456789abcdef0123"}
+{"type":"step-end","time":"2026-10-18T12:00:00Z","stage":0,"step":1,"layer":"0123456789abcdef0123","cached":true,"duration":0,"exitCode":0}
+{"type":"step-start","time":"2026-10-18T12:00:01Z","stage":0,"step":2,"steps":3,"instruction":"RUN make"}
+{"type":"output","time":"2026-10-18T12:00:02Z","stage":0,"step":2,"stream":"stdout","line":"building"}
+{"type":"output","time":"2026-10-18T12:00:02Z","stage":0,"step":2,"stream":"stdout","line":""}
+{"type":"output","time":"2026-10-18T12:00:03Z","stage":0,"step":2,"stream":"stderr","line":"warning"}
+{"type":"step-end","time":"2026-10-18T12:00:04Z","stage":0,"step":2,"layer":"fedcba9876543210fedc","duration":1.5,"exitCode":0}
+{"type":"step-start","time":"2026-10-18T12:00:04Z","stage":0,"step":3,"steps":3,"instruction":"RUN false"}
+{"type":"output","time":"2026-10-18T12:00:05Z","stage":0,"step":3,"stream":"stderr","line":"failed"}
+{"type":"step-end","time":"2026-10-18T12:00:05Z","stage":0,"step":3,"duration":0.5005,"exitCode":1}
+{"type":"done","time":"2026-10-18T12:00:06Z","stage":0,"duration":6,"image":"app","digest":"sha256:00112233445566778899"}
+{"type":"error","time":"2026-10-18T12:00:06Z","stage":0,"error":"Line 3: exit status 1"}
+`
+	if stdout != golden {
+		t.Errorf("unexpected JSON events\n%s\nwant\n%s", stdout, golden)
+	}
+	if stderr != "" {
+		t.Errorf("JSON events wrote to stderr: %q", stderr)
+	}
+}
+
+func TestText(t *testing.T) {
+	stdout, stderr := report(t, "text")
+	golden := `Stage 0: FROM base
+Step 1/3: ENV A=1
+ ---> 0123456789ab (cached)
+Step 2/3: RUN make
+building
+
+ ---> fedcba987654 (1.5s)
+Step 3/3: RUN false
+ ---> failed with exit code 1 after 500ms
+Built app (001122334455) in 6s
+`
+	if stdout != golden {
+		t.Errorf("unexpected output\n%s\nwant\n%s", stdout, golden)
+	}
+	if stderr != "warning\nfailed\n" {
+		t.Errorf("unexpected stderr %q", stderr)
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	stdout, stderr := report(t, "quiet")
+	if stdout != "sha256:00112233445566778899\n" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+	// only the output of the failed step
+	if stderr != "failed\n" {
+		t.Errorf("unexpected stderr %q", stderr)
+	}
+
+	if _, err := NewReporter("fancy", nil, nil); err == nil {
+		t.Error("unknown mode was accepted")
+	}
+}
+
+type recorder []Event
+
+func (r *recorder) Report(e Event) {
+	*r = append(*r, e)
+}
+
+func TestWriter(t *testing.T) {
+	r := &recorder{}
+	w := Writer(r, Event{Step: 2}, "stderr")
+	fmt.Fprint(w, "one\r\ntw")
+	fmt.Fprint(w, "o\n\nthr")
+	if len(*r) != 3 {
+		t.Fatalf("unexpected events before Close %+v", *r)
+	}
+	w.Close()
+
+	lines := []string{"one", "two", "", "thr"}
+	if len(*r) != len(lines) {
+		t.Fatalf("unexpected events %+v", *r)
+	}
+	for i, e := range *r {
+		if e.Type != Output || e.Stream != "stderr" || e.Step != 2 || e.Line != lines[i] || e.Time.IsZero() {
+			t.Errorf("unexpected event %+v", e)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+
+	"github.com/giantswarm/conair/runner"
 )
 
 var cmdPs = &Command{
@@ -16,14 +18,9 @@ var cmdPs = &Command{
 
 func runPs(args []string) (exit int) {
 
-	path, err := exec.LookPath("machinectl")
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "machinectl not found.")
-	}
-
 	args = append([]string{"list"}, args...)
 
-	output, err := exec.Command(path, args...).CombinedOutput()
+	output, err := runner.Default.CombinedOutput(exec.Command("machinectl", args...))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "machinectl failed: machinctl %v: %s (%s)", strings.Join(args, " "), output, err)
 	}
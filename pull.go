@@ -1,19 +1,137 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
-
+	"io"
 	"os"
+	"path/filepath"
 
+	"github.com/giantswarm/conair/archive"
 	"github.com/giantswarm/conair/btrfs"
-	"github.com/giantswarm/conair/nspawn"
+	"github.com/giantswarm/conair/config"
+	"github.com/giantswarm/conair/fetch"
+	"github.com/giantswarm/conair/hub"
+	"github.com/giantswarm/conair/image"
+	"github.com/giantswarm/conair/layer"
+	"github.com/giantswarm/conair/registry"
+	"github.com/giantswarm/conair/signature"
+	"github.com/giantswarm/conair/storage"
+)
+
+// downloadsDir below the home keeps downloads until they are extracted
+const downloadsDir = ".cnr-downloads"
+
+var (
+	flagPullInsecure bool
+	cmdPull          = &Command{
+		Name:    "pull",
+		Summary: "Pull an image (eg base)",
+		Usage:   "[-insecure] [<registry>/]<name>[:<tag>][@<digest>] [<image>]",
+		Run:     runPull,
+		Description: `Pull an image (eg base) from a registry
+
+The reference names the image in a registry of /etc/conair/config.json, or in
+the default registry. Without tag and digest the tag latest is pulled. A
+digest pins the image: pulls fail if the image or the tag changed. The image
+is named like the repository unless a name is given.
+
+Everything is downloaded and checked against its digest before the image is
+created. Images pushed from btrfs are received as btrfs send streams, only the
+volumes which aren't here already are fetched: pulling an image whose base
+image or build layers were pulled or pushed before only fetches the changes on
+top of them. Pulled layers go into the build cache.
+
+Repositories of the registry without index are fetched as a tarball of their
+root filesystem, <name>.tar.zst, .tar.xz, .tar.gz or .tar.bz2, the way images
+were published before. The tarball is checked against <tarball>.sha256 if the
+registry has it. Interrupted downloads are continued by the next pull.
+
+Images have to be signed by one of the keys in the trusted keys directory,
+/etc/conair/trusted-keys unless configured otherwise, for the pulled name and
+tag or tarball. The signature of the image document is checked before anything
+else is downloaded, the one of a tarball before it's extracted. -insecure
+pulls unsigned images and images signed by other keys.
+
+conair pull base
+conair pull local/nginx:1.27 nginx
+conair pull nginx@sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+`,
+	}
 )
 
-var cmdPull = &Command{
-	Name:        "pull",
-	Description: "Pull an image (eg base)",
-	Summary:     "Pull an image (eg base)",
-	Run:         runPull,
+func init() {
+	cmdPull.Flags.BoolVar(&flagPullInsecure, "insecure", false, "Pull images without verifying their signature")
+}
+
+// verifier checks the signatures of pulled files. A nil verifier doesn't.
+type verifier struct {
+	reg  *registry.Registry
+	keys []*signature.PublicKey
+	dir  string
+}
+
+// newVerifier reads the trusted keys of the configuration, or returns nil with
+// -insecure.
+func newVerifier(reg *registry.Registry, c *config.Config) (*verifier, error) {
+	if flagPullInsecure {
+		return nil, nil
+	}
+	keys, err := signature.ReadTrustedKeys(c.TrustedKeys)
+	if err != nil {
+		return nil, err
+	}
+	return &verifier{reg: reg, keys: keys, dir: c.TrustedKeys}, nil
+}
+
+// verify checks the signature of a file of the registry, r reads its content.
+// The signature has to be made for want: the name of a tarball, or the
+// reference of an image with its digest.
+func (v *verifier) verify(file, want string, r io.Reader) error {
+	if v == nil {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Not verifying the signature of %s.", file))
+		return nil
+	}
+	sig, err := v.reg.Signature(file)
+	if err == hub.ErrNotFound {
+		return fmt.Errorf("%s isn't signed. Please use -insecure if you trust registry %s anyway.", file, v.reg)
+	}
+	if err != nil {
+		return fmt.Errorf("Couldn't fetch signature of %s. %v", file, err)
+	}
+	s, err := signature.Verify(r, sig, v.keys)
+	if errors.Is(err, signature.ErrUntrusted) {
+		return fmt.Errorf("%v. Please add the public key to %s if you trust it.", err, v.dir)
+	}
+	if err != nil {
+		return fmt.Errorf("Signature of %s is invalid. %v", file, err)
+	}
+	if !signedFor(s.File(), want) {
+		return fmt.Errorf("Signature of %s is made for %s, not for %s.", file, s.File(), want)
+	}
+	fmt.Printf("Verified signature of %s by key %s (%s).\n", file, signature.KeyID(s.Key.ID), filepath.Base(s.Key.File))
+	return nil
+}
+
+// signedFor reports whether a signature made for file is one for want. Images
+// are signed with the registry and tag they were pushed with: the registry
+// isn't compared, hosts name it differently, and the tag only if it's pulled.
+func signedFor(file, want string) bool {
+	if file == want {
+		return true
+	}
+	signed, err := registry.ParseReference(file)
+	wanted, werr := registry.ParseReference(want)
+	if err != nil || werr != nil || wanted.Digest == "" {
+		return false
+	}
+	signed.Registry = ""
+	if wanted.Tag == "" {
+		signed.Tag = ""
+	}
+	return signed == wanted
 }
 
 func runPull(args []string) (exit int) {
@@ -22,33 +140,338 @@ func runPull(args []string) (exit int) {
 		return 1
 	}
 
-	image := args[0]
+	ref, err := registry.ParseReference(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
 
 	var newImage string
 	if len(args) > 1 {
 		newImage = args[1]
 	} else {
-		newImage = image
+		newImage = ref.Name
+	}
+
+	reg, c, err := initRegistry(ref.Registry)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't find registry.", err)
+		return 1
+	}
+	v, err := newVerifier(reg, c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't read trusted keys.", err)
+		return 1
 	}
 
-	fs, err := btrfs.Init(home)
+	fs, err := initStorage()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Couldn't populate filesystem for conair.", err)
 		return 1
 	}
 
-	err = fs.Subvolume(newImage)
+	// repositories without index have a tarball of the latest image
+	digest, err := reg.Resolve(ref)
+	img := &registry.Image{Manifest: image.New(newImage, image.SourcePull)}
+	if err == hub.ErrNotFound && ref.Digest == "" && ref.Tag == registry.DefaultTag {
+		err = nil
+	} else if err == hub.ErrNotFound {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Registry %s doesn't have %s.", reg, ref.Name))
+		return 1
+	} else if err == nil {
+		var data []byte
+		if img, data, err = reg.Image(digest); err == nil {
+			want := registry.Reference{Name: ref.Name, Tag: ref.Tag, Digest: digest}
+			err = v.verify(registry.BlobFile(digest), want.String(), bytes.NewReader(data))
+		}
+	}
 	if err != nil {
-		fmt.Fprintln(os.Stderr, fmt.Sprintf("Couldn't create subvolume for image %s.", newImage), err)
+		fmt.Fprintln(os.Stderr, "Couldn't fetch image.", err)
 		return 1
 	}
 
-	err = nspawn.FetchImage(image, newImage, hub, home)
+	var vol string
+	d, ok := fs.(*btrfs.Driver)
+	switch {
+	case digest == "":
+		vol, err = pullTarball(reg, v, fs, ref.Name, newImage)
+	case ok && len(img.Volumes) > 0:
+		vol, err = receiveVolumes(d, reg, img, newImage)
+	case img.RootFS != nil:
+		vol, err = extractRootFS(fs, reg, img, newImage)
+	default:
+		err = fmt.Errorf("It's stored as btrfs send streams, which need the btrfs storage driver.")
+	}
 	if err != nil {
-		_ = fs.Remove(newImage)
-		fmt.Fprintln(os.Stderr, fmt.Sprintf("Couldn't create image %s.", newImage), err)
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Couldn't pull image %s.", ref), err)
+		return 1
+	}
+
+	// the image is here already under another name
+	tmpPath := layer.TempPath(newImage)
+	if vol != tmpPath && vol != newImage {
+		if err := fs.Snapshot(vol, tmpPath, true); err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't create filesystem for image.", err)
+			return 1
+		}
+	}
+	// an existing image is replaced once the new one is complete
+	if vol != newImage {
+		if fs.Exists(newImage) {
+			if err := fs.Remove(newImage); err != nil {
+				fs.Remove(tmpPath)
+				fmt.Fprintln(os.Stderr, "Couldn't remove existing image.", err)
+				return 1
+			}
+		}
+		if err := fs.Rename(tmpPath, newImage); err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't create filesystem for image.", err)
+			return 1
+		}
+	}
+
+	ref.Registry, ref.Digest = reg.String(), digest
+	if digest == "" {
+		ref.Tag = ""
+	}
+	m := img.Manifest
+	m.Name, m.Source, m.Origin = newImage, image.SourcePull, ref.String()
+	// the digest of the registry isn't trusted, builds are cached by it
+	if m.Digest, err = image.ComputeDigest(fmt.Sprintf("%s/%s", home, newImage)); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't compute digest of image.", err)
+		return 1
+	}
+	if err := m.Write(home); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't write manifest of image.", err)
 		return 1
 	}
 
+	fmt.Printf("Pulled %s as %s.\n", ref, newImage)
 	return 0
 }
+
+// receiveVolumes receives the volumes of an image which aren't here yet and
+// returns the volume of the image: the temporary volume of newImage if it was
+// received, or the volume which has it already. Volumes are here if a
+// subvolume has their uuid, or was received from them.
+func receiveVolumes(d *btrfs.Driver, reg *registry.Registry, img *registry.Image, newImage string) (string, error) {
+	subvolumes, err := d.ListSubvolumes()
+	if err != nil {
+		return "", err
+	}
+	local := map[btrfs.UUID]string{}
+	for _, s := range subvolumes {
+		local[s.UUID] = s.Path
+		if !s.ReceivedUUID.IsZero() {
+			local[s.ReceivedUUID] = s.Path
+		}
+	}
+
+	// everything below the topmost volume which is here is skipped
+	top, start := "", 0
+	for i := len(img.Volumes) - 1; i >= 0; i-- {
+		id, err := btrfs.ParseUUID(img.Volumes[i].UUID)
+		if err != nil {
+			return "", err
+		}
+		if vol, ok := local[id]; ok {
+			top, start = vol, i+1
+			fmt.Printf("Using %s.\n", vol)
+			break
+		}
+	}
+	if start == len(img.Volumes) {
+		return top, nil
+	}
+
+	// all streams are downloaded and verified before anything is received
+	dir, err := downloadDir()
+	if err != nil {
+		return "", err
+	}
+	streams := map[int]string{}
+	for i := start; i < len(img.Volumes); i++ {
+		v := img.Volumes[i]
+		fmt.Printf("Fetching %s.\n", v.Name)
+		if streams[i], err = reg.Download(v.Stream, dir, progressOutput()); err != nil {
+			return "", err
+		}
+		defer os.Remove(streams[i])
+	}
+
+	// volumes are received into a temporary volume, and moved out of it once
+	// they are complete. Base images which exist under their name already
+	// stay there until the pull is done.
+	tmp := layer.TempPath("pull")
+	if err := d.Subvolume(tmp); err != nil {
+		return "", err
+	}
+	defer d.Remove(tmp)
+
+	for i := start; i < len(img.Volumes); i++ {
+		v := img.Volumes[i]
+		received := fmt.Sprintf("%s/%s", tmp, v.Name)
+		if err := receiveVolume(d, streams[i], tmp); err != nil {
+			if d.Exists(received) {
+				d.Remove(received)
+			}
+			return "", err
+		}
+		top = received
+
+		switch {
+		case i == len(img.Volumes)-1:
+			tmpPath := layer.TempPath(newImage)
+			if err := d.Rename(received, tmpPath); err != nil {
+				return "", err
+			}
+			top = tmpPath
+		case layer.IsLayer(v.Name) && !d.Exists(v.Name):
+			// a layer built here with the same name is kept, the received
+			// one is removed with tmp
+			if err := d.Rename(received, v.Name); err != nil {
+				return "", err
+			}
+			if err := layer.MarkCreated(home, v.Name); err != nil {
+				return "", err
+			}
+			top = v.Name
+		case v.Manifest != nil && !d.Exists(v.Manifest.Name):
+			if err := d.Rename(received, v.Manifest.Name); err != nil {
+				return "", err
+			}
+			m := v.Manifest
+			m.Source, m.Origin = image.SourcePull, fmt.Sprintf("%s/%s", reg, v.Manifest.Name)
+			if m.Digest, err = image.ComputeDigest(fmt.Sprintf("%s/%s", home, v.Manifest.Name)); err != nil {
+				return "", err
+			}
+			if err := m.Write(home); err != nil {
+				return "", err
+			}
+			top = v.Manifest.Name
+		}
+	}
+	return top, nil
+}
+
+// receiveVolume receives a downloaded stream in dir.
+func receiveVolume(d *btrfs.Driver, stream, dir string) error {
+	f, err := os.Open(stream)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return d.Receive(f, dir)
+}
+
+// extractRootFS downloads the root filesystem tarball of an image and extracts
+// it into the temporary volume of newImage.
+func extractRootFS(fs storage.Driver, reg *registry.Registry, img *registry.Image, newImage string) (string, error) {
+	dir, err := downloadDir()
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Fetching %s.\n", img.Manifest.Name)
+	file, err := reg.Download(*img.RootFS, dir, progressOutput())
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file)
+	return extract(fs, file, newImage)
+}
+
+// extract extracts a downloaded tarball into the temporary volume of newImage.
+func extract(fs storage.Driver, file, newImage string) (string, error) {
+	tmpPath := layer.TempPath(newImage)
+	if err := fs.Subvolume(tmpPath); err != nil {
+		return "", err
+	}
+	if err := archive.ExtractFile(file, fmt.Sprintf("%s/%s", home, tmpPath)); err != nil {
+		fs.Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+// pullTarball fetches an image as a tarball of its root filesystem, which is
+// how images were published before registries had an index. The tarball is
+// checked against the checksum published next to it, <tarball>.sha256, and its
+// signature.
+func pullTarball(reg *registry.Registry, v *verifier, fs storage.Driver, name, newImage string) (string, error) {
+	h := reg.Hub()
+	file := ""
+	for _, ext := range archive.Extensions {
+		ok, err := h.Exists(name + ext)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			file = name + ext
+			break
+		}
+	}
+	if file == "" {
+		return "", fmt.Errorf("Registry %s doesn't have %s.", reg, name)
+	}
+
+	sum := ""
+	r, err := h.Get(file + ".sha256")
+	switch err {
+	case nil:
+		sum, err = fetch.ParseChecksum(r, file)
+		r.Close()
+		if err != nil {
+			return "", fmt.Errorf("Couldn't read checksum of %s. %v", file, err)
+		}
+	case hub.ErrNotFound:
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Registry %s has no checksum for %s, it isn't verified.", reg, file))
+	default:
+		return "", err
+	}
+
+	dir, err := downloadDir()
+	if err != nil {
+		return "", err
+	}
+	// the name keeps partial downloads of other hubs apart
+	dest := fmt.Sprintf("%s/%x-%s", dir, sha256.Sum256([]byte(h.String())), file)
+	fmt.Printf("Fetching %s.\n", file)
+	n, err := h.Download(file, dest, progressOutput())
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(dest)
+	if sum != "" {
+		if err := fetch.Verify(dest, sum); err != nil {
+			return "", fmt.Errorf("Checksum of %s doesn't match, the download is corrupt.", file)
+		}
+	}
+	fmt.Printf("Fetched %s. Downloaded %d bytes.\n", file, n)
+
+	f, err := os.Open(dest)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := v.verify(file, file, f); err != nil {
+		return "", err
+	}
+	return extract(fs, dest, newImage)
+}
+
+// downloadDir returns the directory downloads are stored in until they are
+// extracted. Interrupted downloads stay there and are continued by the next
+// pull.
+func downloadDir() (string, error) {
+	dir := fmt.Sprintf("%s/%s", home, downloadsDir)
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// progressOutput returns where download progress is drawn, stderr if it's a
+// terminal.
+func progressOutput() io.Writer {
+	if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		return os.Stderr
+	}
+	return nil
+}
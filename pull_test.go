@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/giantswarm/conair/image"
+	"github.com/giantswarm/conair/registry"
+)
+
+// setupRegistry configures a directory as the default registry local.
+func setupRegistry(t *testing.T, root string) *registry.Registry {
+	dir := t.TempDir()
+	writeFile(t, root+"/etc/conair/config.json", fmt.Sprintf(`{"defaultRegistry": "local", "registries": {"local": %q}}`, dir))
+	return registry.New("local", dir)
+}
+
+func TestPullDigest(t *testing.T) {
+	root, _ := setupRoot(t)
+	reg := setupRegistry(t, root)
+	createBaseImage(t, "base")
+	if exit := runPush([]string{"base", "base:1"}); exit != 0 {
+		t.Fatalf("push failed with %d", exit)
+	}
+
+	// the registry claims the digest of another image
+	digest, err := reg.Resolve(registry.Reference{Name: "base", Tag: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := reg.Image(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Manifest.Digest = "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	if digest, err = reg.PutImage(img); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Tag("base", "1", digest); err != nil {
+		t.Fatal(err)
+	}
+
+	old := flagPullInsecure
+	flagPullInsecure = true
+	defer func() { flagPullInsecure = old }()
+	if exit := runPull([]string{"base:1", "pulled"}); exit != 0 {
+		t.Fatalf("pull failed with %d", exit)
+	}
+	m, err := image.Read(home, "pulled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := image.ComputeDigest(path.Join(home, "pulled"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Digest != want {
+		t.Errorf("pulled image has digest %s of the registry, not %s", m.Digest, want)
+	}
+}
+
+func TestSignedFor(t *testing.T) {
+	const digest = "sha256:34a36f78dde70240ba1d3b10cfa9f2e2cc0f7b153d9927881faa49e908ab7a07"
+	const other = "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	tests := []struct {
+		file, want string
+		ok         bool
+	}{
+		{"base.tar.xz", "base.tar.xz", true},
+		{"other.tar.xz", "base.tar.xz", false},
+		{"base.tar.xz", "base.tar.gz", false},
+		{"", "base.tar.xz", false},
+		{"local/base:1@" + digest, "base:1@" + digest, true},
+		{"base:1@" + digest, "base:1@" + digest, true},
+		{"hub/base:1@" + digest, "base:1@" + digest, true},
+		{"local/base:1@" + digest, "base@" + digest, true},
+		{"local/base:1@" + digest, "base:2@" + digest, false},
+		{"local/base:1@" + digest, "base:latest@" + digest, false},
+		{"local/other:1@" + digest, "other:2@" + digest, false},
+		{"local/other:1@" + digest, "base:1@" + digest, false},
+		{"local/base:1@" + other, "base:1@" + digest, false},
+		{"local/base:1", "base:1@" + digest, false},
+		{"", "base:1@" + digest, false},
+		{"base.tar.xz", "base@" + digest, false},
+	}
+	for _, test := range tests {
+		if ok := signedFor(test.file, test.want); ok != test.ok {
+			t.Errorf("signedFor(%q, %q) = %v, want %v", test.file, test.want, ok, test.ok)
+		}
+	}
+}
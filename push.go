@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/giantswarm/conair/archive"
+	"github.com/giantswarm/conair/btrfs"
+	"github.com/giantswarm/conair/config"
+	"github.com/giantswarm/conair/image"
+	"github.com/giantswarm/conair/registry"
+)
+
+var cmdPush = &Command{
+	Name:    "push",
+	Summary: "Push an image to a registry",
+	Usage:   "<image> [[<registry>/]<name>[:<tag>]]",
+	Run:     runPush,
+	Description: `Push an image to a registry, from which conair pull fetches it
+
+The image is pushed to the default registry under its own name and the tag
+latest, unless a reference is given. Registries are configured in
+/etc/conair/config.json.
+
+With the btrfs storage driver images are pushed as btrfs send streams: the
+base image, the layers of the build and the image itself. Every stream only
+holds the changes to the one below, and streams the registry has already
+aren't pushed again. The pushed volumes are made read-only, builds and
+containers use writable snapshots of them anyway. Other storage drivers push a
+tarball of the root filesystem.
+
+conair push nginx
+conair push nginx local/nginx:1.27
+`,
+}
+
+// pushVolume is a volume of the image which is pushed.
+type pushVolume struct {
+	vol string
+	// manifest of the base image
+	manifest *image.Manifest
+}
+
+func runPush(args []string) (exit int) {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "Image name missing.")
+		return 1
+	}
+	name := args[0]
+	target := name
+	if len(args) > 1 {
+		target = args[1]
+	}
+	ref, err := registry.ParseReference(target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if ref.Digest != "" {
+		fmt.Fprintln(os.Stderr, "Images are pushed to a tag, the registry computes their digest.")
+		return 1
+	}
+	reg, _, err := initRegistry(ref.Registry)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't find registry.", err)
+		return 1
+	}
+
+	fs, err := initStorage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't populate filesystem for conair.", err)
+		return 1
+	}
+
+	if !fs.Exists(name) {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Image %s doesn't exist.", name))
+		return 1
+	}
+	// images of older versions get their manifest now
+	if _, err := image.Digest(home, name); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't compute digest of image.", err)
+		return 1
+	}
+	m, err := image.Read(home, name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't read manifest of image.", err)
+		return 1
+	}
+
+	img := &registry.Image{Version: registry.Version, Manifest: m}
+	if d, ok := fs.(*btrfs.Driver); ok {
+		img.Volumes, err = pushVolumes(d, reg, m)
+	} else {
+		img.RootFS, err = pushRootFS(reg, name)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't push image.", err)
+		return 1
+	}
+
+	// the tag comes last, pulls don't see the image before it's complete
+	digest, err := reg.PutImage(img)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't push image document.", err)
+		return 1
+	}
+	if err := reg.Tag(ref.Name, ref.Tag, digest); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't tag image.", err)
+		return 1
+	}
+
+	ref.Registry, ref.Digest = reg.String(), digest
+	fmt.Printf("Pushed %s.\n", ref)
+	return 0
+}
+
+// initRegistry returns the configured registry of the given name, or the
+// default registry, and the configuration.
+func initRegistry(name string) (*registry.Registry, *config.Config, error) {
+	c, err := config.Read(configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if name == "" {
+		name = c.DefaultRegistry
+	}
+	url, err := c.Registry(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return registry.New(name, url), c, nil
+}
+
+// pushVolumes pushes the send streams of an image: the image it is based on,
+// the layers of its last build stage and the image. Layers which aren't cached
+// anymore are left out, the stream of the image then has their changes.
+func pushVolumes(d *btrfs.Driver, reg *registry.Registry, m *image.Manifest) ([]registry.Volume, error) {
+	volumes := []pushVolume{}
+	if m.Parent != "" && d.Exists(m.Parent) {
+		if _, err := image.Digest(home, m.Parent); err == nil {
+			if pm, err := image.Read(home, m.Parent); err == nil {
+				volumes = append(volumes, pushVolume{vol: m.Parent, manifest: pm})
+			}
+		}
+	}
+	for _, l := range m.Layers {
+		if d.Exists(".cnr-" + l.Hash) {
+			volumes = append(volumes, pushVolume{vol: ".cnr-" + l.Hash})
+		}
+	}
+	volumes = append(volumes, pushVolume{vol: m.Name})
+
+	pushed := []registry.Volume{}
+	var parent *btrfs.Subvolume
+	for _, v := range volumes {
+		if err := d.SetReadOnly(v.vol); err != nil {
+			return nil, fmt.Errorf("Couldn't make %s read-only. %v", v.vol, err)
+		}
+		info, err := d.Info(v.vol)
+		if err != nil {
+			return nil, err
+		}
+
+		vol := registry.Volume{Name: v.vol, UUID: info.SendUUID().String(), Manifest: v.manifest}
+		parentVol := ""
+		if parent != nil {
+			vol.Parent, parentVol = parent.SendUUID().String(), parent.Path
+		}
+		if vol.Stream, err = pushStream(d, reg, v.vol, parentVol, registry.StreamFile(vol.UUID, vol.Parent)); err != nil {
+			return nil, fmt.Errorf("Couldn't push %s. %v", v.vol, err)
+		}
+		pushed = append(pushed, vol)
+		parent = info
+	}
+	return pushed, nil
+}
+
+// pushStream sends a volume to the registry unless it has its stream already.
+// The digest of the stream is stored next to it, so later pushes of the same
+// volume don't need to send it again to find out.
+func pushStream(d *btrfs.Driver, reg *registry.Registry, vol, parent, file string) (registry.Blob, error) {
+	h := reg.Hub()
+	b := registry.Blob{}
+	if r, err := h.Get(file + ".json"); err == nil {
+		err = json.NewDecoder(r).Decode(&b)
+		r.Close()
+		if err == nil && b.File == file {
+			fmt.Printf("%s exists on the registry.\n", vol)
+			return b, nil
+		}
+	}
+	b = registry.Blob{File: file}
+
+	// the stream is written to a file first, http needs its size
+	f, err := ioutil.TempFile("", "conair-push-")
+	if err != nil {
+		return b, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	fmt.Printf("Sending %s...\n", vol)
+	hash := sha256.New()
+	if err := d.Send(vol, parent, io.MultiWriter(f, hash)); err != nil {
+		return b, err
+	}
+	b.Digest = fmt.Sprintf("sha256:%x", hash.Sum(nil))
+	if b.Size, err = f.Seek(0, io.SeekCurrent); err != nil {
+		return b, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return b, err
+	}
+	if err := h.Put(file, f, b.Size); err != nil {
+		return b, err
+	}
+	fmt.Printf("Pushed %s. Uploaded %d bytes.\n", vol, b.Size)
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		return b, err
+	}
+	return b, h.Put(file+".json", bytes.NewReader(data), int64(len(data)))
+}
+
+// pushRootFS pushes a gzip compressed tarball of an image.
+func pushRootFS(reg *registry.Registry, name string) (*registry.Blob, error) {
+	f, err := ioutil.TempFile("", "conair-push-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	fmt.Printf("Packing %s...\n", name)
+	zw := gzip.NewWriter(f)
+	if err := archive.Diff(zw, "", fmt.Sprintf("%s/%s", home, name)); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	b, err := reg.PutBlob(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Pushed %s. Uploaded %d bytes.\n", name, b.Size)
+	return &b, nil
+}
@@ -0,0 +1,72 @@
+package registry
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultTag is pulled and pushed by references without tag and digest.
+const DefaultTag = "latest"
+
+var (
+	nameRegexp   = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*$`)
+	hostRegexp   = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(:[0-9]+)?$`)
+	tagRegexp    = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	digestRegexp = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// Reference names an image of a registry: [registry/]name[:tag][@digest].
+// The registry is one of the configuration file, which may be named by a
+// host and port, the digest the sha256 of the image document.
+type Reference struct {
+	Registry string
+	Name     string
+	Tag      string
+	Digest   string
+}
+
+// ParseReference parses a reference, eg hub/nginx:1.27,
+// localhost:5000/nginx or nginx@sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08.
+func ParseReference(s string) (Reference, error) {
+	ref := Reference{}
+	rest := s
+	if i := strings.Index(rest, "@"); i >= 0 {
+		ref.Digest, rest = rest[i+1:], rest[:i]
+		if !digestRegexp.MatchString(ref.Digest) {
+			return ref, fmt.Errorf("Invalid digest in %s, it has to be sha256:<64 hex digits>.", s)
+		}
+	}
+	hasRegistry := false
+	if i := strings.Index(rest, "/"); i >= 0 {
+		ref.Registry, rest, hasRegistry = rest[:i], rest[i+1:], true
+	}
+	if i := strings.Index(rest, ":"); i >= 0 {
+		ref.Tag, rest = rest[i+1:], rest[:i]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return ref, fmt.Errorf("Invalid tag in %s.", s)
+		}
+	}
+	ref.Name = rest
+	if !nameRegexp.MatchString(ref.Name) || (hasRegistry && !hostRegexp.MatchString(ref.Registry)) {
+		return ref, fmt.Errorf("Invalid reference %s. Please use [registry/]name[:tag][@sha256:digest] with lower case names.", s)
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = DefaultTag
+	}
+	return ref, nil
+}
+
+func (r Reference) String() string {
+	s := r.Name
+	if r.Registry != "" {
+		s = r.Registry + "/" + s
+	}
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
@@ -0,0 +1,60 @@
+package registry
+
+import (
+	"strings"
+	"testing"
+)
+
+const digest = "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		in  string
+		ref Reference
+	}{
+		{"nginx", Reference{Name: "nginx", Tag: "latest"}},
+		{"nginx:1.27", Reference{Name: "nginx", Tag: "1.27"}},
+		{"hub/nginx:1.27", Reference{Registry: "hub", Name: "nginx", Tag: "1.27"}},
+		{"my-image_2.x", Reference{Name: "my-image_2.x", Tag: "latest"}},
+		{"nginx@" + digest, Reference{Name: "nginx", Digest: digest}},
+		{"hub/nginx:1.27@" + digest, Reference{Registry: "hub", Name: "nginx", Tag: "1.27", Digest: digest}},
+		{"localhost:5000/nginx", Reference{Registry: "localhost:5000", Name: "nginx", Tag: "latest"}},
+		{"images.example.com:443/nginx:Stable_1", Reference{Registry: "images.example.com:443", Name: "nginx", Tag: "Stable_1"}},
+		{"localhost:5000/nginx@" + digest, Reference{Registry: "localhost:5000", Name: "nginx", Digest: digest}},
+	}
+	for _, test := range tests {
+		ref, err := ParseReference(test.in)
+		if err != nil || ref != test.ref {
+			t.Errorf("ParseReference(%q) = %+v %v, want %+v", test.in, ref, err, test.ref)
+			continue
+		}
+		if test.ref.Tag != DefaultTag && ref.String() != test.in {
+			t.Errorf("%+v is formatted as %s", ref, ref.String())
+		}
+	}
+
+	bad := []string{
+		"",
+		"Nginx",
+		"nginx:",
+		"nginx:-1",
+		"nginx:a/b",
+		"-nginx",
+		"ng..inx",
+		"a/b/c",
+		"/nginx",
+		"Hub/nginx",
+		"localhost:/nginx",
+		"localhost:port/nginx",
+		"nginx@",
+		"nginx@sha256:abc",
+		"nginx@sha512:" + strings.Repeat("a", 64),
+		"nginx@" + strings.ToUpper(digest),
+		"nginx@" + digest + "0",
+	}
+	for _, in := range bad {
+		if ref, err := ParseReference(in); err == nil {
+			t.Errorf("ParseReference(%q) = %+v, want an error", in, ref)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+// Package registry pulls and pushes images of a registry, a hub with an index
+// of tags per repository. Images are described by a JSON document which is
+// stored by its sha256, so a digest pins the document and the digests in it
+// pin the content of the image.
+//
+// The files of a registry are
+//
+//	<name>/index.json              the tags of a repository
+//	blobs/sha256/<hex>             image documents and root filesystem tarballs
+//	blobs/sha256/<hex>.minisig     signatures of image documents
+//	volumes/<uuid>.btrfs           btrfs send streams, see Volume
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/giantswarm/conair/fetch"
+	"github.com/giantswarm/conair/hub"
+	"github.com/giantswarm/conair/image"
+	"github.com/giantswarm/conair/signature"
+)
+
+// Version of the documents of a registry
+const Version = 1
+
+// Repository is the index.json of a repository, it maps tags to the digests of
+// image documents.
+type Repository struct {
+	Version int               `json:"version"`
+	Name    string            `json:"name"`
+	Tags    map[string]string `json:"tags"`
+}
+
+// Image is the document of a pushed image. Images pushed from btrfs have the
+// send streams of their volumes, others a tarball of their root filesystem.
+type Image struct {
+	Version  int             `json:"version"`
+	Manifest *image.Manifest `json:"manifest"`
+	// Volumes are the btrfs send streams the image is received from,
+	// bottom up: the image it's based on, the layers of its build and the
+	// image itself. Every stream but the first only holds the changes to
+	// the volume before it.
+	Volumes []Volume `json:"volumes,omitempty"`
+	RootFS  *Blob    `json:"rootfs,omitempty"`
+}
+
+// Blob is a file of the registry, which is verified by its digest.
+type Blob struct {
+	File   string `json:"file"`
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// Volume is a subvolume of a pushed image.
+type Volume struct {
+	// Name of the volume on the pushing host, btrfs receive creates the
+	// volume under this name
+	Name string `json:"name"`
+	// UUID identifies the volume in send streams. Hosts which have a
+	// volume of this uuid, or received one, don't need to fetch it again.
+	UUID string `json:"uuid"`
+	// Parent is the uuid of the volume the stream is a delta to
+	Parent string `json:"parent,omitempty"`
+	Stream Blob   `json:"stream"`
+	// Manifest of the base image
+	Manifest *image.Manifest `json:"manifest,omitempty"`
+}
+
+// Registry is a hub with the name it has in the configuration.
+type Registry struct {
+	name string
+	hub  *hub.Hub
+}
+
+func New(name, url string) *Registry {
+	return &Registry{name: name, hub: hub.New(url)}
+}
+
+func (r *Registry) String() string {
+	return r.name
+}
+
+// Hub returns the files of the registry.
+func (r *Registry) Hub() *hub.Hub {
+	return r.hub
+}
+
+// RepositoryFile returns the index of a repository.
+func RepositoryFile(name string) string {
+	return name + "/index.json"
+}
+
+// BlobFile returns the file of a content addressed blob.
+func BlobFile(digest string) string {
+	return "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+}
+
+// StreamFile returns the file of the send stream of a volume. Streams are
+// named by uuid, so pushes find the ones the registry has before sending them,
+// and are shared by all images which have the volume.
+func StreamFile(uuid, parent string) string {
+	if parent == "" {
+		return fmt.Sprintf("volumes/%s.btrfs", uuid)
+	}
+	return fmt.Sprintf("volumes/%s-%s.btrfs", uuid, parent)
+}
+
+// Repository reads the index of a repository. It returns hub.ErrNotFound if
+// the registry doesn't have it.
+func (r *Registry) Repository(name string) (*Repository, error) {
+	rd, err := r.hub.Get(RepositoryFile(name))
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	repo := &Repository{}
+	if err := json.Unmarshal(data, repo); err != nil {
+		return nil, fmt.Errorf("Couldn't parse index of %s: %v", name, err)
+	}
+	if repo.Version > Version {
+		return nil, fmt.Errorf("The index of %s has version %d, this conair supports up to %d.", name, repo.Version, Version)
+	}
+	return repo, nil
+}
+
+// Resolve returns the digest of the image document a reference points to.
+func (r *Registry) Resolve(ref Reference) (string, error) {
+	if ref.Tag == "" {
+		return ref.Digest, nil
+	}
+	repo, err := r.Repository(ref.Name)
+	if err != nil {
+		return "", err
+	}
+	digest, ok := repo.Tags[ref.Tag]
+	if !ok {
+		tags := []string{}
+		for tag := range repo.Tags {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		return "", fmt.Errorf("%s has no tag %s, it has %s.", ref.Name, ref.Tag, strings.Join(tags, ", "))
+	}
+	if !digestRegexp.MatchString(digest) {
+		return "", fmt.Errorf("The index of %s has an invalid digest for %s.", ref.Name, ref.Tag)
+	}
+	if ref.Digest != "" && ref.Digest != digest {
+		return "", fmt.Errorf("%s:%s is %s now, not %s.", ref.Name, ref.Tag, digest, ref.Digest)
+	}
+	return digest, nil
+}
+
+// Image reads an image document and verifies it against its digest. The
+// document is returned as well, signatures of the image sign it.
+func (r *Registry) Image(digest string) (*Image, []byte, error) {
+	if !digestRegexp.MatchString(digest) {
+		return nil, nil, fmt.Errorf("Invalid digest %s", digest)
+	}
+	rd, err := r.hub.Get(BlobFile(digest))
+	if err == hub.ErrNotFound {
+		return nil, nil, fmt.Errorf("The registry doesn't have image %s.", digest)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rd.Close()
+
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, nil, err
+	}
+	if d := fmt.Sprintf("sha256:%x", sha256.Sum256(data)); d != digest {
+		return nil, nil, fmt.Errorf("Digest of image %s doesn't match, it's %s.", digest, d)
+	}
+	img := &Image{}
+	if err := json.Unmarshal(data, img); err != nil {
+		return nil, nil, fmt.Errorf("Couldn't parse image %s: %v", digest, err)
+	}
+	if err := img.validate(); err != nil {
+		return nil, nil, fmt.Errorf("Image %s is invalid. %v", digest, err)
+	}
+	return img, data, nil
+}
+
+// SignatureFile returns the file of the signature of a file: the image
+// document of an image, or a tarball of repositories without index.
+func SignatureFile(file string) string {
+	return file + signature.Extension
+}
+
+// Signature reads the signature of a file. It returns hub.ErrNotFound if the
+// file isn't signed.
+func (r *Registry) Signature(file string) ([]byte, error) {
+	rd, err := r.hub.Get(SignatureFile(file))
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return ioutil.ReadAll(rd)
+}
+
+// PutSignature uploads the signature of a file.
+func (r *Registry) PutSignature(file string, sig []byte) error {
+	return r.hub.Put(SignatureFile(file), bytes.NewReader(sig), int64(len(sig)))
+}
+
+func (img *Image) validate() error {
+	if img.Version > Version {
+		return fmt.Errorf("It has version %d, this conair supports up to %d.", img.Version, Version)
+	}
+	if img.Manifest == nil || (len(img.Volumes) == 0 && img.RootFS == nil) {
+		return fmt.Errorf("It's incomplete.")
+	}
+	if err := img.Manifest.Config.Validate(); err != nil {
+		return fmt.Errorf("Its configuration is invalid. %v", err)
+	}
+	if img.RootFS != nil && (!digestRegexp.MatchString(img.RootFS.Digest) || img.RootFS.File != BlobFile(img.RootFS.Digest)) {
+		return fmt.Errorf("Its root filesystem is invalid.")
+	}
+	for i, v := range img.Volumes {
+		parent := ""
+		if i > 0 {
+			parent = img.Volumes[i-1].UUID
+		}
+		// names and files become paths
+		if v.Parent != parent || v.Name == "" || v.Name == "." || v.Name == ".." || strings.Contains(v.Name, "/") ||
+			v.UUID == "" || strings.ContainsAny(v.UUID+v.Parent, "/.") || v.Stream.File != StreamFile(v.UUID, v.Parent) ||
+			!digestRegexp.MatchString(v.Stream.Digest) {
+			return fmt.Errorf("Its volume %s is invalid.", v.Name)
+		}
+		// images are neither hidden nor below other directories
+		if v.Manifest != nil && (v.Manifest.Name == "" || strings.HasPrefix(v.Manifest.Name, ".") || strings.Contains(v.Manifest.Name, "/")) {
+			return fmt.Errorf("Its volume %s has an invalid image name.", v.Name)
+		}
+	}
+	return nil
+}
+
+// Download fetches a blob into dir, named by its digest, and verifies it. A
+// partial download in dir is continued. The caller removes the file.
+func (r *Registry) Download(b Blob, dir string, progress io.Writer) (string, error) {
+	dest := filepath.Join(dir, strings.TrimPrefix(b.Digest, "sha256:"))
+	if _, err := r.hub.Download(b.File, dest, progress); err != nil {
+		return "", err
+	}
+	if err := fetch.Verify(dest, strings.TrimPrefix(b.Digest, "sha256:")); err != nil {
+		os.Remove(dest)
+		return "", fmt.Errorf("Digest of %s doesn't match, the download is corrupt.", b.File)
+	}
+	return dest, nil
+}
+
+// PutBlob uploads a file as content addressed blob, unless the registry has
+// it already.
+func (r *Registry) PutBlob(path string) (Blob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Blob{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return Blob{}, err
+	}
+	b := Blob{Digest: fmt.Sprintf("sha256:%x", h.Sum(nil)), Size: size}
+	b.File = BlobFile(b.Digest)
+
+	if ok, err := r.hub.Exists(b.File); err != nil || ok {
+		return b, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return Blob{}, err
+	}
+	return b, r.hub.Put(b.File, f, size)
+}
+
+// PutImage uploads an image document and returns its digest.
+func (r *Registry) PutImage(img *Image) (string, error) {
+	data, err := json.MarshalIndent(img, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	if ok, err := r.hub.Exists(BlobFile(digest)); err != nil || ok {
+		return digest, err
+	}
+	return digest, r.hub.Put(BlobFile(digest), bytes.NewReader(data), int64(len(data)))
+}
+
+// Tag points a tag of a repository to an image. Pushes of the same repository
+// at the same time may lose tags, the last one wins.
+func (r *Registry) Tag(name, tag, digest string) error {
+	repo, err := r.Repository(name)
+	if err == hub.ErrNotFound {
+		repo, err = &Repository{Name: name}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if repo.Tags == nil {
+		repo.Tags = map[string]string{}
+	}
+	repo.Version = Version
+	repo.Tags[tag] = digest
+
+	data, err := json.MarshalIndent(repo, "", "  ")
+	if err != nil {
+		return err
+	}
+	return r.hub.Put(RepositoryFile(name), bytes.NewReader(data), int64(len(data)))
+}
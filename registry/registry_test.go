@@ -0,0 +1,88 @@
+package registry
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/giantswarm/conair/hub"
+)
+
+func TestResolve(t *testing.T) {
+	dir := t.TempDir()
+	r := New("local", dir)
+	other := "sha256:" + strings.Repeat("0", 64)
+	if err := r.Tag("nginx", "1.27", digest); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Tag("nginx", "latest", other); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ref    string
+		digest string
+		err    string
+	}{
+		{ref: "nginx", digest: other},
+		{ref: "nginx:1.27", digest: digest},
+		{ref: "nginx:1.27@" + digest, digest: digest},
+		// the registry isn't asked for digests
+		{ref: "unknown@" + digest, digest: digest},
+		{ref: "nginx:1.27@" + other, err: "nginx:1.27 is " + digest + " now, not " + other + "."},
+		{ref: "nginx:1.26", err: "nginx has no tag 1.26, it has 1.27, latest."},
+	}
+	for _, test := range tests {
+		ref, err := ParseReference(test.ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := r.Resolve(ref)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("Resolve(%s) = %s %v, want error %s", test.ref, d, err, test.err)
+			}
+			continue
+		}
+		if err != nil || d != test.digest {
+			t.Errorf("Resolve(%s) = %s %v, want %s", test.ref, d, err, test.digest)
+		}
+	}
+
+	if _, err := r.Resolve(Reference{Name: "unknown", Tag: "latest"}); err != hub.ErrNotFound {
+		t.Errorf("unknown repository: %v", err)
+	}
+}
+
+func TestResolveInvalidIndex(t *testing.T) {
+	dir := t.TempDir()
+	r := New("local", dir)
+	if err := os.MkdirAll(dir+"/nginx", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	indexes := map[string]string{
+		`{"version": 1, "tags": {"latest": "sha256:../../etc/passwd"}}`: "The index of nginx has an invalid digest for latest.",
+		`{"version": 1, "tags": {"latest": "abc"}}`:                     "The index of nginx has an invalid digest for latest.",
+		`{"version": 2, "tags": {}}`:                                    "The index of nginx has version 2, this conair supports up to 1.",
+	}
+	for index, want := range indexes {
+		if err := ioutil.WriteFile(dir+"/"+RepositoryFile("nginx"), []byte(index), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Resolve(Reference{Name: "nginx", Tag: "latest"}); err == nil || err.Error() != want {
+			t.Errorf("%s: got %v, want %s", index, err, want)
+		}
+	}
+	if err := ioutil.WriteFile(dir+"/"+RepositoryFile("nginx"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Resolve(Reference{Name: "nginx", Tag: "latest"}); err == nil {
+		t.Error("broken index was accepted")
+	}
+
+	if _, _, err := r.Image("sha256:../../etc/passwd"); err == nil {
+		t.Error("invalid digest was fetched")
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/giantswarm/conair/btrfs"
 	"github.com/giantswarm/conair/nspawn"
 )
 
@@ -33,7 +32,11 @@ func runRm(args []string) (exit int) {
 		fmt.Fprintln(os.Stderr, "Couldn't disable container.", err)
 	}
 
-	fs, _ := btrfs.Init(home)
+	fs, err := initStorage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't populate filesystem for conair.", err)
+		return 1
+	}
 	if err := fs.Remove(containerPath); err != nil {
 		fmt.Fprintln(os.Stderr, "Couldn't remove filesystem for container.", err)
 		return 1
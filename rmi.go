@@ -5,7 +5,8 @@ import (
 	"os"
 	"strings"
 
-	"github.com/giantswarm/conair/btrfs"
+	"github.com/giantswarm/conair/image"
+	"github.com/giantswarm/conair/layer"
 )
 
 var cmdRmi = &Command{
@@ -23,18 +24,34 @@ func runRmi(args []string) (exit int) {
 
 	imagePath := args[0]
 
-	fs, _ := btrfs.Init(home)
+	fs, err := initStorage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't populate filesystem for conair.", err)
+		return 1
+	}
 
 	if !fs.Exists(imagePath) {
 		fmt.Fprintln(os.Stderr, fmt.Sprintf("Image %s does not exists.", imagePath))
 		return 1
 	}
 
+	// layers other images or containers use are kept
+	_, refs, err := layerRefs(fs, imagePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't find the layers in use.", err)
+		return 1
+	}
+
+	if err := image.Remove(home, imagePath); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't remove manifest.", err)
+		return 1
+	}
+
 	for {
 		var (
-			uuid  string
-			layer string
-			err   error
+			uuid   string
+			parent string
+			err    error
 		)
 		uuid, err = fs.GetSubvolumeParentUuid(imagePath)
 		if err != nil {
@@ -42,7 +59,7 @@ func runRmi(args []string) (exit int) {
 			return 1
 		}
 
-		layer, err = fs.GetLayerByUuid(uuid)
+		parent, err = fs.GetLayerByUuid(uuid)
 		noParent := false
 		if err != nil {
 			noParent = true
@@ -53,11 +70,19 @@ func runRmi(args []string) (exit int) {
 			return 1
 		}
 
+		if layer.IsLayer(imagePath) {
+			layer.Forget(home, imagePath)
+		}
+
 		fmt.Println(imagePath)
-		if !strings.HasPrefix(layer, ".cnr-") || noParent {
+		if !strings.HasPrefix(parent, ".cnr-") || noParent {
+			break
+		} else if len(refs[parent]) > 0 {
+			// its parents are shared as well
+			fmt.Println(fmt.Sprintf("Keeping %s, it is used by %s.", parent, strings.Join(refs[parent], ", ")))
 			break
 		} else {
-			imagePath = layer
+			imagePath = parent
 		}
 	}
 	return 0
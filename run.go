@@ -2,20 +2,26 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path"
 	"strings"
 
-	"github.com/giantswarm/conair/btrfs"
+	"github.com/giantswarm/conair/fileutil"
+	"github.com/giantswarm/conair/image"
 	"github.com/giantswarm/conair/nspawn"
+	"github.com/giantswarm/conair/storage"
 )
 
 var (
 	flagBind     stringSlice
 	flagSnapshot stringSlice
+	flagPublish  bool
+	flagBoot     bool
 	cmdRun       = &Command{
 		Name:    "run",
 		Summary: "Run a container",
-		Usage:   "[-bind=S] [-snapshot=S] <image> [<container>]",
+		Usage:   "[-bind=S] [-snapshot=S] [-publish] [-boot=false] <image> [<container>]",
 		Run:     runRun,
 		Description: `Run a new container
 
@@ -26,6 +32,11 @@ You can either bind mount a directory into the container or take a snapshot of a
 
 conair run -bind=/var/data:/data base test
 conair run -snapshot=mysnapshot:/data base test
+
+Paths declared with VOLUME get a snapshot named <container>-<path>, which
+starts with the content of the image. -publish forwards the ports declared
+with EXPOSE from the host. With -boot=false, the container runs the
+ENTRYPOINT and CMD of the image as a oneshot service instead of booting.
 `,
 	}
 )
@@ -33,6 +44,8 @@ conair run -snapshot=mysnapshot:/data base test
 func init() {
 	cmdRun.Flags.Var(&flagBind, "bind", "Bind mount a directory into the container")
 	cmdRun.Flags.Var(&flagSnapshot, "snapshot", "Add a snapshot into the container")
+	cmdRun.Flags.BoolVar(&flagPublish, "publish", false, "Forward the ports the image exposes from the host")
+	cmdRun.Flags.BoolVar(&flagBoot, "boot", true, "Boot the container, otherwise run the command of the image")
 }
 
 func runRun(args []string) (exit int) {
@@ -52,7 +65,25 @@ func runRun(args []string) (exit int) {
 	}
 	containerPath := fmt.Sprintf(".#%s", container)
 
-	fs, _ := btrfs.Init(home)
+	// images without manifest have no runtime configuration
+	m, err := image.Read(home, imagePath)
+	if os.IsNotExist(err) {
+		m, err = image.New(imagePath, ""), nil
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't read manifest of image.", err)
+		return 1
+	}
+	if !flagBoot && len(m.Config.Command()) == 0 {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Image %s has neither ENTRYPOINT nor CMD to run without booting.", imagePath))
+		return 1
+	}
+
+	fs, err := initStorage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't populate filesystem for conair.", err)
+		return 1
+	}
 	if err := fs.Snapshot(imagePath, containerPath, false); err != nil {
 		fmt.Fprintln(os.Stderr, "Couldn't create filesystem for container.", err)
 		return 1
@@ -62,8 +93,22 @@ func runRun(args []string) (exit int) {
 	if len(flagBind) > 0 {
 		c.SetBinds(flagBind)
 	}
-	if len(flagSnapshot) > 0 {
-		c.SetSnapshots(flagSnapshot)
+
+	volumes, err := createVolumes(fs, m.Config.Volumes, container, containerPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't create volumes for container.", err)
+		return 1
+	}
+	c.SetSnapshots(append(volumes, flagSnapshot...))
+
+	if flagPublish {
+		c.SetPorts(m.Config.ExposedPorts)
+	}
+	if !flagBoot {
+		c.SetEnv(m.Config.Env)
+		c.SetWorkdir(m.Config.Workdir)
+		c.SetUser(m.Config.User)
+		c.SetCommand(m.Config.Command(), bridge)
 	}
 
 	for _, snap := range c.Snapshots {
@@ -102,3 +147,72 @@ func runRun(args []string) (exit int) {
 
 	return 0
 }
+
+// createVolumes creates a snapshot for every VOLUME of the image, unless the
+// path is covered by a -snapshot flag. A new snapshot starts with the content
+// the image has at the path, which is removed from the container.
+func createVolumes(fs storage.Driver, volumes []string, container, containerPath string) ([]string, error) {
+	snapshots := []string{}
+
+	for _, volume := range volumes {
+		// manifests of pulled images aren't checked by a build
+		volume, err := image.CleanVolume(volume)
+		if err != nil {
+			return nil, err
+		}
+		covered := false
+		for _, snap := range flagSnapshot {
+			paths := strings.Split(snap, ":")
+			covered = covered || len(paths) > 1 && path.Clean(paths[1]) == volume
+		}
+		if covered {
+			continue
+		}
+
+		name := container + strings.Replace(volume, "/", "-", -1)
+		snapshotPath := fmt.Sprintf(".cnr-snapshot-%s", name)
+		content, err := fileutil.SecureJoin(fmt.Sprintf("%s/%s", home, containerPath), volume)
+		if err != nil {
+			return nil, err
+		}
+
+		if !fs.Exists(snapshotPath) {
+			if err := fs.Subvolume(snapshotPath); err != nil {
+				return nil, err
+			}
+			if err := seedVolume(content, fmt.Sprintf("%s/%s", home, snapshotPath)); err != nil {
+				return nil, fmt.Errorf("Couldn't copy %s into volume. %v", volume, err)
+			}
+		}
+		if err := os.RemoveAll(content); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(path.Dir(content), 0755); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, fmt.Sprintf("%s:%s", name, volume))
+	}
+	return snapshots, nil
+}
+
+// seedVolume copies the content of the directory src into the volume dst.
+func seedVolume(src, dst string) error {
+	fi, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := fileutil.CopyTree(path.Join(src, entry.Name()), path.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return fileutil.CopyMetadata(src, dst, fi)
+}
@@ -0,0 +1,107 @@
+package runner
+
+import (
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Runner executes external commands. All packages run systemctl, btrfs,
+// systemd-nspawn and friends through a Runner, so tests can replace it.
+type Runner interface {
+	Run(cmd *exec.Cmd) error
+	Output(cmd *exec.Cmd) ([]byte, error)
+	CombinedOutput(cmd *exec.Cmd) ([]byte, error)
+}
+
+// Default is the runner used by containers, drivers and networkd unless a
+// different one is set.
+var Default Runner = Exec{}
+
+// Exec runs the commands on the host.
+type Exec struct{}
+
+func (Exec) Run(cmd *exec.Cmd) error {
+	return cmd.Run()
+}
+
+func (Exec) Output(cmd *exec.Cmd) ([]byte, error) {
+	return cmd.Output()
+}
+
+func (Exec) CombinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	return cmd.CombinedOutput()
+}
+
+// Call is a command recorded by a Recorder.
+type Call struct {
+	Args []string
+	Dir  string
+	Env  []string
+}
+
+// String returns the command line of the call.
+func (c Call) String() string {
+	return strings.Join(c.Args, " ")
+}
+
+// Recorder is a fake Runner. It records every command instead of running it
+// and answers with the output of Handler.
+type Recorder struct {
+	// Handler returns the output and error of a call. Without a handler all
+	// calls succeed without output.
+	Handler func(call Call) ([]byte, error)
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+func (r *Recorder) Run(cmd *exec.Cmd) error {
+	out, err := r.record(cmd)
+	if cmd.Stdout != nil && len(out) > 0 {
+		cmd.Stdout.Write(out)
+	}
+	return err
+}
+
+func (r *Recorder) Output(cmd *exec.Cmd) ([]byte, error) {
+	return r.record(cmd)
+}
+
+func (r *Recorder) CombinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	return r.record(cmd)
+}
+
+// Calls returns all commands recorded so far.
+func (r *Recorder) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Call{}, r.calls...)
+}
+
+// Commands returns the command lines of all recorded calls.
+func (r *Recorder) Commands() []string {
+	commands := []string{}
+	for _, call := range r.Calls() {
+		commands = append(commands, call.String())
+	}
+	return commands
+}
+
+func (r *Recorder) record(cmd *exec.Cmd) ([]byte, error) {
+	call := Call{
+		Args: append([]string{}, cmd.Args...),
+		Dir:  cmd.Dir,
+		Env:  append([]string{}, cmd.Env...),
+	}
+
+	r.mu.Lock()
+	r.calls = append(r.calls, call)
+	r.mu.Unlock()
+
+	if r.Handler == nil {
+		return nil, nil
+	}
+	return r.Handler(call)
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/giantswarm/conair/archive"
+	"github.com/giantswarm/conair/image"
+	"github.com/giantswarm/conair/oci"
+	"github.com/giantswarm/conair/storage"
+)
+
+const (
+	// archiveVersion of the conair.json of saved images
+	archiveVersion = 1
+	archiveFile    = "conair.json"
+
+	formatConair = "conair"
+	formatOCI    = "oci"
+)
+
+var (
+	flagSaveFormat string
+	flagSaveOutput string
+	cmdSave        = &Command{
+		Name:    "save",
+		Summary: "Save an image to a tar archive",
+		Usage:   "[-format=conair|oci] [-o FILE] <image>",
+		Run:     runSave,
+		Description: `Save an image to a tar archive, which conair load reads on another host
+
+Built images are saved layer by layer, every layer is a tar of the changes to
+the one below. Loading them with conair load -cache fills the build cache of
+the other host, so builds on top of the same layers are cached there as well.
+Other images are saved as a single layer.
+
+-format=oci writes an OCI image layout (with the manifest.json of docker save),
+which docker load, podman, skopeo and other OCI tooling understand.
+
+The archive is written to stdout unless -o is given.
+
+conair save my-image > my-image.tar
+conair save -format=oci -o my-image.tar my-image
+`,
+	}
+)
+
+func init() {
+	cmdSave.Flags.StringVar(&flagSaveFormat, "format", formatConair, "Archive format: conair or oci")
+	cmdSave.Flags.StringVar(&flagSaveOutput, "o", "", "Write the archive to this file instead of stdout")
+}
+
+// savedArchive is the conair.json of a saved image.
+type savedArchive struct {
+	Version  int             `json:"version"`
+	Manifest *image.Manifest `json:"manifest"`
+	Layers   []savedLayer    `json:"layers"`
+}
+
+// savedLayer is a layer of a saved image. ID is the hash of the layer in the
+// build cache, layers with changes to the last cached layer (or all of the
+// image) have none.
+type savedLayer struct {
+	ID          string `json:"id,omitempty"`
+	Digest      string `json:"digest"`
+	Size        int64  `json:"size"`
+	Instruction string `json:"instruction,omitempty"`
+
+	// file holds the tar of the layer while the archive is written
+	file string
+}
+
+func runSave(args []string) (exit int) {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "Image name missing.")
+		return 1
+	}
+	name := args[0]
+
+	if flagSaveFormat != formatConair && flagSaveFormat != formatOCI {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Unknown format %s. Please use conair or oci.", flagSaveFormat))
+		return 1
+	}
+
+	fs, err := initStorage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't populate filesystem for conair.", err)
+		return 1
+	}
+
+	if !fs.Exists(name) {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Image %s doesn't exist.", name))
+		return 1
+	}
+	// images of older versions get their manifest now
+	if _, err := image.Digest(home, name); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't compute digest of image.", err)
+		return 1
+	}
+	m, err := image.Read(home, name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't read manifest of image.", err)
+		return 1
+	}
+
+	var w io.Writer = os.Stdout
+	if flagSaveOutput != "" {
+		f, err := os.Create(flagSaveOutput)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't create archive.", err)
+			return 1
+		}
+		defer func() {
+			f.Close()
+			if exit != 0 {
+				os.Remove(flagSaveOutput)
+			}
+		}()
+		w = f
+	} else if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprintln(os.Stderr, "Refusing to write the archive to a terminal. Please redirect stdout or use -o.")
+		return 1
+	}
+
+	// the layers are written to files first, the archive needs their size
+	// upfront
+	tmp, err := ioutil.TempDir("", "conair-save-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't create temporary directory.", err)
+		return 1
+	}
+	defer os.RemoveAll(tmp)
+
+	layers, err := saveLayers(fs, m, tmp)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't save layers of image.", err)
+		return 1
+	}
+
+	tw := tar.NewWriter(w)
+	if flagSaveFormat == formatOCI {
+		err = writeOCI(tw, m, layers)
+	} else {
+		err = writeConair(tw, m, layers)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't write archive.", err)
+		return 1
+	}
+	return 0
+}
+
+// saveLayers writes the layers of an image into dir, bottom up. Built images
+// are saved as the layers of their last stage followed by the changes of the
+// image to its last layer. If a layer isn't cached anymore, the image is saved
+// as a single layer.
+func saveLayers(fs storage.Driver, m *image.Manifest, dir string) ([]savedLayer, error) {
+	layers := []savedLayer{}
+	for _, l := range m.Layers {
+		if !fs.Exists(".cnr-" + l.Hash) {
+			layers = nil
+			break
+		}
+		layers = append(layers, savedLayer{ID: l.Hash, Instruction: l.Instruction})
+	}
+	layers = append(layers, savedLayer{})
+
+	base := ""
+	for i := range layers {
+		vol := m.Name
+		if layers[i].ID != "" {
+			vol = ".cnr-" + layers[i].ID
+		}
+		path := fmt.Sprintf("%s/%s", home, vol)
+		file := fmt.Sprintf("%s/%d.tar", dir, i)
+		digest, size, err := writeLayer(file, base, path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", vol, err)
+		}
+		layers[i].Digest, layers[i].Size, layers[i].file = digest, size, file
+		base = path
+	}
+	return layers, nil
+}
+
+// writeLayer writes the changes from base to dir into file and returns the
+// digest and size of the tar.
+func writeLayer(file, base, dir string) (string, int64, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if err := archive.Diff(io.MultiWriter(f, h), base, dir); err != nil {
+		return "", 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), fi.Size(), f.Close()
+}
+
+// writeConair writes conair.json and the layers, named by their digest.
+func writeConair(tw *tar.Writer, m *image.Manifest, layers []savedLayer) error {
+	data, err := json.MarshalIndent(savedArchive{Version: archiveVersion, Manifest: m, Layers: layers}, "", "  ")
+	if err != nil {
+		return err
+	}
+	// conair.json comes first, so load knows what it reads
+	if err := addData(tw, archiveFile, data); err != nil {
+		return err
+	}
+	// layers without changes, eg of ENV, are all the same
+	written := map[string]bool{}
+	for _, l := range layers {
+		if written[l.Digest] {
+			continue
+		}
+		if err := addFile(tw, layerFile(l.Digest), l.file); err != nil {
+			return err
+		}
+		written[l.Digest] = true
+	}
+	return nil
+}
+
+// layerFile returns the name of a layer in a conair archive.
+func layerFile(digest string) string {
+	return fmt.Sprintf("layers/%s.tar", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// writeOCI writes an OCI image layout with one image, and the manifest.json of
+// docker save for docker load.
+func writeOCI(tw *tar.Writer, m *image.Manifest, layers []savedLayer) error {
+	created := m.Created
+	config := oci.Image{
+		Created:      &created,
+		Architecture: runtime.GOARCH,
+		OS:           "linux",
+		Config:       oci.FromConfig(m.Config),
+		RootFS:       oci.RootFS{Type: "layers"},
+	}
+	manifest := oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     oci.MediaTypeManifest,
+		Layers:        []oci.Descriptor{},
+	}
+	docker := oci.DockerManifest{RepoTags: []string{dockerTag(m.Name)}}
+
+	data, err := json.Marshal(oci.Layout{Version: oci.LayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := addData(tw, "oci-layout", data); err != nil {
+		return err
+	}
+
+	written := map[string]bool{}
+	for _, l := range layers {
+		path, err := oci.BlobPath(l.Digest)
+		if err != nil {
+			return err
+		}
+		if !written[l.Digest] {
+			if err := addFile(tw, path, l.file); err != nil {
+				return err
+			}
+			written[l.Digest] = true
+		}
+		desc := oci.Descriptor{MediaType: oci.MediaTypeLayer, Digest: l.Digest, Size: l.Size}
+		history := oci.History{Created: &created, CreatedBy: l.Instruction}
+		if l.ID != "" {
+			desc.Annotations = map[string]string{oci.AnnotationLayer: l.ID}
+		} else {
+			history.CreatedBy = fmt.Sprintf("conair %s", m.Source)
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, l.Digest)
+		config.History = append(config.History, history)
+		docker.Layers = append(docker.Layers, path)
+	}
+
+	if manifest.Config, err = addBlob(tw, oci.MediaTypeConfig, config); err != nil {
+		return err
+	}
+	docker.Config, _ = oci.BlobPath(manifest.Config.Digest)
+	desc, err := addBlob(tw, oci.MediaTypeManifest, manifest)
+	if err != nil {
+		return err
+	}
+	desc.Annotations = map[string]string{oci.AnnotationRefName: m.Name}
+
+	index := oci.Index{SchemaVersion: 2, MediaType: oci.MediaTypeIndex, Manifests: []oci.Descriptor{desc}}
+	if data, err = json.Marshal(index); err != nil {
+		return err
+	}
+	if err := addData(tw, "index.json", data); err != nil {
+		return err
+	}
+	if data, err = json.Marshal([]oci.DockerManifest{docker}); err != nil {
+		return err
+	}
+	return addData(tw, "manifest.json", data)
+}
+
+// dockerTag returns the name of an image as docker repository and tag.
+func dockerTag(name string) string {
+	if strings.Contains(name, ":") {
+		return strings.ToLower(name)
+	}
+	return strings.ToLower(name) + ":latest"
+}
+
+// addBlob adds a JSON document to the blobs of a layout.
+func addBlob(tw *tar.Writer, mediaType string, v interface{}) (oci.Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	desc := oci.Descriptor{
+		MediaType: mediaType,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(data)),
+		Size:      int64(len(data)),
+	}
+	path, _ := oci.BlobPath(desc.Digest)
+	return desc, addData(tw, path, data)
+}
+
+func addData(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func addFile(tw *tar.Writer, name, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    fi.Size(),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/giantswarm/conair/hub"
+	"github.com/giantswarm/conair/registry"
+	"github.com/giantswarm/conair/signature"
+)
+
+var (
+	flagSignKey      string
+	flagSignGenerate bool
+	flagSignFile     bool
+	cmdSign          = &Command{
+		Name:    "sign",
+		Summary: "Sign images of a registry",
+		Usage:   "-generate-key <name> | -key=FILE [<registry>/]<name>[:<tag>][@<digest>] | -key=FILE -file <file>...",
+		Run:     runSign,
+		Description: `Sign images of a registry, so conair pull trusts them
+
+-generate-key creates a key pair, <name>.key and <name>.pub. Keep the secret
+key to yourself and copy the public key into the trusted keys directory of the
+hosts which pull the images, /etc/conair/trusted-keys by default.
+
+Signing an image reference signs the image document, which pins all content of
+the image, and uploads the signature next to it. -file signs local files, eg
+tarballs published in repositories without index, into <file>.minisig.
+
+Signatures and public keys have the format of minisign, so minisign -V verifies
+them as well.
+
+conair sign -generate-key release
+conair push nginx local/nginx:1.27
+conair sign -key=release.key local/nginx:1.27
+conair sign -key=release.key -file base.tar.xz
+`,
+	}
+)
+
+func init() {
+	cmdSign.Flags.StringVar(&flagSignKey, "key", "", "Secret key to sign with")
+	cmdSign.Flags.BoolVar(&flagSignGenerate, "generate-key", false, "Generate a key pair <name>.key and <name>.pub")
+	cmdSign.Flags.BoolVar(&flagSignFile, "file", false, "Sign local files instead of an image of a registry")
+}
+
+func runSign(args []string) (exit int) {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "Image reference, file or key name missing.")
+		return 1
+	}
+	if flagSignGenerate {
+		return generateKey(args[0])
+	}
+
+	if flagSignKey == "" {
+		fmt.Fprintln(os.Stderr, "Please give the secret key with -key.")
+		return 1
+	}
+	data, err := ioutil.ReadFile(flagSignKey)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't read secret key.", err)
+		return 1
+	}
+	key, err := signature.ParsePrivateKey(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if flagSignFile {
+		for _, file := range args {
+			if err := signFile(key, file); err != nil {
+				fmt.Fprintln(os.Stderr, fmt.Sprintf("Couldn't sign %s.", file), err)
+				return 1
+			}
+			fmt.Printf("Signed %s into %s.\n", file, file+signature.Extension)
+		}
+		return 0
+	}
+
+	ref, err := registry.ParseReference(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	reg, _, err := initRegistry(ref.Registry)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't find registry.", err)
+		return 1
+	}
+	digest, err := reg.Resolve(ref)
+	if err == hub.ErrNotFound {
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("Registry %s doesn't have %s. Please sign its tarball with -file.", reg, ref.Name))
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't resolve reference.", err)
+		return 1
+	}
+	_, doc, err := reg.Image(digest)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't fetch image.", err)
+		return 1
+	}
+
+	ref.Registry, ref.Digest = reg.String(), digest
+	sig, err := key.Sign(bytes.NewReader(doc), trustedComment(ref.String()))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't sign image.", err)
+		return 1
+	}
+	if err := reg.PutSignature(registry.BlobFile(digest), sig); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't push signature.", err)
+		return 1
+	}
+
+	fmt.Printf("Signed %s with key %s.\n", ref, signature.KeyID(key.ID))
+	return 0
+}
+
+// generateKey writes a new key pair. Existing keys aren't overwritten.
+func generateKey(name string) (exit int) {
+	pub, priv, err := signature.GenerateKey()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't generate key.", err)
+		return 1
+	}
+	if err := writeNew(name+".key", priv.Marshal(), 0600); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't write secret key.", err)
+		return 1
+	}
+	if err := writeNew(name+signature.KeyExtension, pub.Marshal(), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't write public key.", err)
+		return 1
+	}
+
+	fmt.Printf("Generated key %s. Copy %s into the trusted keys directory of the hosts pulling your images.\n",
+		signature.KeyID(pub.ID), name+signature.KeyExtension)
+	return 0
+}
+
+func writeNew(path string, data []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// signFile writes the signature of a local file next to it.
+func signFile(key *signature.PrivateKey, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sig, err := key.Sign(f, trustedComment(filepath.Base(file)))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file+signature.Extension, sig, 0644)
+}
+
+// trustedComment is signed along with a file, in the format of minisign.
+func trustedComment(file string) string {
+	return fmt.Sprintf("timestamp:%d\tfile:%s\thashed", time.Now().Unix(), file)
+}
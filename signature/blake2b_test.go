@@ -0,0 +1,51 @@
+package signature
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestBlake2b(t *testing.T) {
+	long := make([]byte, 1000)
+	for i := range long {
+		long[i] = byte(i % 251)
+	}
+
+	// the first two are the examples of RFC 7693, the others cross block
+	// boundaries
+	tests := []struct {
+		data []byte
+		sum  string
+	}{
+		{nil, "786a02f742015903c6c6fd852552d272912f4740e15847618a86e217f71f5419d25e1031afee585313896444934eb04b903a685b1448b755d56f701afe9be2ce"},
+		{[]byte("abc"), "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"},
+		{long[:128], "2319e3789c47e2daa5fe807f61bec2a1a6537fa03f19ff32e87eecbfd64b7e0e8ccff439ac333b040f19b0c4ddd11a61e24ac1fe0f10a039806c5dcc0da3d115"},
+		{long[:129], "f59711d44a031d5f97a9413c065d1e614c417ede998590325f49bad2fd444d3e4418be19aec4e11449ac1a57207898bc57d76a1bcf3566292c20c683a5c4648f"},
+		{long, "c11e1c0340bd7e5a1b275f1230c962fad215ecb1391486e74e31b960a2f2996381a5fad092da06841d5f26e38f6ecfeaf441acbcd1c2de61aef121e7927175f5"},
+	}
+	for _, test := range tests {
+		for _, chunk := range []int{1, 7, 128, 1000} {
+			h := newBlake2b()
+			for data := test.data; len(data) > 0; {
+				n := chunk
+				if n > len(data) {
+					n = len(data)
+				}
+				h.Write(data[:n])
+				data = data[n:]
+			}
+			if sum := hex.EncodeToString(h.Sum(nil)); sum != test.sum {
+				t.Errorf("BLAKE2b of %d bytes written in chunks of %d is %s, want %s", len(test.data), chunk, sum, test.sum)
+			}
+		}
+	}
+
+	// Sum doesn't change the state
+	h := newBlake2b()
+	h.Write([]byte("ab"))
+	h.Sum(nil)
+	h.Write([]byte("c"))
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != tests[1].sum {
+		t.Errorf("Sum changed the state: %s", sum)
+	}
+}
@@ -0,0 +1,270 @@
+// Package signature signs and verifies files with Ed25519 in the format of
+// minisign: public keys and signatures can be used with minisign -V, and
+// signatures made by minisign are verified with its public keys.
+package signature
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Extension of signature files, which are stored next to the signed file.
+const Extension = ".minisig"
+
+// KeyExtension is the extension of public keys in the trusted keys directory.
+const KeyExtension = ".pub"
+
+var (
+	algorithm = []byte("Ed")
+	// prehashed signatures sign the BLAKE2b-512 of the file, minisign's
+	// default
+	algorithmHashed = []byte("ED")
+
+	// ErrUntrusted is returned for signatures of keys which aren't trusted.
+	ErrUntrusted = errors.New("The signature is made with a key which isn't trusted")
+)
+
+const (
+	untrustedPrefix = "untrusted comment: "
+	trustedPrefix   = "trusted comment: "
+)
+
+// PublicKey verifies signatures. Its ID is stored in signatures, to find the
+// key which made them.
+type PublicKey struct {
+	ID  [8]byte
+	Key ed25519.PublicKey
+	// File the key was read from
+	File string
+}
+
+// PrivateKey makes signatures. Private keys are stored unencrypted, minisign's
+// secret keys can't be used.
+type PrivateKey struct {
+	ID  [8]byte
+	Key ed25519.PrivateKey
+}
+
+// Signature is a verified signature.
+type Signature struct {
+	Key *PublicKey
+	// TrustedComment is signed along with the file
+	TrustedComment string
+}
+
+// File returns the file the trusted comment names, "" if it names none.
+func (s *Signature) File() string {
+	for _, field := range strings.Split(s.TrustedComment, "\t") {
+		if strings.HasPrefix(field, "file:") {
+			return strings.TrimPrefix(field, "file:")
+		}
+	}
+	return ""
+}
+
+// KeyID formats the ID of a key like minisign does.
+func KeyID(id [8]byte) string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(id[:]))
+}
+
+// GenerateKey creates a new key pair.
+func GenerateKey() (*PublicKey, *PrivateKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, nil, err
+	}
+	return &PublicKey{ID: id, Key: pub}, &PrivateKey{ID: id, Key: priv}, nil
+}
+
+// Public returns the public key of a private key.
+func (k *PrivateKey) Public() *PublicKey {
+	return &PublicKey{ID: k.ID, Key: k.Key.Public().(ed25519.PublicKey)}
+}
+
+// Marshal encodes a public key in the format of minisign.
+func (k *PublicKey) Marshal() []byte {
+	return encode(fmt.Sprintf("minisign public key %s", KeyID(k.ID)), algorithm, k.ID[:], k.Key)
+}
+
+// Marshal encodes a private key.
+func (k *PrivateKey) Marshal() []byte {
+	return encode(fmt.Sprintf("conair secret key %s", KeyID(k.ID)), algorithm, k.ID[:], k.Key)
+}
+
+func encode(comment string, parts ...[]byte) []byte {
+	return []byte(fmt.Sprintf("%s%s\n%s\n", untrustedPrefix, comment, base64.StdEncoding.EncodeToString(bytes.Join(parts, nil))))
+}
+
+// ParsePublicKey decodes a public key of conair or minisign.
+func ParsePublicKey(data []byte) (*PublicKey, error) {
+	lines, err := readLines(data, 2)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid public key. %v", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(raw) != 2+8+ed25519.PublicKeySize || !bytes.Equal(raw[:2], algorithm) {
+		return nil, fmt.Errorf("Invalid public key.")
+	}
+	k := &PublicKey{Key: ed25519.PublicKey(raw[10:])}
+	copy(k.ID[:], raw[2:10])
+	return k, nil
+}
+
+// ParsePrivateKey decodes a private key written by Marshal.
+func ParsePrivateKey(data []byte) (*PrivateKey, error) {
+	lines, err := readLines(data, 2)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid secret key. %v", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(raw) != 2+8+ed25519.PrivateKeySize || !bytes.Equal(raw[:2], algorithm) {
+		return nil, fmt.Errorf("Invalid secret key. Only keys of conair sign -generate-key can be used.")
+	}
+	k := &PrivateKey{Key: ed25519.PrivateKey(raw[10:])}
+	copy(k.ID[:], raw[2:10])
+	return k, nil
+}
+
+// ReadTrustedKeys reads the public keys, *.pub, of a directory. A missing
+// directory trusts no key.
+func ReadTrustedKeys(dir string) ([]*PublicKey, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+KeyExtension))
+	if err != nil {
+		return nil, err
+	}
+	keys := []*PublicKey{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		k, err := ParsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		k.File = file
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// Sign signs the content of r. The trusted comment is signed as well, minisign
+// prints it on verification.
+func (k *PrivateKey) Sign(r io.Reader, trustedComment string) ([]byte, error) {
+	if strings.ContainsAny(trustedComment, "\r\n") {
+		return nil, fmt.Errorf("The trusted comment has to be a single line.")
+	}
+	h := newBlake2b()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	sig := ed25519.Sign(k.Key, h.Sum(nil))
+	global := ed25519.Sign(k.Key, append(append([]byte{}, sig...), trustedComment...))
+
+	return []byte(fmt.Sprintf("%ssignature from conair secret key %s\n%s\n%s%s\n%s\n",
+		untrustedPrefix, KeyID(k.ID),
+		base64.StdEncoding.EncodeToString(bytes.Join([][]byte{algorithmHashed, k.ID[:], sig}, nil)),
+		trustedPrefix, trustedComment,
+		base64.StdEncoding.EncodeToString(global))), nil
+}
+
+// Verify checks a signature of the content of r, which has to be made by one
+// of the keys. It returns ErrUntrusted if none of them made it.
+func Verify(r io.Reader, data []byte, keys []*PublicKey) (*Signature, error) {
+	lines, err := readLines(data, 4)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid signature. %v", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(raw) != 2+8+ed25519.SignatureSize {
+		return nil, fmt.Errorf("Invalid signature.")
+	}
+	if !strings.HasPrefix(lines[2], trustedPrefix) {
+		return nil, fmt.Errorf("Invalid signature, the trusted comment is missing.")
+	}
+	comment := strings.TrimPrefix(lines[2], trustedPrefix)
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("Invalid signature.")
+	}
+
+	var key *PublicKey
+	for _, k := range keys {
+		if bytes.Equal(k.ID[:], raw[2:10]) {
+			key = k
+			break
+		}
+	}
+	if key == nil {
+		var id [8]byte
+		copy(id[:], raw[2:10])
+		return nil, fmt.Errorf("%w: %s", ErrUntrusted, KeyID(id))
+	}
+
+	var message []byte
+	switch {
+	case bytes.Equal(raw[:2], algorithmHashed):
+		h := newBlake2b()
+		if _, err := io.Copy(h, r); err != nil {
+			return nil, err
+		}
+		message = h.Sum(nil)
+	case bytes.Equal(raw[:2], algorithm):
+		if message, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported signature algorithm %q.", raw[:2])
+	}
+
+	sig := raw[10:]
+	if !ed25519.Verify(key.Key, message, sig) {
+		return nil, fmt.Errorf("The signature doesn't match, the file was modified or isn't the signed one.")
+	}
+	if !ed25519.Verify(key.Key, append(append([]byte{}, sig...), comment...), global) {
+		return nil, fmt.Errorf("The trusted comment of the signature was modified.")
+	}
+	return &Signature{Key: key, TrustedComment: comment}, nil
+}
+
+// VerifyFile checks a signature of a file.
+func VerifyFile(path string, data []byte, keys []*PublicKey) (*Signature, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Verify(f, data, keys)
+}
+
+// readLines returns the first n lines of a key or signature file, the first
+// being an untrusted comment.
+func readLines(data []byte, n int) ([]string, error) {
+	lines := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() && len(lines) < n {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	if len(lines) < n {
+		return nil, fmt.Errorf("It's incomplete.")
+	}
+	if !strings.HasPrefix(lines[0], untrustedPrefix) {
+		return nil, fmt.Errorf("The untrusted comment is missing.")
+	}
+	return lines, nil
+}
@@ -0,0 +1,122 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func generateKey(t *testing.T) (*PublicKey, *PrivateKey) {
+	pub, priv, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+func TestSignVerify(t *testing.T) {
+	pub, priv := generateKey(t)
+	other, _ := generateKey(t)
+
+	data := []byte("image document")
+	comment := "timestamp:1\tfile:local/base:1@sha256:00\thashed"
+	sig, err := priv.Sign(bytes.NewReader(data), comment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Verify(bytes.NewReader(data), sig, []*PublicKey{other, pub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Key != pub || s.TrustedComment != comment || s.File() != "local/base:1@sha256:00" {
+		t.Errorf("unexpected signature %+v", s)
+	}
+
+	if _, err := Verify(bytes.NewReader([]byte("image documenT")), sig, []*PublicKey{pub}); err == nil {
+		t.Error("modified content was verified")
+	}
+	if _, err := Verify(bytes.NewReader(data), sig, []*PublicKey{other}); !errors.Is(err, ErrUntrusted) {
+		t.Errorf("signature of an untrusted key: %v", err)
+	}
+	if _, err := Verify(bytes.NewReader(data), sig, nil); !errors.Is(err, ErrUntrusted) {
+		t.Errorf("signature without trusted keys: %v", err)
+	}
+
+	tampered := bytes.Replace(sig, []byte("file:local/base:1"), []byte("file:local/base:2"), 1)
+	if _, err := Verify(bytes.NewReader(data), tampered, []*PublicKey{pub}); err == nil || !strings.Contains(err.Error(), "trusted comment") {
+		t.Errorf("modified trusted comment: %v", err)
+	}
+	if _, err := Verify(bytes.NewReader(data), sig[:len(sig)/2], []*PublicKey{pub}); err == nil {
+		t.Error("truncated signature was verified")
+	}
+	if _, err := priv.Sign(bytes.NewReader(data), "two\nlines"); err == nil {
+		t.Error("trusted comment with a newline was signed")
+	}
+}
+
+// Signatures of minisign -l sign the content itself instead of its hash.
+func TestVerifyLegacy(t *testing.T) {
+	pub, priv := generateKey(t)
+	data := []byte("tarball")
+	sig := ed25519.Sign(priv.Key, data)
+	global := ed25519.Sign(priv.Key, append(append([]byte{}, sig...), "file:base.tar.xz"...))
+	file := fmt.Sprintf("untrusted comment: minisign\n%s\ntrusted comment: file:base.tar.xz\n%s\n",
+		base64.StdEncoding.EncodeToString(bytes.Join([][]byte{algorithm, priv.ID[:], sig}, nil)),
+		base64.StdEncoding.EncodeToString(global))
+
+	s, err := Verify(bytes.NewReader(data), []byte(file), []*PublicKey{pub})
+	if err != nil || s.File() != "base.tar.xz" {
+		t.Errorf("legacy signature wasn't verified: %+v %v", s, err)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	pub, priv := generateKey(t)
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "release"+KeyExtension), pub.Marshal(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "release.key"), priv.Marshal(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ReadTrustedKeys(dir)
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("unexpected trusted keys %v %v", keys, err)
+	}
+	if keys[0].ID != pub.ID || !keys[0].Key.Equal(pub.Key) || keys[0].File != filepath.Join(dir, "release"+KeyExtension) {
+		t.Errorf("public key changed: %+v", keys[0])
+	}
+
+	parsed, err := ParsePrivateKey(priv.Marshal())
+	if err != nil || parsed.ID != priv.ID || !parsed.Key.Equal(priv.Key) {
+		t.Errorf("private key changed: %v", err)
+	}
+	if _, err := ParsePrivateKey(pub.Marshal()); err == nil {
+		t.Error("public key was read as private key")
+	}
+	if keys, err := ReadTrustedKeys(filepath.Join(dir, "missing")); err != nil || len(keys) != 0 {
+		t.Errorf("missing directory trusts %v %v", keys, err)
+	}
+}
+
+func TestFile(t *testing.T) {
+	tests := map[string]string{
+		"timestamp:1\tfile:base.tar.xz\thashed": "base.tar.xz",
+		"file:base.tar.xz":                      "base.tar.xz",
+		"timestamp:1":                           "",
+		"signed by me":                          "",
+	}
+	for comment, file := range tests {
+		if got := (&Signature{TrustedComment: comment}).File(); got != file {
+			t.Errorf("File of %q is %q, want %q", comment, got, file)
+		}
+	}
+}
@@ -5,8 +5,6 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
-
-	"github.com/giantswarm/conair/btrfs"
 )
 
 var cmdSnapshot = &Command{
@@ -32,7 +30,11 @@ func runSnapshot(args []string) (exit int) {
 		snapshot := args[1]
 		snapshotPath := fmt.Sprintf(".cnr-snapshot-%s", snapshot)
 
-		fs, _ := btrfs.Init(home)
+		fs, err := initStorage()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't populate filesystem for conair.", err)
+			return 1
+		}
 
 		if fs.Exists(snapshotPath) {
 			fmt.Fprintln(os.Stderr, "Snapshot already exists.")
@@ -52,7 +54,11 @@ func runSnapshot(args []string) (exit int) {
 		snapshot := args[1]
 		snapshotPath := fmt.Sprintf(".cnr-snapshot-%s", snapshot)
 
-		fs, _ := btrfs.Init(home)
+		fs, err := initStorage()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't populate filesystem for conair.", err)
+			return 1
+		}
 
 		if !fs.Exists(snapshotPath) {
 			fmt.Fprintln(os.Stderr, "Snapshot doesn't exist.")
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/giantswarm/conair/btrfs"
+	"github.com/giantswarm/conair/overlay"
+	"github.com/giantswarm/conair/vfs"
+)
+
+// Driver manages the volumes images, layers and containers are stored in.
+// Volume names are relative to the conair home.
+type Driver interface {
+	Snapshot(from, to string, readonly bool) error
+	Subvolume(vol string) error
+	Remove(vol string) error
+	Exists(vol string) bool
+	// Rename moves a volume to a new name which must not exist yet.
+	Rename(from, to string) error
+	GetSubvolumeUuid(vol string) (string, error)
+	GetSubvolumeParentUuid(vol string) (string, error)
+	GetLayerByUuid(uuid string) (string, error)
+	// List returns the names of all volumes directly below the home.
+	List() ([]string, error)
+}
+
+const (
+	DriverAuto    = "auto"
+	DriverBtrfs   = "btrfs"
+	DriverOverlay = "overlay"
+	DriverVfs     = "vfs"
+)
+
+// filesystem magics of statfs overlayfs can keep its layers on
+const (
+	magicExt4 = 0xef53
+	magicXfs  = 0x58465342
+)
+
+// statfs is replaced by tests
+var statfs = syscall.Statfs
+
+// Init returns the storage driver with the given name. The automatic driver
+// is chosen by the filesystem of the home: btrfs on btrfs, overlayfs on ext4
+// and xfs if the kernel has it, plain directories otherwise.
+func Init(name, home string) (Driver, error) {
+	switch name {
+	case DriverAuto, "":
+		if err := os.MkdirAll(home, 0700); err != nil {
+			return nil, err
+		}
+		name, err := detect(home)
+		if err != nil {
+			return nil, err
+		}
+		fs, err := Init(name, home)
+		if name == DriverOverlay && err == overlay.ErrPrerequisites {
+			return Init(DriverVfs, home)
+		}
+		return fs, err
+	case DriverBtrfs:
+		fs, err := btrfs.Init(home)
+		if err != nil {
+			return nil, err
+		}
+		return fs, nil
+	case DriverOverlay:
+		fs, err := overlay.Init(home)
+		if err != nil {
+			return nil, err
+		}
+		return fs, nil
+	case DriverVfs:
+		fs, err := vfs.Init(home)
+		if err != nil {
+			return nil, err
+		}
+		return fs, nil
+	}
+	return nil, fmt.Errorf("Unknown storage driver: %s", name)
+}
+
+// detect returns the driver for the filesystem of the home.
+func detect(home string) (string, error) {
+	var buf syscall.Statfs_t
+	if err := statfs(home, &buf); err != nil {
+		return "", err
+	}
+
+	switch magic := btrfs.FsMagic(buf.Type); {
+	case magic == btrfs.FsMagicBtrfs || magic == btrfs.FsMagicBtrfs32Bit:
+		return DriverBtrfs, nil
+	case magic == magicExt4 || magic == magicXfs:
+		return DriverOverlay, nil
+	}
+	return DriverVfs, nil
+}
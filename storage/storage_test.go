@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/giantswarm/conair/btrfs"
+)
+
+func TestDetect(t *testing.T) {
+	old := statfs
+	defer func() { statfs = old }()
+
+	tests := []struct {
+		magic  int64
+		driver string
+	}{
+		{int64(btrfs.FsMagicBtrfs), DriverBtrfs},
+		{int64(btrfs.FsMagicBtrfs32Bit), DriverBtrfs},
+		{0xef53, DriverOverlay},
+		{0x58465342, DriverOverlay},
+		// tmpfs, overlayfs and nfs
+		{0x01021994, DriverVfs},
+		{0x794c7630, DriverVfs},
+		{0x6969, DriverVfs},
+	}
+	for _, test := range tests {
+		statfs = func(path string, buf *syscall.Statfs_t) error {
+			buf.Type = test.magic
+			return nil
+		}
+		if driver, err := detect("/var/lib/machines"); err != nil || driver != test.driver {
+			t.Errorf("filesystem %x has driver %s %v, want %s", test.magic, driver, err, test.driver)
+		}
+	}
+
+	statfs = func(path string, buf *syscall.Statfs_t) error {
+		return syscall.EACCES
+	}
+	if _, err := detect("/var/lib/machines"); !os.IsPermission(err) {
+		t.Errorf("statfs error wasn't returned: %v", err)
+	}
+}
@@ -0,0 +1,289 @@
+package vfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+
+	"code.google.com/p/go-uuid/uuid"
+
+	"github.com/giantswarm/conair/fileutil"
+)
+
+const (
+	// directory below the conair home where the volume index is stored
+	storageDir = ".cnr-vfs"
+	indexFile  = "volumes.json"
+	lockFile   = "lock"
+)
+
+// volume is a plain directory. Snapshots are full copies, so readonly is only
+// recorded, not enforced.
+type volume struct {
+	Uuid       string `json:"uuid"`
+	ParentUuid string `json:"parentUuid,omitempty"`
+	ReadOnly   bool   `json:"readonly,omitempty"`
+}
+
+// Driver stores volumes as plain directories. It works on every filesystem,
+// but snapshots cost a copy of the whole tree unless the filesystem supports
+// reflinks.
+type Driver struct {
+	home    string
+	root    string
+	volumes map[string]*volume
+}
+
+func Init(home string) (*Driver, error) {
+	d := &Driver{
+		home:    home,
+		root:    fmt.Sprintf("%s/%s", home, storageDir),
+		volumes: map[string]*volume{},
+	}
+
+	if err := os.MkdirAll(d.root, 0700); err != nil {
+		return nil, err
+	}
+
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Driver) Snapshot(from, to string, readonly bool) error {
+	fromPath := d.volumePath(from)
+	toPath := d.volumePath(to)
+
+	if !d.Exists(from) {
+		return fmt.Errorf("Volume does not exist: %s", fromPath)
+	}
+	if d.Exists(to) {
+		return fmt.Errorf("Snapshot already exists: %s", toPath)
+	}
+
+	if err := fileutil.CopyTree(fromPath, toPath); err != nil {
+		os.RemoveAll(toPath)
+		return fmt.Errorf("Couldn't copy volume %s: %v", fromPath, err)
+	}
+
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// nested volumes were copied along with their parent
+	for name, v := range d.volumes {
+		if strings.HasPrefix(name, from+"/") {
+			d.volumes[to+strings.TrimPrefix(name, from)] = &volume{
+				Uuid:       uuid.New(),
+				ParentUuid: v.Uuid,
+				ReadOnly:   readonly,
+			}
+		}
+	}
+
+	d.volumes[to] = &volume{
+		Uuid:       uuid.New(),
+		ParentUuid: d.uuid(from),
+		ReadOnly:   readonly,
+	}
+	return d.save()
+}
+
+func (d *Driver) Subvolume(vol string) error {
+	volPath := d.volumePath(vol)
+	if _, err := os.Stat(volPath); err == nil {
+		return fmt.Errorf("Subvolume already exists: %s", volPath)
+	}
+
+	if err := os.Mkdir(volPath, 0755); err != nil {
+		return err
+	}
+
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	d.volumes[vol] = &volume{
+		Uuid: uuid.New(),
+	}
+	return d.save()
+}
+
+func (d *Driver) Exists(vol string) bool {
+	_, err := os.Stat(d.volumePath(vol))
+	return err == nil
+}
+
+func (d *Driver) GetSubvolumeUuid(vol string) (string, error) {
+	if !d.Exists(vol) {
+		return "", fmt.Errorf("Volume does not exist: %s", d.volumePath(vol))
+	}
+	if _, ok := d.volumes[vol]; ok {
+		return d.uuid(vol), nil
+	}
+
+	unlock, err := d.lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	return d.uuid(vol), d.save()
+}
+
+func (d *Driver) GetSubvolumeParentUuid(vol string) (string, error) {
+	v, ok := d.volumes[vol]
+	if !ok || v.ParentUuid == "" {
+		return "-", nil
+	}
+	return v.ParentUuid, nil
+}
+
+func (d *Driver) GetLayerByUuid(uuid string) (string, error) {
+	for name, v := range d.volumes {
+		if v.Uuid == uuid && !strings.Contains(name, "/") {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("No layer found")
+}
+
+func (d *Driver) List() ([]string, error) {
+	names := []string{}
+	for name := range d.volumes {
+		if !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (d *Driver) Remove(vol string) error {
+	volPath := d.volumePath(vol)
+
+	if !d.Exists(vol) {
+		return fmt.Errorf("Volume does not exist: %s", volPath)
+	}
+
+	if err := os.RemoveAll(volPath); err != nil {
+		return err
+	}
+
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for name := range d.volumes {
+		if name == vol || strings.HasPrefix(name, vol+"/") {
+			delete(d.volumes, name)
+		}
+	}
+	return d.save()
+}
+
+func (d *Driver) Rename(from, to string) error {
+	if !d.Exists(from) {
+		return fmt.Errorf("Volume does not exist: %s", d.volumePath(from))
+	}
+	if d.Exists(to) {
+		return fmt.Errorf("Volume already exists: %s", d.volumePath(to))
+	}
+
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.Rename(d.volumePath(from), d.volumePath(to)); err != nil {
+		return err
+	}
+	moved := map[string]*volume{}
+	for name, v := range d.volumes {
+		if name == from || strings.HasPrefix(name, from+"/") {
+			delete(d.volumes, name)
+			moved[to+strings.TrimPrefix(name, from)] = v
+		}
+	}
+	for name, v := range moved {
+		d.volumes[name] = v
+	}
+	return d.save()
+}
+
+// lock serializes changes of the index between conair processes (eg parallel
+// builds) and reloads the index. The returned function releases the lock.
+func (d *Driver) lock() (func(), error) {
+	f, err := os.OpenFile(fmt.Sprintf("%s/%s", d.root, lockFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := d.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// uuid returns the uuid of a volume. Directories that weren't created by the
+// driver (eg an image extracted by hand) get one assigned on first use.
+func (d *Driver) uuid(vol string) string {
+	v, ok := d.volumes[vol]
+	if !ok {
+		v = &volume{Uuid: uuid.New()}
+		d.volumes[vol] = v
+	}
+	return v.Uuid
+}
+
+func (d *Driver) load() error {
+	data, err := ioutil.ReadFile(d.indexPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	volumes := map[string]*volume{}
+	if err := json.Unmarshal(data, &volumes); err != nil {
+		return err
+	}
+	d.volumes = volumes
+	return nil
+}
+
+func (d *Driver) save() error {
+	data, err := json.MarshalIndent(d.volumes, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := d.indexPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.indexPath())
+}
+
+func (d *Driver) volumePath(vol string) string {
+	return fmt.Sprintf("%s/%s", d.home, vol)
+}
+
+func (d *Driver) indexPath() string {
+	return fmt.Sprintf("%s/%s", d.root, indexFile)
+}
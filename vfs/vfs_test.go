@@ -0,0 +1,97 @@
+package vfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	home := t.TempDir()
+	d, err := Init(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Subvolume("base"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Subvolume("base/nested"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(home+"/base/nested/file", []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Snapshot("base", "app", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := ioutil.ReadFile(home + "/app/nested/file"); err != nil || string(data) != "content" {
+		t.Errorf("snapshot doesn't have the files of its source: %q %v", data, err)
+	}
+	base, _ := d.GetSubvolumeUuid("base")
+	if parent, _ := d.GetSubvolumeParentUuid("app"); parent != base {
+		t.Errorf("snapshot has parent %s, want %s", parent, base)
+	}
+	nested, _ := d.GetSubvolumeUuid("base/nested")
+	if parent, _ := d.GetSubvolumeParentUuid("app/nested"); parent != nested {
+		t.Errorf("nested snapshot has parent %s, want %s", parent, nested)
+	}
+	if err := d.Snapshot("base", "app", false); err == nil {
+		t.Error("snapshot replaced an existing volume")
+	}
+
+	// snapshots don't share files
+	if err := ioutil.WriteFile(home+"/app/nested/file", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(home + "/base/nested/file"); string(data) != "content" {
+		t.Errorf("change of the snapshot changed its source: %q", data)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	home := t.TempDir()
+	d, err := Init(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Subvolume("base"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Snapshot("base", "app", false); err != nil {
+		t.Fatal(err)
+	}
+	app, _ := d.GetSubvolumeUuid("app")
+	if err := d.Rename("app", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Remove("base"); err != nil {
+		t.Fatal(err)
+	}
+	// directories created without the driver get a uuid on first use
+	if err := os.Mkdir(home+"/foreign", 0755); err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := d.GetSubvolumeUuid("foreign")
+	if err != nil || foreign == "" {
+		t.Fatalf("directory without volume has no uuid: %v", err)
+	}
+
+	d, err = Init(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := d.List(); len(names) != 2 || names[0] != "foreign" || names[1] != "renamed" {
+		t.Errorf("unexpected volumes %v", names)
+	}
+	if name, err := d.GetLayerByUuid(app); err != nil || name != "renamed" {
+		t.Errorf("volume of uuid %s is %s %v", app, name, err)
+	}
+	if uuid, _ := d.GetSubvolumeUuid("foreign"); uuid != foreign {
+		t.Errorf("uuid of the directory changed from %s to %s", foreign, uuid)
+	}
+	if d.Exists("base") {
+		t.Error("removed volume exists")
+	}
+}